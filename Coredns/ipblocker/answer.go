@@ -0,0 +1,63 @@
+package ipblocker
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/miekg/dns"
+)
+
+// checkAnswer checks the answer to a client's query: every CNAME target in the
+// chain against the client's blocklists, to catch trackers cloaked behind
+// first-party names, and the A and AAAA addresses against the client's IP
+// blocklists
+func (ib *IPBlocker) checkAnswer(clientIP, domain string, msg *dns.Msg) dnslookup.Verdict {
+	verdict := dnslookup.Verdict{ClientIP: clientIP, Domain: domain, Allowed: true}
+	checkIPs := ib.DNSFilter.HasIPBlocklists(clientIP)
+
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			if cnameVerdict := ib.checkCNAME(clientIP, domain, rr.Target); !cnameVerdict.Allowed {
+				return cnameVerdict
+			}
+			continue
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		if !checkIPs {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		// A records hold IPv4 addresses in their 16 byte form
+		if answerVerdict := ib.DNSFilter.EvaluateAnswerIP(clientIP, domain, addr.Unmap()); !answerVerdict.Allowed {
+			return answerVerdict
+		}
+	}
+
+	return verdict
+}
+
+// checkCNAME checks a CNAME target in the answer for domain. Only a matching
+// blocklist blocks the answer: in whitelist mode the targets are typically
+// CDN names nobody lists, and the queried name was already allowed.
+func (ib *IPBlocker) checkCNAME(clientIP, domain, target string) dnslookup.Verdict {
+	cnameVerdict := ib.DNSFilter.Evaluate(clientIP, target)
+	if cnameVerdict.Allowed || cnameVerdict.ListType != "blocklist" {
+		return dnslookup.Verdict{ClientIP: clientIP, Domain: domain, Allowed: true}
+	}
+
+	cnameVerdict.Domain = domain
+	cnameVerdict.CNAME = target
+	return cnameVerdict
+}
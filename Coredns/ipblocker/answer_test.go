@@ -0,0 +1,142 @@
+package ipblocker
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newAnswerTestFilter returns a filter with a blocklist "ads", a whitelist
+// "allowed" and an IP blocklist "bad", used by 10.240.0.1 in blocklist mode
+// and by 10.240.0.2 in whitelist mode
+func newAnswerTestFilter(t *testing.T) *dnslookup.DNSFilter {
+	t.Helper()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "etc", "clients.json"), `{
+  "10.240.0.1": {"blocklists": ["ads"], "whitelists": [], "ipblocklists": ["bad"], "mode": "blocklist"},
+  "10.240.0.2": {"blocklists": ["ads"], "whitelists": ["allowed"], "mode": "whitelist"}
+}`)
+	writeTestFile(t, filepath.Join(dir, "blocklists", "ads"), "ads.example.com\n")
+	writeTestFile(t, filepath.Join(dir, "whitelists", "allowed"), "www.example.org\n")
+	writeTestFile(t, filepath.Join(dir, "ipblocklists", "bad"), "203.0.113.0/24\n203.0.113.7\n2001:db8:bad::/48\n")
+
+	df := dnslookup.NewDNSFilter(filepath.Join(dir, "etc", "clients.json"),
+		filepath.Join(dir, "blocklists"), filepath.Join(dir, "whitelists"), filepath.Join(dir, "ipblocklists"))
+	if err := df.Initialize(); err != nil {
+		t.Fatalf("Expected no error initializing the filter, got %v", err)
+	}
+	t.Cleanup(func() { df.Close() })
+	return df
+}
+
+// answerMsg returns an answer to a query for domain with the records rrs
+func answerMsg(t *testing.T, domain string, rrs ...string) *dns.Msg {
+	t.Helper()
+
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeA)
+	m.Response = true
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("Expected no error parsing %q, got %v", s, err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestCheckAnswer(t *testing.T) {
+	ib := &IPBlocker{DNSFilter: newAnswerTestFilter(t)}
+
+	tests := []struct {
+		clientIP string
+		domain   string
+		answer   []string
+		allowed  bool
+		listType string
+		rule     string
+		cname    string
+		answerIP string
+	}{
+		{"10.240.0.1", "www.example.com.", []string{"www.example.com. 300 IN A 192.0.2.1"}, true, "", "", "", ""},
+		{"10.240.0.1", "www.example.com.", []string{"www.example.com. 300 IN A 203.0.113.7"}, false, "ipblocklist", "203.0.113.7/32", "", "203.0.113.7"},
+		{"10.240.0.1", "www.example.com.", []string{"www.example.com. 300 IN A 192.0.2.1", "www.example.com. 300 IN A 203.0.113.8"}, false, "ipblocklist", "203.0.113.0/24", "", "203.0.113.8"},
+		{"10.240.0.1", "www.example.com.", []string{"www.example.com. 300 IN AAAA 2001:db8:bad::1"}, false, "ipblocklist", "2001:db8:bad::/48", "", "2001:db8:bad::1"},
+		{"10.240.0.1", "www.example.com.", []string{"www.example.com. 300 IN AAAA 2001:db8::1"}, true, "", "", "", ""},
+		{"10.240.0.1", "metrics.example.com.", []string{
+			"metrics.example.com. 300 IN CNAME cdn.example.net.",
+			"cdn.example.net. 300 IN CNAME ads.example.com.",
+			"ads.example.com. 300 IN A 192.0.2.1",
+		}, false, "blocklist", "ads.example.com", "ads.example.com.", ""},
+		{"10.240.0.1", "www.example.com.", []string{"www.example.com. 300 IN CNAME cdn.example.net.", "cdn.example.net. 300 IN A 192.0.2.1"}, true, "", "", "", ""},
+		// In whitelist mode only blocklists block CNAME targets, and there are no IP blocklists
+		{"10.240.0.2", "www.example.org.", []string{"www.example.org. 300 IN CNAME cdn.example.net.", "cdn.example.net. 300 IN A 203.0.113.7"}, true, "", "", "", ""},
+	}
+
+	for i, tc := range tests {
+		verdict := ib.checkAnswer(tc.clientIP, tc.domain, answerMsg(t, tc.domain, tc.answer...))
+		if verdict.Allowed != tc.allowed || verdict.ListType != tc.listType || verdict.Rule != tc.rule ||
+			verdict.CNAME != tc.cname || verdict.AnswerIP != tc.answerIP {
+			t.Errorf("Test %d: expected allowed %v by %s %q (CNAME %q, address %q), got %v by %s %q (CNAME %q, address %q)", i,
+				tc.allowed, tc.listType, tc.rule, tc.cname, tc.answerIP,
+				verdict.Allowed, verdict.ListType, verdict.Rule, verdict.CNAME, verdict.AnswerIP)
+		}
+		if verdict.Domain != tc.domain {
+			t.Errorf("Test %d: expected the verdict for %s, got %s", i, tc.domain, verdict.Domain)
+		}
+	}
+}
+
+func TestServeDNSAnswer(t *testing.T) {
+	tests := []struct {
+		answer []string
+		rcode  int
+	}{
+		{[]string{"www.example.com. 300 IN A 192.0.2.1", "www.example.com. 300 IN AAAA 2001:db8::1"}, dns.RcodeSuccess},
+		{[]string{"www.example.com. 300 IN A 203.0.113.7"}, dns.RcodeNameError},
+		{[]string{"www.example.com. 300 IN CNAME ads.example.com.", "ads.example.com. 300 IN A 192.0.2.1"}, dns.RcodeNameError},
+	}
+
+	ib := &IPBlocker{DNSFilter: newAnswerTestFilter(t)}
+	for i, tc := range tests {
+		upstreamAnswer := answerMsg(t, "www.example.com.", tc.answer...)
+		ib.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := upstreamAnswer.Copy()
+			m.SetReply(r)
+			m.Answer = upstreamAnswer.Answer
+			w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		})
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ib.ServeDNS(context.Background(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if rec.Msg == nil || rec.Msg.Rcode != tc.rcode {
+			t.Fatalf("Test %d: expected rcode %s, got %v", i, dns.RcodeToString[tc.rcode], rec.Msg)
+		}
+		if tc.rcode != dns.RcodeSuccess {
+			continue
+		}
+		if len(rec.Msg.Answer) != len(tc.answer) {
+			t.Fatalf("Test %d: expected %d records, got %d", i, len(tc.answer), len(rec.Msg.Answer))
+		}
+		for j, rr := range rec.Msg.Answer {
+			if rr.String() != upstreamAnswer.Answer[j].String() {
+				t.Errorf("Test %d: expected record %d to pass unchanged as %s, got %s", i, j, upstreamAnswer.Answer[j], rr)
+			}
+		}
+	}
+}
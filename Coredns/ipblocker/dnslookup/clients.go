@@ -0,0 +1,150 @@
+package dnslookup
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// clientIndex finds the client entry covering an address by longest-prefix
+// match
+type clientIndex struct {
+	byPrefix map[netip.Prefix]string // Client entry key by network
+	lengths  []int                   // Prefix lengths in use, longest first
+}
+
+// IsClientID checks if a client entry key is a client ID like "kids-tablet",
+// which identifies DoH and DoT clients instead of their address. A client ID
+// is a DNS label in lowercase, so it can be used as server name prefix.
+func IsClientID(key string) bool {
+	if key == "" || len(key) > 63 || key[0] == '-' || key[len(key)-1] == '-' {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	_, err := netip.ParseAddr(key)
+	return err != nil
+}
+
+// ParseClientKey parses the key of a client entry, an IP address like
+// "10.8.0.2" or a network like "10.8.0.0/24" or "fd00::/64". It returns the
+// network the entry covers and the canonical form of the key.
+func ParseClientKey(key string) (netip.Prefix, string, error) {
+	if strings.Contains(key, "/") {
+		prefix, err := netip.ParsePrefix(key)
+		if err != nil {
+			return netip.Prefix{}, "", fmt.Errorf("invalid client network %s: %v", key, err)
+		}
+		if prefix.Addr().Is4In6() {
+			return netip.Prefix{}, "", fmt.Errorf("invalid client network %s: use the IPv4 form", key)
+		}
+		if prefix != prefix.Masked() {
+			return netip.Prefix{}, "", fmt.Errorf("client network %s has host bits set, use %s", key, prefix.Masked())
+		}
+		if prefix.IsSingleIP() {
+			return prefix, prefix.Addr().String(), nil
+		}
+		return prefix, prefix.String(), nil
+	}
+
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
+		return netip.Prefix{}, "", fmt.Errorf("invalid client address %s", key)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), addr.String(), nil
+}
+
+// buildClientIndex indexes the client entries by network. The caller must hold
+// the lock.
+func (df *DNSFilter) buildClientIndex() {
+	index := clientIndex{byPrefix: make(map[netip.Prefix]string)}
+
+	// Sort the keys so duplicates resolve the same way on every load
+	keys := make([]string, 0, len(df.Clients))
+	for key := range df.Clients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lengths := make(map[int]bool)
+	for _, key := range keys {
+		if IsClientID(key) {
+			continue // Only matches exactly
+		}
+		prefix, _, err := ParseClientKey(key)
+		if err != nil {
+			log.Printf("Warning: Client entry %s only matches exactly: %v", key, err)
+			continue
+		}
+		if existing, exists := index.byPrefix[prefix]; exists {
+			log.Printf("Warning: Client entries %s and %s cover the same network, using %s", existing, key, existing)
+			continue
+		}
+		index.byPrefix[prefix] = key
+		lengths[prefix.Bits()] = true
+	}
+
+	for bits := range lengths {
+		index.lengths = append(index.lengths, bits)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(index.lengths)))
+
+	df.clientIndex = index
+}
+
+// resolveClient finds the client entry for a client IP: the entry for exactly
+// this key if there is one, otherwise the entry with the longest network
+// containing the address. It returns the key of the entry. The caller must
+// hold the lock.
+func (df *DNSFilter) resolveClient(clientIP string) (string, ClientConfig, bool) {
+	if config, exists := df.Clients[clientIP]; exists {
+		return clientIP, config, true
+	}
+
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return "", ClientConfig{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+
+	for _, bits := range df.clientIndex.lengths {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix := netip.PrefixFrom(addr, bits).Masked()
+		if key, exists := df.clientIndex.byPrefix[prefix]; exists {
+			return key, df.Clients[key], true
+		}
+	}
+
+	return "", ClientConfig{}, false
+}
+
+// canonicalClientKey validates the key of a client entry, an address, a
+// network or a client ID, and returns its canonical form. The key must not
+// cover the same network as another entry than the one named by except. The
+// caller must hold the lock.
+func (df *DNSFilter) canonicalClientKey(key, except string) (string, error) {
+	if IsClientID(key) {
+		return key, nil
+	}
+
+	prefix, canonical, err := ParseClientKey(key)
+	if err != nil && !strings.Contains(key, "/") {
+		return "", fmt.Errorf("invalid client %s, expected an IP address, a network or a client ID", key)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if existing, exists := df.clientIndex.byPrefix[prefix]; exists && existing != except {
+		return "", fmt.Errorf("client %s covers the same network as client %s", key, existing)
+	}
+	return canonical, nil
+}
@@ -0,0 +1,112 @@
+package dnslookup
+
+import (
+	"testing"
+)
+
+func TestParseClientKey(t *testing.T) {
+	tests := []struct {
+		key       string
+		canonical string
+		bits      int
+		err       bool
+	}{
+		{"10.8.0.2", "10.8.0.2", 32, false},
+		{"::ffff:10.8.0.2", "10.8.0.2", 32, false},
+		{"10.8.0.0/24", "10.8.0.0/24", 24, false},
+		{"10.8.0.5/32", "10.8.0.5", 32, false},
+		{"fd00::/64", "fd00::/64", 64, false},
+		{"FD00::1", "fd00::1", 128, false},
+		{"10.8.0.1/24", "", 0, true},
+		{"::ffff:10.8.0.0/120", "", 0, true},
+		{"10.8.0.0/33", "", 0, true},
+		{"kids-tablet", "", 0, true},
+	}
+
+	for i, tc := range tests {
+		prefix, canonical, err := ParseClientKey(tc.key)
+		if (err != nil) != tc.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tc.err, err)
+			continue
+		}
+		if err == nil && (canonical != tc.canonical || prefix.Bits() != tc.bits) {
+			t.Errorf("Test %d: expected %s with %d bits, got %s with %d", i, tc.canonical, tc.bits, canonical, prefix.Bits())
+		}
+	}
+}
+
+func TestResolveClient(t *testing.T) {
+	df := &DNSFilter{Clients: map[string]ClientConfig{
+		"10.0.0.0/8":          {},
+		"10.1.0.0/16":         {},
+		"10.1.2.0/24":         {},
+		"10.1.2.3":            {},
+		"192.168.1.0/24":      {},
+		"fd00::/48":           {},
+		"fd00::/64":           {},
+		"kids-tablet":         {},
+		"::ffff:10.9.0.0/112": {}, // Invalid, only matches exactly
+	}}
+	df.buildClientIndex()
+
+	tests := []struct {
+		clientIP string
+		key      string
+	}{
+		{"10.1.2.3", "10.1.2.3"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.3.1", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"10.9.0.1", "10.0.0.0/8"},
+		{"::ffff:10.1.2.3", "10.1.2.3"},
+		{"::ffff:10.1.2.4", "10.1.2.0/24"},
+		{"::ffff:192.168.1.7", "192.168.1.0/24"},
+		{"192.168.2.1", ""},
+		{"fd00::1", "fd00::/64"},
+		{"fd00::1%eth0", "fd00::/64"},
+		{"fd00:0:0:1::1", "fd00::/48"},
+		{"fd01::1", ""},
+		{"11.0.0.1", ""},
+		{"kids-tablet", "kids-tablet"},
+		{"other-tablet", ""},
+		{"::ffff:10.9.0.0/112", "::ffff:10.9.0.0/112"},
+	}
+
+	for i, tc := range tests {
+		key, _, found := df.resolveClient(tc.clientIP)
+		if found != (tc.key != "") || key != tc.key {
+			t.Errorf("Test %d: expected %s to resolve to %q, got %q", i, tc.clientIP, tc.key, key)
+		}
+	}
+}
+
+func TestCanonicalClientKey(t *testing.T) {
+	df := &DNSFilter{Clients: map[string]ClientConfig{
+		"10.1.2.0/24": {},
+		"10.1.2.3":    {},
+	}}
+	df.buildClientIndex()
+
+	tests := []struct {
+		key       string
+		except    string
+		canonical string
+		err       bool
+	}{
+		{"10.1.0.0/16", "", "10.1.0.0/16", false},
+		{"::ffff:10.1.2.4", "", "10.1.2.4", false},
+		{"10.1.2.0/24", "", "", true},
+		{"10.1.2.3/32", "", "", true},
+		{"::ffff:10.1.2.3", "", "", true},
+		{"10.1.2.3/32", "10.1.2.3", "10.1.2.3", false},
+		{"kids-tablet", "", "kids-tablet", false},
+		{"not a client", "", "", true},
+	}
+
+	for i, tc := range tests {
+		canonical, err := df.canonicalClientKey(tc.key, tc.except)
+		if (err != nil) != tc.err || canonical != tc.canonical {
+			t.Errorf("Test %d: expected %q with error %v, got %q with %v", i, tc.canonical, tc.err, canonical, err)
+		}
+	}
+}
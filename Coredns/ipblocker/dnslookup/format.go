@@ -0,0 +1,609 @@
+package dnslookup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// List formats understood when importing lists
+const (
+	FormatAuto    = "auto"    // Detect the format from the content
+	FormatDomains = "domains" // One domain per line, e.g. "example.com !mail"
+	FormatHosts   = "hosts"   // Hosts file, e.g. "0.0.0.0 ads.example.com"
+	FormatABP     = "abp"     // AdBlock Plus/AdGuard rules, e.g. "||ads.example.com^"
+	FormatDnsmasq = "dnsmasq" // dnsmasq configuration, e.g. "address=/ads.example.com/"
+	FormatIP      = "ip"      // One address or network per line, for IP blocklists
+)
+
+// Limits of format detection and of the skipped rules reported
+const (
+	detectSampleSize  = 100
+	maxSkippedSamples = 10
+	maxLineLength     = 1024 * 1024
+)
+
+// hostsLocalNames are the names of the local machine found in most hosts
+// files, which are not meant to be blocked
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// ParseStats describes how a domain list was imported
+type ParseStats struct {
+	Format  string   `json:"format"`            // Format the list was parsed as
+	Rules   int      `json:"rules"`             // Rules taken over into the list
+	Skipped int      `json:"skipped"`           // Unsupported or invalid rules that were left out
+	Samples []string `json:"samples,omitempty"` // The first skipped rules with the reason
+	Errors  []string `json:"errors,omitempty"`  // The first malformed rules, e.g. regular expressions that do not compile
+
+	count int // Rules in the trie, duplicates counted once
+}
+
+// skip records a rule that was left out
+func (s *ParseStats) skip(line, reason string) {
+	s.Skipped++
+	if len(s.Samples) < maxSkippedSamples {
+		s.Samples = append(s.Samples, line+": "+reason)
+	}
+}
+
+// fail records a malformed rule, which is left out as well
+func (s *ParseStats) fail(line string, err error) {
+	s.skip(line, err.Error())
+	if len(s.Errors) < maxSkippedSamples {
+		s.Errors = append(s.Errors, line+": "+err.Error())
+	}
+}
+
+// listRule is a rule read from a domain list
+type listRule struct {
+	domain     string
+	exceptions []string
+	pattern    bool // domain is a glob or regular expression rule
+	exact      bool // The rule only matches the domain, not its subdomains
+	allow      bool // ABP "@@" rule, excluding the domain from a block rule
+}
+
+// insertRule adds a block rule to a trie
+func insertRule(root *Node, rule listRule) error {
+	if rule.exact {
+		InsertExactDomain(root, rule.domain)
+		return nil
+	}
+	if !rule.pattern {
+		InsertDomain(root, rule.domain, rule.exceptions)
+		return nil
+	}
+
+	pattern, err := CompilePatternRule(rule.domain)
+	if err != nil {
+		return err
+	}
+	root.addPattern(pattern)
+	return nil
+}
+
+// validateListFormat checks if a format can be used for a list type
+func validateListFormat(listType, format string) error {
+	if listType == "ipblocklist" {
+		if format == "" || format == FormatIP {
+			return nil
+		}
+	} else {
+		switch format {
+		case "", FormatAuto, FormatDomains, FormatHosts, FormatABP, FormatDnsmasq:
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported format for %s: %s", listType, format)
+}
+
+// ParseDomainLines creates a trie from the lines of a domain list. An empty
+// format or FormatAuto detects the format from the content. Rules that cannot
+// be represented are left out and counted in the returned stats.
+func ParseDomainLines(lines []string, format string) (*Node, ParseStats) {
+	if format == "" || format == FormatAuto {
+		format = DetectListFormat(lines)
+	}
+
+	root := NewNode()
+	stats := ParseStats{Format: format}
+
+	type allowRule struct{ line, domain string }
+	allows := []allowRule{}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if isCommentLine(format, line) {
+			continue
+		}
+
+		rules, reason := parseRule(format, line)
+		if reason != "" {
+			stats.skip(line, reason)
+			continue
+		}
+
+		for _, rule := range rules {
+			if rule.allow {
+				allows = append(allows, allowRule{line, rule.domain})
+				continue
+			}
+			if err := insertRule(root, rule); err != nil {
+				stats.fail(line, err)
+				continue
+			}
+			stats.Rules++
+		}
+	}
+
+	// Allow rules apply to the block rules of the whole list, so they are
+	// inserted once all block rules are known
+	for _, allow := range allows {
+		if reason := insertAllowRule(root, allow.domain); reason != "" {
+			stats.skip(allow.line, reason)
+			continue
+		}
+		stats.Rules++
+	}
+
+	stats.count = countDomainsInTrie(root)
+	return root, stats
+}
+
+// DetectListFormat guesses the format of a domain list from its first rules.
+// A "# Format: NAME" comment before the first rule declares the format.
+func DetectListFormat(lines []string) string {
+	votes := make(map[string]int)
+	sampled := 0
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if sampled == 0 {
+				if format, ok := formatDirective(line); ok {
+					return format
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "[Adblock") {
+			return FormatABP
+		}
+
+		votes[classifyLine(line)]++
+		sampled++
+		if sampled >= detectSampleSize {
+			break
+		}
+	}
+
+	best := FormatDomains
+	for _, format := range []string{FormatHosts, FormatABP, FormatDnsmasq} {
+		if votes[format] > votes[best] {
+			best = format
+		}
+	}
+	return best
+}
+
+// classifyLine returns the format a single line most likely belongs to
+func classifyLine(line string) string {
+	switch {
+	case isRegexRule(line):
+		return "" // Regular expressions are used by several formats
+	case strings.HasPrefix(line, "address=/"), strings.HasPrefix(line, "local=/"), strings.HasPrefix(line, "server=/"):
+		return FormatDnsmasq
+	case strings.HasPrefix(line, "|"), strings.HasPrefix(line, "@@"), strings.HasPrefix(line, "!"), strings.Contains(line, "^"):
+		return FormatABP
+	}
+
+	if fields := strings.Fields(line); len(fields) >= 2 {
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			return FormatHosts
+		}
+	}
+	return FormatDomains
+}
+
+// formatDirective reads a "# Format: NAME" comment
+func formatDirective(line string) (string, bool) {
+	directive := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+	if !strings.HasPrefix(directive, "format:") {
+		return "", false
+	}
+
+	format := strings.TrimSpace(strings.TrimPrefix(directive, "format:"))
+	switch format {
+	case FormatDomains, FormatHosts, FormatABP, FormatDnsmasq:
+		return format, true
+	}
+	return "", false
+}
+
+// withFormatHeader prepends a format declaration to the lines of a list that
+// is not in the plain domains format, so it is parsed the same way when the
+// file is loaded again
+func withFormatHeader(format string, lines []string) []string {
+	if format == FormatDomains {
+		return lines
+	}
+	return append([]string{"# Format: " + format}, lines...)
+}
+
+// isCommentLine checks if a line is empty or a comment in a format
+func isCommentLine(format, line string) bool {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return true
+	}
+	return format == FormatABP && (strings.HasPrefix(line, "!") || strings.HasPrefix(line, "["))
+}
+
+// parseRule parses a line of a domain list. It returns the reason if the line
+// cannot be represented; lines without rules return neither.
+func parseRule(format, line string) ([]listRule, string) {
+	switch format {
+	case FormatHosts:
+		return parseHostsRule(line)
+	case FormatABP:
+		return parseABPRule(line)
+	case FormatDnsmasq:
+		return parseDnsmasqRule(line)
+	default:
+		return parseDomainsRule(line)
+	}
+}
+
+// parseDomainsRule parses "example.com !mail, !eu.forum", allow rules like
+// "@@api.example.com", exact rules like "=example.com" or "|example.com|",
+// and glob and regular expression rules like "ads*.example.com" and
+// "/^track[0-9]+\./"
+func parseDomainsRule(line string) ([]listRule, string) {
+	if isRegexRule(line) {
+		return []listRule{{domain: line, pattern: true}}, ""
+	}
+
+	if strings.HasPrefix(line, "@@") {
+		domain, ok := normalizeDomain(strings.TrimPrefix(line, "@@"))
+		if !ok {
+			return nil, "invalid allow rule"
+		}
+		return []listRule{{domain: domain, allow: true}}, ""
+	}
+
+	entry, exceptions := ParseDomainWithExceptions(line)
+	if name, exact := exactRuleDomain(entry); exact {
+		if len(exceptions) > 0 {
+			return nil, "exceptions of exact rules are not supported"
+		}
+		if IsPatternRule(name) {
+			return nil, "exact glob rules are not supported"
+		}
+		domain, ok := normalizeDomain(name)
+		if !ok {
+			return nil, "invalid domain"
+		}
+		return []listRule{{domain: domain, exact: true}}, ""
+	}
+
+	if IsPatternRule(entry) {
+		if len(exceptions) > 0 {
+			return nil, "exceptions of glob rules are not supported"
+		}
+		return []listRule{{domain: entry, pattern: true}}, ""
+	}
+
+	domain, ok := normalizeDomain(entry)
+	if !ok {
+		return nil, "invalid domain"
+	}
+
+	for i, exception := range exceptions {
+		exception, ok := normalizeDomain(exception)
+		if !ok {
+			return nil, "invalid exception"
+		}
+		exceptions[i] = exception
+	}
+
+	return []listRule{{domain: domain, exceptions: exceptions}}, ""
+}
+
+// parseHostsRule parses "0.0.0.0 ads.example.com tracker.example.com # comment"
+func parseHostsRule(line string) ([]listRule, string) {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		line = line[:idx]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, "not a hosts entry"
+	}
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return nil, "invalid address"
+	}
+
+	rules := []listRule{}
+	for _, name := range fields[1:] {
+		if hostsLocalNames[strings.ToLower(name)] {
+			continue
+		}
+		domain, ok := normalizeDomain(name)
+		if !ok {
+			return nil, "invalid domain " + name
+		}
+		rules = append(rules, listRule{domain: domain})
+	}
+
+	return rules, ""
+}
+
+// parseABPRule parses the network rules of AdBlock Plus/AdGuard lists that
+// apply to whole domains: "||example.com^", "||ads*.example.com^",
+// "@@||example.com^", "/regex/" and plain domains. Cosmetic rules, URL rules
+// and modifiers other than $important cannot be applied to DNS queries.
+func parseABPRule(line string) ([]listRule, string) {
+	for _, marker := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, marker) {
+			return nil, "cosmetic rule"
+		}
+	}
+
+	rule := listRule{}
+	pattern := line
+	if strings.HasPrefix(pattern, "@@") {
+		rule.allow = true
+		pattern = strings.TrimPrefix(pattern, "@@")
+	}
+
+	// Regular expressions may contain "$", so their modifiers follow the
+	// closing slash
+	if end := strings.LastIndex(pattern, "/"); strings.HasPrefix(pattern, "/") && end > 1 {
+		if options := pattern[end+1:]; options != "" && options != "$important" {
+			return nil, "unsupported modifier " + options
+		}
+		if rule.allow {
+			return nil, "allow rule with a regular expression"
+		}
+		return []listRule{{domain: pattern[:end+1], pattern: true}}, ""
+	}
+
+	if idx := strings.Index(pattern, "$"); idx >= 0 {
+		for _, option := range strings.Split(pattern[idx+1:], ",") {
+			if option != "important" {
+				return nil, "unsupported modifier $" + option
+			}
+		}
+		pattern = pattern[:idx]
+	}
+
+	if strings.HasPrefix(pattern, "||") {
+		pattern = strings.TrimPrefix(pattern, "||")
+		pattern = strings.TrimSuffix(strings.TrimSuffix(pattern, "|"), "^")
+	} else if strings.HasPrefix(pattern, "|") {
+		// "|example.com^" only matches the name itself
+		pattern = strings.TrimPrefix(pattern, "|")
+		pattern = strings.TrimSuffix(strings.TrimSuffix(pattern, "|"), "^")
+		if rule.allow {
+			return nil, "exact allow rule"
+		}
+		if strings.Contains(pattern, "*") {
+			return nil, "exact wildcard rule"
+		}
+		rule.exact = true
+	}
+	if strings.Contains(pattern, "*") {
+		if rule.allow {
+			return nil, "allow rule with a wildcard"
+		}
+		return []listRule{{domain: pattern, pattern: true}}, ""
+	}
+
+	domain, ok := normalizeDomain(pattern)
+	if !ok {
+		return nil, "unsupported rule"
+	}
+	rule.domain = domain
+
+	return []listRule{rule}, ""
+}
+
+// parseDnsmasqRule parses "address=/example.com/", "address=/example.com/0.0.0.0"
+// and "local=/example.com/". Rules that redirect or forward names elsewhere
+// cannot be represented.
+func parseDnsmasqRule(line string) ([]listRule, string) {
+	key, value, found := strings.Cut(line, "=")
+	if !found || !strings.HasPrefix(value, "/") {
+		return nil, "not a dnsmasq domain rule"
+	}
+
+	parts := strings.Split(value, "/")
+	names, target := parts[1:len(parts)-1], parts[len(parts)-1]
+	if len(names) == 0 {
+		return nil, "not a dnsmasq domain rule"
+	}
+
+	switch key {
+	case "address":
+		if target != "" && !isSinkholeTarget(target) {
+			return nil, "redirect to " + target
+		}
+	case "local", "server":
+		if target != "" {
+			return nil, "forward to " + target
+		}
+	default:
+		return nil, "unsupported option " + key
+	}
+
+	rules := []listRule{}
+	for _, name := range names {
+		if name == "#" {
+			return nil, "wildcard rule"
+		}
+		domain, ok := normalizeDomain(name)
+		if !ok {
+			return nil, "invalid domain " + name
+		}
+		rules = append(rules, listRule{domain: domain})
+	}
+
+	return rules, ""
+}
+
+// isSinkholeTarget checks if a dnsmasq address target blocks the name rather
+// than redirecting it
+func isSinkholeTarget(target string) bool {
+	if target == "#" {
+		return true
+	}
+	addr, err := netip.ParseAddr(target)
+	return err == nil && (addr.IsUnspecified() || addr.IsLoopback())
+}
+
+// insertAllowRule excludes a domain from the rules covering it: a rule for
+// the domain itself is lifted, and the domain becomes an exception of the most
+// specific rule above it. It returns the reason if no rule covers the domain.
+func insertAllowRule(root *Node, domain string) string {
+	parts := ReverseDomainParts(domain)
+	currentNode := root
+
+	var covering *Node
+	coveringDepth := -1
+	lifted := false
+
+	for i, part := range parts {
+		child, exists := currentNode.Children[part]
+		if !exists {
+			break
+		}
+		currentNode = child
+
+		if i == len(parts)-1 {
+			if currentNode.IsEndpoint || currentNode.IsExact {
+				currentNode.IsEndpoint = false
+				currentNode.IsExact = false
+				currentNode.Exceptions = make(map[string]bool)
+				lifted = true
+			}
+		} else if currentNode.IsEndpoint {
+			covering = currentNode
+			coveringDepth = i
+		}
+	}
+
+	if covering != nil {
+		path := make([]string, 0, len(parts)-coveringDepth-1)
+		for i := len(parts) - 1; i > coveringDepth; i-- {
+			path = append(path, parts[i])
+		}
+		covering.Exceptions[strings.Join(path, ".")] = true
+		return ""
+	}
+	if lifted {
+		return ""
+	}
+	return "no block rule to allow"
+}
+
+// hasCoveringRule checks if a domain rule of a trie covers a domain
+func hasCoveringRule(root *Node, domain string) bool {
+	parts := ReverseDomainParts(domain)
+	currentNode := root
+
+	for i, part := range parts {
+		child, exists := currentNode.Children[part]
+		if !exists {
+			return false
+		}
+		currentNode = child
+
+		if currentNode.IsEndpoint || (i == len(parts)-1 && currentNode.IsExact) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomain lowercases a domain and checks that it is a valid name
+func normalizeDomain(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if domain == "" || len(domain) > 253 {
+		return "", false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return "", false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", false
+			}
+		}
+	}
+
+	return domain, true
+}
+
+// readLines reads all lines of a list
+func readLines(r io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// exactRulePrefix marks rules that only match the name itself in the domains
+// format, e.g. "=example.com"
+const exactRulePrefix = "="
+
+// exactRuleDomain returns the name of an exact rule, written "=example.com"
+// or "|example.com|"
+func exactRuleDomain(entry string) (string, bool) {
+	if strings.HasPrefix(entry, exactRulePrefix) {
+		return strings.TrimPrefix(entry, exactRulePrefix), true
+	}
+	if len(entry) > 2 && strings.HasPrefix(entry, "|") && strings.HasSuffix(entry, "|") {
+		return entry[1 : len(entry)-1], true
+	}
+	return "", false
+}
+
+// ruleKey returns the rule of a domain list entry without its exceptions, in
+// the form it is saved in, so entries can be compared
+func ruleKey(entry string) string {
+	rules, reason := parseDomainsRule(strings.TrimSpace(entry))
+	if reason != "" || len(rules) != 1 || rules[0].allow {
+		return entry
+	}
+	if rules[0].exact {
+		return exactRulePrefix + rules[0].domain
+	}
+	return rules[0].domain
+}
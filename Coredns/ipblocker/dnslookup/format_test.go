@@ -0,0 +1,201 @@
+package dnslookup
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// checkNames checks which names a trie matches
+func checkNames(t *testing.T, test int, root *Node, matched, unmatched []string) {
+	t.Helper()
+
+	for _, name := range matched {
+		if !IsDomainBlocked(root, name) {
+			t.Errorf("Test %d: expected %s to match", test, name)
+		}
+	}
+	for _, name := range unmatched {
+		if IsDomainBlocked(root, name) {
+			t.Errorf("Test %d: expected %s not to match", test, name)
+		}
+	}
+}
+
+func TestDetectListFormat(t *testing.T) {
+	tests := []struct {
+		lines  []string
+		format string
+	}{
+		{[]string{}, FormatDomains},
+		{[]string{"# Ads", "ads.example.com", "tracker.example.com !cdn"}, FormatDomains},
+		{[]string{"0.0.0.0 ads.example.com", "0.0.0.0 tracker.example.com", "ads.example.net"}, FormatHosts},
+		{[]string{"||ads.example.com^", "||ads.example.net^", "tracker.example.com"}, FormatABP},
+		{[]string{"||ads.example.com^", "tracker.example.com"}, FormatDomains},
+		{[]string{"[Adblock Plus 2.0]", "ads.example.com"}, FormatABP},
+		{[]string{"address=/ads.example.com/", "local=/tracker.example.com/"}, FormatDnsmasq},
+		{[]string{"/^ads[0-9]+\\./", "ads.example.com"}, FormatDomains},
+		{[]string{"# Format: abp", "ads.example.com"}, FormatABP},
+		{[]string{"ads.example.com", "# Format: hosts"}, FormatDomains},
+		{[]string{"# Format: unknown", "0.0.0.0 ads.example.com"}, FormatHosts},
+	}
+
+	for i, tc := range tests {
+		if format := DetectListFormat(tc.lines); format != tc.format {
+			t.Errorf("Test %d: expected format %s, got %s", i, tc.format, format)
+		}
+	}
+}
+
+func TestParseDomainLines(t *testing.T) {
+	tests := []struct {
+		format    string
+		lines     []string
+		rules     int
+		skipped   int
+		errors    int
+		matched   []string
+		unmatched []string
+	}{
+		{
+			format: FormatDomains,
+			lines: []string{
+				"# Ads", "",
+				"ads.example.com",
+				"Tracker.Example.NET.",
+				"example.org !mail",
+				"@@api.ads.example.com",
+				"bad domain !mail",
+				"exa$mple.com",
+				"=exact.example.com !mail",
+			},
+			rules:     4,
+			skipped:   3,
+			matched:   []string{"ads.example.com", "x.ads.example.com", "tracker.example.net.", "www.example.org"},
+			unmatched: []string{"api.ads.example.com", "mail.example.org", "example.com", "exact.example.com"},
+		},
+		{
+			format: FormatHosts,
+			lines: []string{
+				"# Hosts",
+				"0.0.0.0 ads.example.com tracker.example.com # Ads",
+				"127.0.0.1 localhost",
+				"::1 ip6-localhost ip6-loopback",
+				"0.0.0.0",
+				"300.0.0.1 ads.example.net",
+				"0.0.0.0 bad!name.example.com",
+			},
+			rules:     2,
+			skipped:   3,
+			matched:   []string{"ads.example.com", "cdn.tracker.example.com"},
+			unmatched: []string{"localhost", "ads.example.net", "example.com"},
+		},
+		{
+			format: FormatABP,
+			lines: []string{
+				"[Adblock Plus 2.0]",
+				"! Title: Ads",
+				"||ads.example.com^",
+				"||track*.example.net^",
+				"|exact.example.org^",
+				"@@||good.ads.example.com^",
+				`/^banner[0-9]+\./`,
+				"||important.example.com^$important",
+				"example.com##.banner",
+				"||example.com^$third-party",
+				"@@||nothing.example.com^",
+				"/[/",
+			},
+			rules:   6,
+			skipped: 4,
+			errors:  1,
+			matched: []string{"ads.example.com", "tracker1.example.net", "cdn.track.example.net", "exact.example.org",
+				"banner12.example.com", "important.example.com"},
+			unmatched: []string{"good.ads.example.com", "www.exact.example.org", "banner.example.com", "example.com"},
+		},
+		{
+			// An allow rule does not lift the more specific rules below it
+			format:    FormatABP,
+			lines:     []string{"||example.com^", "||ads.example.com^", "@@||example.com^"},
+			rules:     3,
+			matched:   []string{"ads.example.com", "x.ads.example.com"},
+			unmatched: []string{"example.com", "www.example.com"},
+		},
+		{
+			format: FormatDnsmasq,
+			lines: []string{
+				"# dnsmasq",
+				"address=/ads.example.com/",
+				"address=/tracker.example.com/0.0.0.0",
+				"local=/local.example.org/",
+				"address=/a.example.net/b.example.net/::",
+				"server=/corp.example.com/10.0.0.1",
+				"address=/redirect.example.com/192.168.1.1",
+				"address=/#/",
+				"no-resolv",
+			},
+			rules:     5,
+			skipped:   4,
+			matched:   []string{"ads.example.com", "cdn.tracker.example.com", "local.example.org", "a.example.net", "b.example.net"},
+			unmatched: []string{"corp.example.com", "redirect.example.com", "example.net"},
+		},
+	}
+
+	for i, tc := range tests {
+		root, stats := ParseDomainLines(tc.lines, tc.format)
+		if stats.Format != tc.format {
+			t.Errorf("Test %d: expected format %s, got %s", i, tc.format, stats.Format)
+		}
+		if stats.Rules != tc.rules || stats.Skipped != tc.skipped || len(stats.Errors) != tc.errors {
+			t.Errorf("Test %d: expected %d rules, %d skipped and %d errors, got %d, %d and %d (%v)", i,
+				tc.rules, tc.skipped, tc.errors, stats.Rules, stats.Skipped, len(stats.Errors), stats.Samples)
+		}
+		if len(stats.Samples) != stats.Skipped {
+			t.Errorf("Test %d: expected a sample for each of the %d skipped rules, got %d", i, stats.Skipped, len(stats.Samples))
+		}
+		checkNames(t, i, root, tc.matched, tc.unmatched)
+
+		// Detection agrees with the declared format
+		if _, detected := ParseDomainLines(tc.lines, FormatAuto); detected.Format != tc.format {
+			t.Errorf("Test %d: expected %s to be detected, got %s", i, tc.format, detected.Format)
+		}
+	}
+}
+
+func TestParseIPList(t *testing.T) {
+	list, err := ParseIPList(strings.NewReader(strings.Join([]string{
+		"# Networks",
+		"10.0.0.0/8",
+		"192.168.1.1",
+		"::ffff:203.0.113.5",
+		"2001:db8::/32",
+		"bad",
+		"10.0.0.0/33",
+		"",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(list.Prefixes) != 4 {
+		t.Fatalf("Expected 4 entries, got %v", list.Entries())
+	}
+
+	tests := []struct {
+		ip     string
+		prefix string
+	}{
+		{"10.1.2.3", "10.0.0.0/8"},
+		{"192.168.1.1", "192.168.1.1/32"},
+		{"::ffff:192.168.1.1", "192.168.1.1/32"},
+		{"203.0.113.5", "203.0.113.5/32"},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"192.168.1.2", ""},
+		{"8.8.8.8", ""},
+	}
+	for i, tc := range tests {
+		prefix, found := list.Match(netip.MustParseAddr(tc.ip))
+		if found != (tc.prefix != "") || (found && prefix.String() != tc.prefix) {
+			t.Errorf("Test %d: expected %s to match %q, got %q", i, tc.ip, tc.prefix, prefix)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package dnslookup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IPList is a list of IP networks, matched against the addresses in DNS answers
+type IPList struct {
+	Prefixes []netip.Prefix // Sorted by address and length, see index
+
+	lengths []int // Lengths of the networks, longest first
+}
+
+// ParseIPEntry parses an IP list entry, either a single address or a CIDR
+// network like "10.0.0.0/8" or "2001:db8::/32"
+func ParseIPEntry(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network %s: %v", entry, err)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %s: %v", entry, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// NewIPList creates an IP list from entries, failing on the first invalid one
+func NewIPList(entries []string) (*IPList, error) {
+	list := &IPList{}
+	for _, entry := range entries {
+		prefix, err := ParseIPEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		list.Prefixes = append(list.Prefixes, prefix)
+	}
+	list.index()
+	return list, nil
+}
+
+// index sorts the networks of the list, drops duplicates and collects their
+// lengths for Match. It must be called once the networks are complete.
+func (l *IPList) index() {
+	sort.Slice(l.Prefixes, func(i, j int) bool { return lessPrefix(l.Prefixes[i], l.Prefixes[j]) })
+
+	prefixes := l.Prefixes[:0]
+	lengths := make(map[int]bool)
+	for i, prefix := range l.Prefixes {
+		if i > 0 && prefix == l.Prefixes[i-1] {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+		lengths[prefix.Bits()] = true
+	}
+	l.Prefixes = prefixes
+
+	l.lengths = nil
+	for bits := range lengths {
+		l.lengths = append(l.lengths, bits)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(l.lengths)))
+}
+
+// lessPrefix orders networks by address, then by length
+func lessPrefix(a, b netip.Prefix) bool {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c < 0
+	}
+	return a.Bits() < b.Bits()
+}
+
+// Match returns the most specific network of the list containing ip
+func (l *IPList) Match(ip netip.Addr) (netip.Prefix, bool) {
+	ip = ip.Unmap().WithZone("")
+	for _, bits := range l.lengths {
+		if bits > ip.BitLen() {
+			continue
+		}
+		prefix := netip.PrefixFrom(ip, bits).Masked()
+		i := sort.Search(len(l.Prefixes), func(i int) bool { return !lessPrefix(l.Prefixes[i], prefix) })
+		if i < len(l.Prefixes) && l.Prefixes[i] == prefix {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Entries returns the networks of the list in file format
+func (l *IPList) Entries() []string {
+	entries := make([]string, 0, len(l.Prefixes))
+	for _, prefix := range l.Prefixes {
+		entries = append(entries, prefix.String())
+	}
+	return entries
+}
+
+// LoadIPList loads an IP list from a file, skipping invalid lines
+func LoadIPList(filename string) (*IPList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	list, err := ParseIPList(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s: %v", filename, err)
+	}
+
+	return list, nil
+}
+
+// ParseIPList reads an IP list, skipping invalid lines
+func ParseIPList(r io.Reader) (*IPList, error) {
+	list := &IPList{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Ignore empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		prefix, err := ParseIPEntry(line)
+		if err != nil {
+			log.Printf("Warning: Skipping IP list entry: %v", err)
+			continue
+		}
+		list.Prefixes = append(list.Prefixes, prefix)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	list.index()
+	return list, nil
+}
+
+// getIPListContent returns the content of an IP blocklist
+func (df *DNSFilter) getIPListContent(listName string) (*ListContent, error) {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	list, exists := df.IPBlocklists[listName]
+	if !exists {
+		return nil, fmt.Errorf("list not found: %s", listName)
+	}
+
+	return &ListContent{
+		Name:         listName,
+		Type:         "ipblocklist",
+		Domains:      list.Entries(),
+		Subscription: df.copySubscription("ipblocklist", listName),
+	}, nil
+}
+
+// createIPList creates a new IP blocklist
+func (df *DNSFilter) createIPList(list *ListContent) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if _, exists := df.IPBlocklists[list.Name]; exists {
+		return fmt.Errorf("ipblocklist already exists: %s", list.Name)
+	}
+
+	ipList, err := NewIPList(list.Domains)
+	if err != nil {
+		return err
+	}
+
+	df.IPBlocklists[list.Name] = ipList
+	return df.SaveDomainList(list.Name, list.Type, ipList.Entries())
+}
+
+// updateIPList replaces the content of an existing IP blocklist
+func (df *DNSFilter) updateIPList(list *ListContent) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if _, exists := df.IPBlocklists[list.Name]; !exists {
+		return fmt.Errorf("list not found: %s", list.Name)
+	}
+
+	ipList, err := NewIPList(list.Domains)
+	if err != nil {
+		return err
+	}
+
+	df.IPBlocklists[list.Name] = ipList
+	return df.SaveDomainList(list.Name, list.Type, ipList.Entries())
+}
+
+// deleteIPList deletes an IP blocklist, the caller must hold the lock
+func (df *DNSFilter) deleteIPList(listName string) error {
+	if _, exists := df.IPBlocklists[listName]; !exists {
+		return fmt.Errorf("list not found: %s", listName)
+	}
+
+	delete(df.IPBlocklists, listName)
+	delete(df.listErrors, listKey("ipblocklist", listName))
+	df.removeListReferencesFromClients(listName, "ipblocklist")
+
+	filePath := filepath.Join(df.IPBlocklistDir, listName)
+	if err := os.Remove(filePath); err != nil {
+		log.Printf("Warning: Could not delete file: %v", err)
+	}
+
+	return nil
+}
+
+// addIPEntries adds networks to an IP blocklist
+func (df *DNSFilter) addIPEntries(listName string, entries []string) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	list, exists := df.IPBlocklists[listName]
+	if !exists {
+		return fmt.Errorf("list not found: %s", listName)
+	}
+
+	added, err := NewIPList(entries)
+	if err != nil {
+		return err
+	}
+
+	// Build a new list so concurrent readers never see a partial update
+	updated := &IPList{Prefixes: make([]netip.Prefix, 0, len(list.Prefixes)+len(added.Prefixes))}
+	updated.Prefixes = append(updated.Prefixes, list.Prefixes...)
+	updated.Prefixes = append(updated.Prefixes, added.Prefixes...)
+	updated.index()
+
+	df.IPBlocklists[listName] = updated
+	return df.SaveDomainList(listName, "ipblocklist", updated.Entries())
+}
+
+// removeIPEntries removes networks from an IP blocklist
+func (df *DNSFilter) removeIPEntries(listName string, entries []string) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	list, exists := df.IPBlocklists[listName]
+	if !exists {
+		return fmt.Errorf("list not found: %s", listName)
+	}
+
+	removed, err := NewIPList(entries)
+	if err != nil {
+		return err
+	}
+
+	updated := &IPList{}
+	for _, prefix := range list.Prefixes {
+		if !containsPrefix(removed.Prefixes, prefix) {
+			updated.Prefixes = append(updated.Prefixes, prefix)
+		}
+	}
+	updated.index()
+
+	df.IPBlocklists[listName] = updated
+	return df.SaveDomainList(listName, "ipblocklist", updated.Entries())
+}
+
+// containsPrefix checks if a slice of networks contains a network
+func containsPrefix(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// EvaluateAnswerIP checks an address from the answer to a client's query for
+// domain against the client's IP blocklists. The verdict is allowed unless
+// the address is in one of them.
+func (df *DNSFilter) EvaluateAnswerIP(clientIP, domain string, ip netip.Addr) Verdict {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	verdict := Verdict{
+		ClientIP: clientIP,
+		Domain:   domain,
+		Allowed:  true,
+	}
+
+	key, config, exists := df.resolveClient(clientIP)
+	if !exists {
+		verdict.UnknownClient = true
+		policy := df.unknownClientPolicy()
+		verdict.Policy = policy.Action
+		if policy.Action != UnknownClientTemplate {
+			return verdict
+		}
+		config = *policy.Template
+	}
+	config = df.effectiveConfig(config)
+	verdict.Client = key
+	verdict.Mode = config.Mode
+	verdict.BlockResponse = config.BlockResponse
+
+	for _, listName := range config.IPBlocklistRefs {
+		list, exists := df.IPBlocklists[listName]
+		if !exists {
+			log.Printf("Warning: Referenced ipblocklist not found: %s", listName)
+			continue
+		}
+
+		if prefix, matched := list.Match(ip); matched {
+			log.Printf("Answer %s for %s (client %s) blocked by ipblocklist %s (%s)",
+				ip, domain, clientIP, listName, prefix)
+			verdict.Allowed = false
+			verdict.ListType = "ipblocklist"
+			verdict.ListName = listName
+			verdict.Rule = prefix.String()
+			verdict.AnswerIP = ip.String()
+			return verdict
+		}
+	}
+
+	return verdict
+}
+
+// HasIPBlocklists reports whether answers to a client's queries have to be
+// checked against IP blocklists
+func (df *DNSFilter) HasIPBlocklists(clientIP string) bool {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	_, config, exists := df.resolveClient(clientIP)
+	if !exists {
+		if policy := df.unknownClientPolicy(); policy.Action == UnknownClientTemplate {
+			config = *policy.Template
+		}
+	}
+	return len(df.effectiveConfig(config).IPBlocklistRefs) > 0
+}
@@ -0,0 +1,96 @@
+package dnslookup
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPListMatch(t *testing.T) {
+	list, err := ParseIPList(strings.NewReader(`# Unsorted, the most specific network matches
+203.0.113.0/24
+10.0.0.0/8
+10.1.0.0/16
+203.0.113.7
+10.1.0.0/16
+2001:db8::/32
+2001:db8:bad::/48
+::ffff:192.0.2.1
+not an address
+`))
+	if err != nil {
+		t.Fatalf("Expected no error parsing the list, got %v", err)
+	}
+	if entries := strings.Join(list.Entries(), " "); entries != "10.0.0.0/8 10.1.0.0/16 192.0.2.1/32 203.0.113.0/24 203.0.113.7/32 2001:db8::/32 2001:db8:bad::/48" {
+		t.Errorf("Expected the entries sorted without duplicates, got %s", entries)
+	}
+
+	tests := []struct {
+		ip     string
+		prefix string
+	}{
+		{"10.1.2.3", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"::ffff:10.1.2.3", "10.1.0.0/16"},
+		{"203.0.113.7", "203.0.113.7/32"},
+		{"203.0.113.8", "203.0.113.0/24"},
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"192.0.2.2", ""},
+		{"2001:db8:bad::1", "2001:db8:bad::/48"},
+		{"2001:db8:1::1", "2001:db8::/32"},
+		{"fe80::1%eth0", ""},
+		{"11.0.0.1", ""},
+	}
+
+	for i, tc := range tests {
+		prefix, matched := list.Match(netip.MustParseAddr(tc.ip))
+		if matched != (tc.prefix != "") || (matched && prefix.String() != tc.prefix) {
+			t.Errorf("Test %d: expected %s to match %q, got %s (%v)", i, tc.ip, tc.prefix, prefix, matched)
+		}
+	}
+}
+
+func TestEvaluateAnswerIP(t *testing.T) {
+	df := newTestFilter(t, `{
+		"10.0.0.1": {"blocklists": [], "whitelists": [], "ipblocklists": ["bad", "private"], "mode": "blocklist", "blockResponse": "nodata"},
+		"10.0.0.2": {"blocklists": [], "whitelists": [], "mode": "blocklist"}
+	}`, map[string]string{
+		"ipblocklist/bad":     "203.0.113.0/24\n203.0.113.7\n2001:db8:bad::/48\n",
+		"ipblocklist/private": "10.0.0.0/8\n",
+	})
+
+	tests := []struct {
+		clientIP string
+		ip       string
+		allowed  bool
+		listName string
+		rule     string
+	}{
+		{"10.0.0.1", "203.0.113.7", false, "bad", "203.0.113.7/32"},
+		{"10.0.0.1", "203.0.113.8", false, "bad", "203.0.113.0/24"},
+		{"10.0.0.1", "2001:db8:bad::1", false, "bad", "2001:db8:bad::/48"},
+		{"10.0.0.1", "10.1.2.3", false, "private", "10.0.0.0/8"},
+		{"10.0.0.1", "192.0.2.1", true, "", ""},
+		{"10.0.0.2", "203.0.113.7", true, "", ""},
+		{"10.0.0.3", "203.0.113.7", true, "", ""}, // Unknown client
+	}
+
+	for i, tc := range tests {
+		verdict := df.EvaluateAnswerIP(tc.clientIP, "www.example.com", netip.MustParseAddr(tc.ip))
+		if verdict.Allowed != tc.allowed || verdict.ListName != tc.listName || verdict.Rule != tc.rule {
+			t.Errorf("Test %d: expected %s for %s allowed %v by %q (%s), got %v by %q (%s)", i,
+				tc.ip, tc.clientIP, tc.allowed, tc.listName, tc.rule, verdict.Allowed, verdict.ListName, verdict.Rule)
+		}
+		if !verdict.Allowed && (verdict.ListType != "ipblocklist" || verdict.AnswerIP != tc.ip || verdict.BlockResponse != "nodata") {
+			t.Errorf("Test %d: expected an ipblocklist verdict for %s with block response nodata, got %+v", i, tc.ip, verdict)
+		}
+	}
+
+	// Added networks are matched right away, the most specific first
+	if err := df.AddDomains("bad", "ipblocklist", []string{"203.0.113.128/25"}); err != nil {
+		t.Fatalf("Expected no error adding a network, got %v", err)
+	}
+	if verdict := df.EvaluateAnswerIP("10.0.0.1", "www.example.com", netip.MustParseAddr("203.0.113.200")); verdict.Rule != "203.0.113.128/25" {
+		t.Errorf("Expected the added network to match, got %q", verdict.Rule)
+	}
+}
@@ -0,0 +1,281 @@
+package dnslookup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Override actions, temporarily changing the filtering of a client
+const (
+	OverridePause = "pause" // Allow every query, no list applies
+	OverrideAllow = "allow" // Allow a domain and its subdomains
+	OverrideBlock = "block" // Block a domain and its subdomains
+)
+
+// overridesFile is the file the overrides are stored in, next to the client
+// configuration
+const overridesFile = "overrides.json"
+
+// Override temporarily changes the filtering of a client until it expires
+type Override struct {
+	ID      string    `json:"id"`
+	Action  string    `json:"action"`           // "pause", "allow" or "block"
+	Domain  string    `json:"domain,omitempty"` // Domain allowed or blocked, with its subdomains
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// OverrideRequest creates an override lasting for a duration or until a time
+type OverrideRequest struct {
+	Action   string    `json:"action"`
+	Domain   string    `json:"domain,omitempty"`
+	Duration string    `json:"duration,omitempty"` // How long the override lasts, e.g. "15m"
+	Until    time.Time `json:"until,omitempty"`    // When the override expires, instead of a duration
+}
+
+// covers checks if the domain of an override covers a name
+func (o *Override) covers(name string) bool {
+	return name == o.Domain || strings.HasSuffix(name, "."+o.Domain)
+}
+
+// LoadOverrides loads the overrides from a JSON file
+func LoadOverrides(filename string) (map[string][]Override, error) {
+	overrides := make(map[string][]Override)
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading overrides: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("error parsing overrides: %v", err)
+	}
+
+	return overrides, nil
+}
+
+// overridesPath returns the file the overrides are stored in
+func (df *DNSFilter) overridesPath() string {
+	return filepath.Join(filepath.Dir(df.ConfigPath), overridesFile)
+}
+
+// saveOverrides saves the overrides, the caller must hold the lock
+func (df *DNSFilter) saveOverrides() error {
+	data, err := json.MarshalIndent(df.Overrides, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding overrides: %v", err)
+	}
+
+	if err := os.WriteFile(df.overridesPath(), data, 0644); err != nil {
+		return fmt.Errorf("error writing overrides: %v", err)
+	}
+
+	return nil
+}
+
+// newOverrideID returns a random ID for an override
+func newOverrideID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("error generating override id: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// GetOverrides returns the active overrides of a client entry, the ones
+// expiring first first
+func (df *DNSFilter) GetOverrides(ip string) ([]Override, error) {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	key := df.clientKey(ip)
+	if _, exists := df.Clients[key]; !exists {
+		return nil, fmt.Errorf("client not found: %s", ip)
+	}
+
+	now := df.clock()
+	result := []Override{}
+	for _, override := range df.Overrides[key] {
+		if now.Before(override.Expires) {
+			result = append(result, override)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Expires.Before(result[j].Expires) })
+
+	return result, nil
+}
+
+// CreateOverride adds an expiring override to a client entry
+func (df *DNSFilter) CreateOverride(ip string, request *OverrideRequest) (*Override, error) {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	key := df.clientKey(ip)
+	if _, exists := df.Clients[key]; !exists {
+		return nil, fmt.Errorf("client not found: %s", ip)
+	}
+
+	now := df.clock()
+	override := Override{Action: request.Action, Created: now}
+
+	// Check action and domain
+	switch request.Action {
+	case OverridePause:
+		if request.Domain != "" {
+			return nil, fmt.Errorf("override %s takes no domain", request.Action)
+		}
+	case OverrideAllow, OverrideBlock:
+		domain, ok := normalizeDomain(request.Domain)
+		if !ok {
+			return nil, fmt.Errorf("invalid override domain: %s", request.Domain)
+		}
+		override.Domain = domain
+	default:
+		return nil, fmt.Errorf("invalid override action: %s", request.Action)
+	}
+
+	// Check expiry, given either as a duration or a time
+	if request.Duration != "" && !request.Until.IsZero() {
+		return nil, fmt.Errorf("override takes either a duration or an expiry time")
+	}
+	if request.Duration != "" {
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid override duration: %s", request.Duration)
+		}
+		override.Expires = now.Add(duration)
+	} else if !request.Until.IsZero() {
+		override.Expires = request.Until
+	} else {
+		return nil, fmt.Errorf("override needs a duration or an expiry time")
+	}
+	if !override.Expires.After(now) {
+		return nil, fmt.Errorf("override must expire in the future")
+	}
+
+	id, err := newOverrideID()
+	if err != nil {
+		return nil, err
+	}
+	override.ID = id
+
+	df.Overrides[key] = append(df.Overrides[key], override)
+	if err := df.saveOverrides(); err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+// DeleteOverride removes an override of a client entry before it expires
+func (df *DNSFilter) DeleteOverride(ip, id string) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	key := df.clientKey(ip)
+	overrides := df.Overrides[key]
+	for i, override := range overrides {
+		if override.ID != id {
+			continue
+		}
+
+		remaining := append(append([]Override{}, overrides[:i]...), overrides[i+1:]...)
+		if len(remaining) == 0 {
+			delete(df.Overrides, key)
+		} else {
+			df.Overrides[key] = remaining
+		}
+		return df.saveOverrides()
+	}
+
+	return fmt.Errorf("override not found: %s", id)
+}
+
+// matchOverride returns the active override of a client entry deciding a
+// query: a block override for the domain, otherwise an allow override for the
+// domain, otherwise a pause. The caller must hold the lock.
+func (df *DNSFilter) matchOverride(key, domain string, now time.Time) (Override, bool) {
+	overrides := df.Overrides[key]
+	if len(overrides) == 0 {
+		return Override{}, false
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(domain, "."))
+	var allow, pause *Override
+	for i := range overrides {
+		override := &overrides[i]
+		if !now.Before(override.Expires) {
+			continue
+		}
+
+		switch override.Action {
+		case OverrideBlock:
+			if override.covers(name) {
+				return *override, true
+			}
+		case OverrideAllow:
+			if allow == nil && override.covers(name) {
+				allow = override
+			}
+		case OverridePause:
+			if pause == nil {
+				pause = override
+			}
+		}
+	}
+
+	if allow != nil {
+		return *allow, true
+	}
+	if pause != nil {
+		return *pause, true
+	}
+	return Override{}, false
+}
+
+// pruneOverrides drops expired overrides and those of deleted client entries.
+// While the client configuration cannot be loaded, overrides are kept for
+// all entries.
+func (df *DNSFilter) pruneOverrides() {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	now := df.clock()
+	pruned := 0
+	for key, overrides := range df.Overrides {
+		_, exists := df.Clients[key]
+		exists = exists || df.configError != ""
+
+		active := []Override{}
+		for _, override := range overrides {
+			if exists && now.Before(override.Expires) {
+				active = append(active, override)
+			}
+		}
+
+		pruned += len(overrides) - len(active)
+		if len(active) == 0 {
+			delete(df.Overrides, key)
+		} else {
+			df.Overrides[key] = active
+		}
+	}
+
+	if pruned == 0 {
+		return
+	}
+	log.Printf("Removed %d expired overrides", pruned)
+	if err := df.saveOverrides(); err != nil {
+		log.Printf("Warning: Could not save overrides: %v", err)
+	}
+}
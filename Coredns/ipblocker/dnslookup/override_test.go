@@ -0,0 +1,248 @@
+package dnslookup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// overrideClients filters ads for two clients
+const overrideClients = `{
+  "10.0.0.1": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"},
+  "10.0.0.2": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}
+}`
+
+// overrideTime is the time the overrides of the tests are created at
+var overrideTime = time.Date(2025, 4, 14, 18, 0, 0, 0, time.UTC)
+
+// newOverrideTestFilter returns a filter with the clients of overrideClients
+// at overrideTime, and a function moving its clock to an offset from it
+func newOverrideTestFilter(t *testing.T) (*DNSFilter, func(offset time.Duration)) {
+	t.Helper()
+
+	df := newTestFilter(t, overrideClients, map[string]string{"blocklist/ads": "ads.example.com\n"})
+	setOffset := func(offset time.Duration) {
+		df.SetClock(func() time.Time { return overrideTime.Add(offset) })
+	}
+	setOffset(0)
+	return df, setOffset
+}
+
+// createTestOverride creates an override and fails the test if it cannot
+func createTestOverride(t *testing.T, df *DNSFilter, ip string, request *OverrideRequest) *Override {
+	t.Helper()
+
+	override, err := df.CreateOverride(ip, request)
+	if err != nil {
+		t.Fatalf("Expected no error creating the %s override for %s, got %v", request.Action, ip, err)
+	}
+	return override
+}
+
+func TestMatchOverride(t *testing.T) {
+	df, setOffset := newOverrideTestFilter(t)
+
+	createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverridePause, Duration: "1h"})
+	createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverrideAllow, Domain: "ads.example.com", Duration: "30m"})
+	createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverrideBlock, Domain: "Example.ORG.", Duration: "15m"})
+	createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverrideAllow, Domain: "www.example.org", Until: overrideTime.Add(2 * time.Hour)})
+
+	tests := []struct {
+		offset   time.Duration
+		ip       string
+		domain   string
+		allowed  bool
+		override string
+		rule     string
+	}{
+		// Block before allow before pause
+		{0, "10.0.0.1", "ads.example.com", true, OverrideAllow, "ads.example.com"},
+		{0, "10.0.0.1", "www.example.org", false, OverrideBlock, "example.org"},
+		{0, "10.0.0.1", "WWW.Example.org.", false, OverrideBlock, "example.org"},
+		{0, "10.0.0.1", "example.net", true, OverridePause, ""},
+		{0, "10.0.0.2", "ads.example.com", false, "", "ads.example.com"}, // Overrides of another client
+
+		// Overrides end at their expiry time
+		{15*time.Minute - time.Second, "10.0.0.1", "www.example.org", false, OverrideBlock, "example.org"},
+		{15 * time.Minute, "10.0.0.1", "www.example.org", true, OverrideAllow, "www.example.org"},
+		{15 * time.Minute, "10.0.0.1", "mail.example.org", true, OverridePause, ""},
+		{45 * time.Minute, "10.0.0.1", "ads.example.com", true, OverridePause, ""},
+		{90 * time.Minute, "10.0.0.1", "ads.example.com", false, "", "ads.example.com"},
+		{90 * time.Minute, "10.0.0.1", "www.example.org", true, OverrideAllow, "www.example.org"},
+		{2 * time.Hour, "10.0.0.1", "www.example.org", true, "", ""},
+	}
+
+	for i, tc := range tests {
+		setOffset(tc.offset)
+
+		verdict := df.Evaluate(tc.ip, tc.domain)
+		if verdict.Allowed != tc.allowed || verdict.Override != tc.override || verdict.Rule != tc.rule {
+			t.Errorf("Test %d: expected %s for %s allowed %v by %q override (%q) after %v, got %v by %q (%q)", i,
+				tc.domain, tc.ip, tc.allowed, tc.override, tc.rule, tc.offset, verdict.Allowed, verdict.Override, verdict.Rule)
+		}
+		if (verdict.OverrideID != "") != (tc.override != "") {
+			t.Errorf("Test %d: expected an override ID only for an override, got %q", i, verdict.OverrideID)
+		}
+	}
+
+	// Only the active overrides are listed, the ones expiring first first
+	setOffset(20 * time.Minute)
+	overrides, err := df.GetOverrides("10.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected no error getting the overrides, got %v", err)
+	}
+	actions := []string{}
+	for _, override := range overrides {
+		actions = append(actions, override.Action+" "+override.Domain)
+	}
+	if !reflect.DeepEqual(actions, []string{"allow ads.example.com", "pause ", "allow www.example.org"}) {
+		t.Errorf("Expected the active overrides by expiry, got %q", actions)
+	}
+}
+
+func TestCreateOverride(t *testing.T) {
+	df, _ := newOverrideTestFilter(t)
+
+	tests := []struct {
+		ip      string
+		request OverrideRequest
+		err     string
+	}{
+		{"10.0.0.9", OverrideRequest{Action: OverridePause, Duration: "1h"}, "client not found"},
+		{"10.0.0.1", OverrideRequest{Action: "skip", Duration: "1h"}, "invalid override action"},
+		{"10.0.0.1", OverrideRequest{Action: OverridePause, Domain: "example.com", Duration: "1h"}, "takes no domain"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "not a domain", Duration: "1h"}, "invalid override domain"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "example.com"}, "needs a duration"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "example.com", Duration: "1h", Until: overrideTime.Add(time.Hour)}, "either a duration"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "example.com", Duration: "an hour"}, "invalid override duration"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "example.com", Duration: "-1h"}, "in the future"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "example.com", Until: overrideTime}, "in the future"},
+		{"10.0.0.1", OverrideRequest{Action: OverrideAllow, Domain: "example.com", Duration: "1h"}, ""},
+	}
+
+	for i, tc := range tests {
+		override, err := df.CreateOverride(tc.ip, &tc.request)
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("Test %d: expected error %q, got %v", i, tc.err, err)
+			continue
+		}
+		if err == nil && (override.ID == "" || !override.Created.Equal(overrideTime) || !override.Expires.Equal(overrideTime.Add(time.Hour))) {
+			t.Errorf("Test %d: expected an override created now for an hour, got %+v", i, override)
+		}
+	}
+
+	if len(df.Overrides["10.0.0.1"]) != 1 {
+		t.Errorf("Expected only the valid override to be added, got %d", len(df.Overrides["10.0.0.1"]))
+	}
+}
+
+func TestPruneOverrides(t *testing.T) {
+	df, setOffset := newOverrideTestFilter(t)
+
+	createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverridePause, Duration: "15m"})
+	kept := createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverrideAllow, Domain: "ads.example.com", Duration: "1h"})
+	createTestOverride(t, df, "10.0.0.2", &OverrideRequest{Action: OverridePause, Duration: "1h"})
+
+	// 10.0.0.2 is removed from the configuration file by hand
+	writeTestFile(t, df.ConfigPath, `{"10.0.0.1": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}}`)
+	df.reloadClientConfig()
+
+	setOffset(30 * time.Minute)
+	df.pruneOverrides()
+	if len(df.Overrides) != 1 || !reflect.DeepEqual(df.Overrides["10.0.0.1"], []Override{*kept}) {
+		t.Errorf("Expected only the active override of 10.0.0.1 to be kept, got %+v", df.Overrides)
+	}
+
+	// The pruned overrides are saved
+	loaded, err := LoadOverrides(df.overridesPath())
+	if err != nil {
+		t.Fatalf("Expected no error loading the overrides, got %v", err)
+	}
+	if len(loaded) != 1 || len(loaded["10.0.0.1"]) != 1 || loaded["10.0.0.1"][0].ID != kept.ID {
+		t.Errorf("Expected the pruned overrides to be saved, got %+v", loaded)
+	}
+
+	// Deleting a client drops its overrides right away
+	if err := df.DeleteClient("10.0.0.1"); err != nil {
+		t.Fatalf("Expected no error deleting the client, got %v", err)
+	}
+	if len(df.Overrides) != 0 {
+		t.Errorf("Expected the overrides of the deleted client to be dropped, got %+v", df.Overrides)
+	}
+}
+
+func TestPruneOverridesBrokenConfig(t *testing.T) {
+	df := newTestFiles(t, `{"10.0.0.1": `, nil)
+	writeTestFile(t, df.overridesPath(), `{"10.0.0.1": [
+  {"id": "a", "action": "pause", "created": "2025-04-14T18:00:00Z", "expires": "2025-04-14T18:15:00Z"},
+  {"id": "b", "action": "pause", "created": "2025-04-14T18:00:00Z", "expires": "2025-04-14T19:00:00Z"}
+]}`)
+	if err := df.Initialize(); err == nil {
+		t.Fatalf("Expected an error loading the client configuration")
+	}
+
+	// Overrides are kept while the clients are unknown, unless they expired
+	df.SetClock(func() time.Time { return overrideTime.Add(30 * time.Minute) })
+	df.pruneOverrides()
+	if overrides := df.Overrides["10.0.0.1"]; len(overrides) != 1 || overrides[0].ID != "b" {
+		t.Errorf("Expected the active override to be kept, got %+v", overrides)
+	}
+}
+
+func TestOverridePersistence(t *testing.T) {
+	df, _ := newOverrideTestFilter(t)
+
+	pause := createTestOverride(t, df, "10.0.0.1", &OverrideRequest{Action: OverridePause, Duration: "1h"})
+	block := createTestOverride(t, df, "10.0.0.2", &OverrideRequest{Action: OverrideBlock, Domain: "example.com", Duration: "2h"})
+
+	// A new filter on the same files picks the overrides up
+	loaded := NewDNSFilter(df.ConfigPath, df.BlocklistDir, df.WhitelistDir, df.IPBlocklistDir)
+	t.Cleanup(func() { loaded.Close() })
+	loaded.SetClock(func() time.Time { return overrideTime.Add(30 * time.Minute) })
+	if err := loaded.Initialize(); err != nil {
+		t.Fatalf("Expected no error initializing the filter, got %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		domain   string
+		allowed  bool
+		override *Override
+	}{
+		{"10.0.0.1", "ads.example.com", true, pause},
+		{"10.0.0.2", "www.example.com", false, block},
+		{"10.0.0.2", "example.net", true, nil},
+	}
+
+	for i, tc := range tests {
+		verdict := loaded.Evaluate(tc.ip, tc.domain)
+		id := ""
+		if tc.override != nil {
+			id = tc.override.ID
+		}
+		if verdict.Allowed != tc.allowed || verdict.OverrideID != id {
+			t.Errorf("Test %d: expected %s for %s allowed %v by override %q, got %v by %q", i,
+				tc.domain, tc.ip, tc.allowed, id, verdict.Allowed, verdict.OverrideID)
+		}
+	}
+
+	overrides, err := loaded.GetOverrides("10.0.0.2")
+	if err != nil {
+		t.Fatalf("Expected no error getting the overrides, got %v", err)
+	}
+	if len(overrides) != 1 || !overrides[0].Created.Equal(block.Created) || !overrides[0].Expires.Equal(block.Expires) {
+		t.Errorf("Expected the block override to be loaded as created, got %+v", overrides)
+	}
+
+	// Deleting an override is saved too
+	if err := loaded.DeleteOverride("10.0.0.1", pause.ID); err != nil {
+		t.Fatalf("Expected no error deleting the override, got %v", err)
+	}
+	if err := loaded.DeleteOverride("10.0.0.1", pause.ID); err == nil {
+		t.Errorf("Expected an error deleting the override again")
+	}
+	if saved, err := LoadOverrides(df.overridesPath()); err != nil || len(saved["10.0.0.1"]) != 0 || len(saved["10.0.0.2"]) != 1 {
+		t.Errorf("Expected only the block override to be saved, got %+v (%v)", saved, err)
+	}
+}
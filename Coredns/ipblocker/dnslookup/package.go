@@ -2,44 +2,122 @@ package dnslookup
 
 import (
 	"bufio"
+	"container/list"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // ListMetadata contains list metadata
 type ListMetadata struct {
 	Name         string    `json:"name"`
-	Type         string    `json:"type"` // "blocklist" or "whitelist"
+	Type         string    `json:"type"` // "blocklist", "whitelist" or "ipblocklist"
 	Count        int       `json:"count"`
 	LastModified time.Time `json:"lastModified"`
+	Error        string    `json:"error,omitempty"`   // Last error loading the file, the list keeps its previous content
+	Source       string    `json:"source,omitempty"`  // URL of the subscription the list is refreshed from
+	Format       string    `json:"format,omitempty"`  // Format the list was imported from
+	Skipped      int       `json:"skipped,omitempty"` // Rules left out on import because they are unsupported
 }
 
 // Node represents a node in the trie (part of a domain)
 type Node struct {
 	Children   map[string]*Node // Child nodes (next domain parts)
 	IsEndpoint bool             // Marks if a rule ends here
-	Exceptions map[string]bool  // Exceptions for specific subdomains (e.g. "!mail")
+	IsExact    bool             // Marks if a rule ends here that does not cover subdomains
+	Exceptions map[string]bool  // Exceptions for subdomain paths below the rule (e.g. "!mail" or "!eu.mail")
+	Patterns   []*PatternRule   // Glob and regular expression rules, only used on the root
 }
 
 // ClientConfig contains client configuration
 type ClientConfig struct {
-	IP            string   `json:"ip,omitempty"` // IP address (only for output)
-	BlocklistRefs []string `json:"blocklists"`   // References to blocklists
-	WhitelistRefs []string `json:"whitelists"`   // References to whitelists
-	Mode          string   `json:"mode"`         // "blocklist" or "whitelist"
+	IP              string     `json:"ip,omitempty"`            // IP address (only for output)
+	BlocklistRefs   []string   `json:"blocklists"`              // References to blocklists
+	WhitelistRefs   []string   `json:"whitelists"`              // References to whitelists
+	IPBlocklistRefs []string   `json:"ipblocklists,omitempty"`  // References to IP blocklists, checked against answers
+	Mode            string     `json:"mode"`                    // "blocklist", "whitelist", "mixed" or "strict", empty to use the profile's
+	BlockResponse   string     `json:"blockResponse,omitempty"` // Answer for blocked queries, empty for the profile's or the server default
+	Profile         string     `json:"profile,omitempty"`       // Profile the client uses, its lists are added to the profile's
+	Schedules       []Schedule `json:"schedules,omitempty"`     // Time windows adding lists or switching the mode
+}
+
+// IsValidMode reports whether mode is a known client mode:
+//   - blocklist: everything not in a blocklist is allowed
+//   - whitelist: only names in a whitelist are allowed
+//   - mixed: blocklists apply, but names in a whitelist are always allowed
+//   - strict: only names in a whitelist and in no blocklist are allowed
+func IsValidMode(mode string) bool {
+	return mode == "blocklist" || mode == "whitelist" || mode == "mixed" || mode == "strict"
+}
+
+// IsValidListType reports whether listType is a known list type
+func IsValidListType(listType string) bool {
+	return listType == "blocklist" || listType == "whitelist" || listType == "ipblocklist"
+}
+
+// Block response modes, selecting how blocked queries are answered
+const (
+	BlockResponseNXDomain = "nxdomain" // NXDOMAIN with SOA
+	BlockResponseNoData   = "nodata"   // NOERROR without answers, with SOA
+	BlockResponseRefused  = "refused"  // REFUSED
+	BlockResponseSinkhole = "sinkhole" // Answer with the sinkhole address
+)
+
+// IsValidBlockResponse reports whether mode is a known block response mode
+func IsValidBlockResponse(mode string) bool {
+	switch mode {
+	case BlockResponseNXDomain, BlockResponseNoData, BlockResponseRefused, BlockResponseSinkhole:
+		return true
+	}
+	return false
+}
+
+// Verdict explains the filtering decision for a client and a domain
+type Verdict struct {
+	ClientIP      string   `json:"clientIP"`
+	Client        string   `json:"client,omitempty"` // Client entry that matched, an address or network
+	Domain        string   `json:"domain"`
+	Allowed       bool     `json:"allowed"`
+	Mode          string   `json:"mode,omitempty"`          // Filtering mode of the client
+	Profile       string   `json:"profile,omitempty"`       // Profile the client uses
+	Schedules     []string `json:"schedules,omitempty"`     // Schedules of the client that applied
+	Override      string   `json:"override,omitempty"`      // Action of the override that decided, if any
+	OverrideID    string   `json:"overrideID,omitempty"`    // ID of the override that decided
+	ListName      string   `json:"listName,omitempty"`      // List that decided, if any
+	ListType      string   `json:"listType,omitempty"`      // "blocklist", "whitelist" or "ipblocklist"
+	Rule          string   `json:"rule,omitempty"`          // Matched rule, e.g. "example.com !mail" or "10.0.0.0/8"
+	AnswerIP      string   `json:"answerIP,omitempty"`      // Address in the answer that matched an IP blocklist
+	CNAME         string   `json:"cname,omitempty"`         // CNAME target in the answer that matched a blocklist
+	Exception     bool     `json:"exception"`               // An exception of the rule excluded the domain
+	UnknownClient bool     `json:"unknownClient"`           // The client has no configuration
+	Policy        string   `json:"policy,omitempty"`        // Unknown client policy that applied
+	BlockResponse string   `json:"blockResponse,omitempty"` // Block response configured for the client
+}
+
+// Match describes the result of looking up a domain in a trie
+type Match struct {
+	Matched   bool   // A rule covers the domain
+	Rule      string // The rule as written in the list, e.g. "example.com !mail"
+	Exception bool   // A rule covers the domain, but one of its exceptions excludes it
 }
 
 // ListContent represents the content of a list
 type ListContent struct {
-	Name    string   `json:"name"`
-	Type    string   `json:"type"` // "blocklist" or "whitelist"
-	Domains []string `json:"domains"`
+	Name         string        `json:"name"`
+	Type         string        `json:"type"`                   // "blocklist", "whitelist" or "ipblocklist"
+	Domains      []string      `json:"domains"`                // Domains, or addresses and networks for IP blocklists
+	Format       string        `json:"format,omitempty"`       // Format of the domains, detected if empty
+	Stats        *ParseStats   `json:"stats,omitempty"`        // Result of importing the domains
+	Subscription *Subscription `json:"subscription,omitempty"` // Remote source the list is refreshed from
 }
 
 // DNSFilter represents the complete DNS filtering system
@@ -47,25 +125,79 @@ type DNSFilter struct {
 	ConfigPath     string
 	BlocklistDir   string
 	WhitelistDir   string
+	IPBlocklistDir string
 	BlocklistTries map[string]*Node
 	WhitelistTries map[string]*Node
+	IPBlocklists   map[string]*IPList
 	Clients        map[string]ClientConfig
+	Profiles       map[string]Profile       // Filtering profiles shared by clients, keyed by name
+	Overrides      map[string][]Override    // Expiring overrides, keyed by client entry
+	Subscriptions  map[string]*Subscription // Remote list sources, keyed by listKey
 	mutex          sync.RWMutex
+
+	// File loading state, protected by mutex
+	configError   string                // Last error loading the client configuration
+	profilesError string                // Last error loading the profiles
+	listErrors    map[string]string     // Last error loading a list file, keyed by listKey
+	listStats     map[string]ParseStats // Result of importing a domain list, keyed by listKey
+	clientIndex   clientIndex           // Client entries by network
+	clock         func() time.Time      // Current time for schedules, replaceable in tests
+	lastReload    time.Time             // Last time a file was (re)loaded
+
+	// Unknown client policy, protected by mutex
+	defaultPolicy UnknownClientPolicy  // Policy from the Corefile
+	unknownPolicy *UnknownClientPolicy // Policy set through the API, overrides the default
+
+	// Unknown client counters, protected by unknownMutex
+	unknownClients map[string]*list.Element // Elements of unknownOrder holding an *UnknownClient
+	unknownOrder   *list.List               // Unknown clients, most recently seen first
+	unknownQueries uint64
+	unknownMutex   sync.Mutex
+
+	// File watching state, protected by watchMutex
+	watcher     *fsnotify.Watcher
+	watchTimers map[string]*time.Timer
+	watchMutex  sync.Mutex
+
+	// Subscription refresher state, protected by watchMutex
+	refresherStop chan struct{}
+	refreshMutex  sync.Mutex // Serializes subscription refreshes
+
+	// Subscriptions file state, the file is written without holding mutex
+	subscriptionsVersion uint64     // Incremented on every encoding, protected by mutex
+	subscriptionsSaved   uint64     // Version on disk, protected by subscriptionsSave
+	subscriptionsSave    sync.Mutex // Orders writes of the subscriptions file
 }
 
 // NewDNSFilter creates a new DNSFilter instance
-func NewDNSFilter(configPath, blocklistDir, whitelistDir string) *DNSFilter {
+func NewDNSFilter(configPath, blocklistDir, whitelistDir, ipBlocklistDir string) *DNSFilter {
 	return &DNSFilter{
 		ConfigPath:     configPath,
 		BlocklistDir:   blocklistDir,
 		WhitelistDir:   whitelistDir,
+		IPBlocklistDir: ipBlocklistDir,
 		BlocklistTries: make(map[string]*Node),
 		WhitelistTries: make(map[string]*Node),
+		IPBlocklists:   make(map[string]*IPList),
 		Clients:        make(map[string]ClientConfig),
+		Profiles:       make(map[string]Profile),
+		Overrides:      make(map[string][]Override),
+		Subscriptions:  make(map[string]*Subscription),
 		mutex:          sync.RWMutex{},
+		listErrors:     make(map[string]string),
+		listStats:      make(map[string]ParseStats),
+		defaultPolicy:  DefaultUnknownClientPolicy(),
+		unknownClients: make(map[string]*list.Element),
+		unknownOrder:   list.New(),
+		clock:          time.Now,
 	}
 }
 
+// listKey returns the key of a list in maps spanning all list types
+func listKey(listType, listName string) string {
+	return listType + "/" + listName
+}
+
 // NewNode creates a new trie node
 func NewNode() *Node {
 	return &Node{
@@ -77,8 +209,9 @@ func NewNode() *Node {
 
 // ReverseDomainParts splits a domain into components and reverses the order
 // "mail.google.com" → ["com", "google", "mail"]
+// A trailing dot of a fully qualified name is ignored.
 func ReverseDomainParts(domain string) []string {
-	parts := strings.Split(strings.ToLower(domain), ".")
+	parts := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
 	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
 		parts[i], parts[j] = parts[j], parts[i]
 	}
@@ -124,28 +257,118 @@ func InsertDomain(root *Node, domain string, exceptions []string) {
 	}
 }
 
+// InsertExactDomain adds a rule to the trie that only matches the domain
+// itself, not its subdomains
+func InsertExactDomain(root *Node, domain string) {
+	parts := ReverseDomainParts(domain)
+	currentNode := root
+
+	for _, part := range parts {
+		if _, exists := currentNode.Children[part]; !exists {
+			currentNode.Children[part] = NewNode()
+		}
+		currentNode = currentNode.Children[part]
+	}
+
+	currentNode.IsExact = true
+}
+
 // IsDomainBlocked checks if a domain is blocked in a blocklist
 func IsDomainBlocked(root *Node, domain string) bool {
+	return MatchDomain(root, domain).Matched
+}
+
+// MatchDomain looks up a domain in a trie and returns the rule covering it.
+// The pattern rules of the trie are only evaluated if no domain rule matches.
+func MatchDomain(root *Node, domain string) Match {
+	match := matchTrie(root, domain)
+	if match.Matched {
+		return match
+	}
+
+	if rule, matched := matchPatterns(root, domain); matched {
+		return Match{Matched: true, Rule: rule}
+	}
+	return match
+}
+
+// matchTrie looks up a domain in the domain rules of a trie. The most specific
+// rule or exception decides: "example.com !mail" and "eu.mail.example.com"
+// block eu.mail.example.com, but allow the rest of mail.example.com. A rule
+// for the same name as an exception takes precedence over the exception.
+func matchTrie(root *Node, domain string) Match {
 	parts := ReverseDomainParts(domain)
 	currentNode := root
 
+	block, blockDepth := Match{}, -1
+	exception, exceptionDepth := Match{}, -1
+
 	for i, part := range parts {
 		child, exists := currentNode.Children[part]
 		if !exists {
-			return false
+			break
 		}
 
 		currentNode = child
 
 		if currentNode.IsEndpoint {
-			if i+1 < len(parts) && currentNode.Exceptions[parts[i+1]] {
-				return false
+			block = Match{Matched: true, Rule: formatRule(parts[:i+1], currentNode)}
+			blockDepth = i
+
+			if depth := deepestException(currentNode, parts, i); depth > exceptionDepth {
+				exception = Match{Rule: block.Rule, Exception: true}
+				exceptionDepth = depth
 			}
-			return true
+		} else if i == len(parts)-1 && currentNode.IsExact {
+			// Exact rules only match the name itself
+			block = Match{Matched: true, Rule: exactRulePrefix + formatRule(parts, currentNode)}
+			blockDepth = i
 		}
 	}
 
-	return false
+	if exceptionDepth > blockDepth {
+		return exception
+	}
+	return block
+}
+
+// deepestException returns the depth in parts of the deepest exception of the
+// rule ending at node, found at depth i, that covers the name; -1 if none does.
+// Exceptions are paths below the rule, e.g. "mail" or "eu.mail".
+func deepestException(node *Node, parts []string, i int) int {
+	if len(node.Exceptions) == 0 {
+		return -1
+	}
+
+	deepest := -1
+	path := ""
+	for depth := i + 1; depth < len(parts); depth++ {
+		if path == "" {
+			path = parts[depth]
+		} else {
+			path = parts[depth] + "." + path
+		}
+		if node.Exceptions[path] {
+			deepest = depth
+		}
+	}
+	return deepest
+}
+
+// formatRule formats the rule ending at node, given its reversed domain parts
+func formatRule(reversedParts []string, node *Node) string {
+	parts := make([]string, len(reversedParts))
+	for i, part := range reversedParts {
+		parts[len(reversedParts)-1-i] = part
+	}
+
+	exceptions := make([]string, 0, len(node.Exceptions))
+	for exception := range node.Exceptions {
+		exceptions = append(exceptions, exception)
+	}
+	sort.Strings(exceptions)
+
+	return FormatDomainWithExceptions(strings.Join(parts, "."), exceptions)
 }
 
 // IsDomainAllowed checks if a domain is allowed in a whitelist
@@ -153,34 +376,35 @@ func IsDomainAllowed(root *Node, domain string) bool {
 	return IsDomainBlocked(root, domain) // Same logic as IsDomainBlocked
 }
 
-// LoadDomainList loads a domain list from a file and creates a trie
-func LoadDomainList(filename string) (*Node, error) {
+// LoadDomainList loads a domain list from a file and creates a trie, detecting
+// the format of the file
+func LoadDomainList(filename string) (*Node, ParseStats, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error opening file %s: %v", filename, err)
+		return nil, ParseStats{}, fmt.Errorf("error opening file %s: %v", filename, err)
 	}
 	defer file.Close()
 
-	root := NewNode()
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		// Ignore empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		domain, exceptions := ParseDomainWithExceptions(line)
-		InsertDomain(root, domain, exceptions)
+	root, stats, err := ParseDomainList(file, FormatAuto)
+	if err != nil {
+		return nil, ParseStats{}, fmt.Errorf("error reading file %s: %v", filename, err)
+	}
+	if stats.Skipped > 0 {
+		log.Printf("Warning: Skipped %d unsupported rules in %s (%s format)", stats.Skipped, filename, stats.Format)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file %s: %v", filename, err)
+	return root, stats, nil
+}
+
+// ParseDomainList reads a domain list in the given format and creates a trie
+func ParseDomainList(r io.Reader, format string) (*Node, ParseStats, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, ParseStats{}, err
 	}
 
-	return root, nil
+	root, stats := ParseDomainLines(lines, format)
+	return root, stats, nil
 }
 
 // FormatDomainWithExceptions formats a domain with its exceptions for the file
@@ -223,6 +447,17 @@ func extractDomainsFromTrie(node *Node, prefix []string, result *[]string) {
 		}
 
 		*result = append(*result, domain)
+	} else if node.IsExact {
+		reversedParts := make([]string, len(prefix))
+		copy(reversedParts, prefix)
+		for i, j := 0, len(reversedParts)-1; i < j; i, j = i+1, j-1 {
+			reversedParts[i], reversedParts[j] = reversedParts[j], reversedParts[i]
+		}
+		*result = append(*result, exactRulePrefix+strings.Join(reversedParts, "."))
+	}
+
+	for _, pattern := range node.Patterns {
+		*result = append(*result, pattern.Rule)
 	}
 
 	for part, child := range node.Children {
@@ -231,15 +466,26 @@ func extractDomainsFromTrie(node *Node, prefix []string, result *[]string) {
 	}
 }
 
+// savedListStats replaces the stats of a domain list saved from its trie with
+// the ones of the saved file: its rules in domains format, none skipped. The
+// caller must hold the lock.
+func (df *DNSFilter) savedListStats(listType, listName string, trie *Node, rules []string) {
+	df.listStats[listKey(listType, listName)] = ParseStats{
+		Format: FormatDomains,
+		Rules:  len(rules),
+		count:  countDomainsInTrie(trie),
+	}
+}
+
 // countDomainsInTrie counts the number of domains in a trie
 func countDomainsInTrie(node *Node) int {
 	if node == nil {
 		return 0
 	}
 
-	count := 0
-	if node.IsEndpoint {
-		count = 1
+	count := len(node.Patterns)
+	if node.IsEndpoint || node.IsExact {
+		count++
 	}
 
 	for _, child := range node.Children {
@@ -294,34 +540,55 @@ func (df *DNSFilter) SaveClientConfig() error {
 
 // SaveDomainList saves a domain list to a file
 func (df *DNSFilter) SaveDomainList(listName, listType string, domains []string) error {
+	dirPath, err := df.listDir(listType)
+	if err != nil {
+		return err
+	}
+
+	return writeListFile(filepath.Join(dirPath, listName), domains)
+}
+
+// listDir returns the directory holding the lists of a type, creating it if
+// needed
+func (df *DNSFilter) listDir(listType string) (string, error) {
 	var dirPath string
 	if listType == "blocklist" {
 		dirPath = df.BlocklistDir
 	} else if listType == "whitelist" {
 		dirPath = df.WhitelistDir
+	} else if listType == "ipblocklist" {
+		dirPath = df.IPBlocklistDir
 	} else {
-		return fmt.Errorf("invalid list type: %s", listType)
+		return "", fmt.Errorf("invalid list type: %s", listType)
 	}
 
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return fmt.Errorf("error creating directory %s: %v", dirPath, err)
+		return "", fmt.Errorf("error creating directory %s: %v", dirPath, err)
 	}
+	return dirPath, nil
+}
 
-	filePath := filepath.Join(dirPath, listName)
+// writeListFile writes the entries of a list to a file below a generated
+// header
+func writeListFile(filePath string, domains []string) error {
 	file, err := os.Create(filePath)
 	if err != nil {
 		return fmt.Errorf("error creating list file %s: %v", filePath, err)
 	}
 	defer file.Close()
 
-	file.WriteString("# Automatically generated list\n")
-	file.WriteString("# Last update: " + fmt.Sprint(time.Now().Format(time.RFC3339)) + "\n\n")
+	writer := bufio.NewWriter(file)
+	writer.WriteString("# Automatically generated list\n")
+	writer.WriteString("# Last update: " + fmt.Sprint(time.Now().Format(time.RFC3339)) + "\n\n")
 
 	for _, domain := range domains {
-		file.WriteString(domain + "\n")
+		writer.WriteString(domain + "\n")
 	}
 
-	return nil
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing list file %s: %v", filePath, err)
+	}
+	return file.Close()
 }
 
 // Initialize initializes the DNS filtering system
@@ -332,54 +599,124 @@ func (df *DNSFilter) Initialize() error {
 	// Initialize global data structures
 	df.BlocklistTries = make(map[string]*Node)
 	df.WhitelistTries = make(map[string]*Node)
+	df.IPBlocklists = make(map[string]*IPList)
+	df.listErrors = make(map[string]string)
+	df.listStats = make(map[string]ParseStats)
+	df.lastReload = time.Now()
+
+	// Load client configuration. A broken file leaves no clients configured,
+	// but everything else is still loaded so a fixed file picked up by the
+	// watcher takes effect on its own.
+	clients, configErr := LoadClientConfig(df.ConfigPath)
+	if configErr != nil {
+		clients = make(map[string]ClientConfig)
+		df.configError = configErr.Error()
+	} else {
+		df.configError = ""
+	}
+	df.Clients = clients
+	df.buildClientIndex()
 
-	// Load client configuration
+	// Load profiles, clients using a profile that cannot be loaded only get
+	// their own lists
 	var err error
-	df.Clients, err = LoadClientConfig(df.ConfigPath)
+	df.Profiles, err = LoadProfiles(df.profilesPath())
+	if err != nil {
+		log.Printf("Warning: Could not load profiles: %v", err)
+		df.Profiles = make(map[string]Profile)
+		df.profilesError = err.Error()
+	} else {
+		df.profilesError = ""
+	}
+
+	// Load overrides, a broken file only drops them
+	df.Overrides, err = LoadOverrides(df.overridesPath())
+	if err != nil {
+		log.Printf("Warning: Could not load overrides: %v", err)
+		df.Overrides = make(map[string][]Override)
+	}
+
+	// Load subscriptions, a broken file only disables refreshing
+	df.Subscriptions, err = LoadSubscriptions(df.subscriptionsPath())
 	if err != nil {
-		return fmt.Errorf("error loading client configuration: %v", err)
+		log.Printf("Warning: Could not load subscriptions: %v", err)
+		df.Subscriptions = make(map[string]*Subscription)
 	}
 
-	// Collect all unique list files
-	blocklists, whitelists := df.collectUniqueListFiles()
+	// Load the unknown client policy set through the API, a broken file falls
+	// back to the Corefile policy
+	df.unknownPolicy, err = LoadUnknownClientPolicy(df.policyPath())
+	if err != nil {
+		log.Printf("Warning: Could not load unknown client policy: %v", err)
+	}
+
+	// Collect all list files: those referenced by clients, and every file in
+	// the list directories so lists stay available after a restart
+	blocklists, whitelists, ipBlocklists := df.collectUniqueListFiles()
 
 	// Ensure directories exist
 	ensureDirExists(df.BlocklistDir)
 	ensureDirExists(df.WhitelistDir)
+	ensureDirExists(df.IPBlocklistDir)
+
+	blocklists = mergeUnique(blocklists, listFilesInDir(df.BlocklistDir))
+	whitelists = mergeUnique(whitelists, listFilesInDir(df.WhitelistDir))
+	ipBlocklists = mergeUnique(ipBlocklists, listFilesInDir(df.IPBlocklistDir))
 
 	// Load blocklists
 	for _, list := range blocklists {
 		path := filepath.Join(df.BlocklistDir, list)
-		trie, err := LoadDomainList(path)
+		trie, stats, err := LoadDomainList(path)
 		if err != nil {
 			log.Printf("Warning: Could not load blocklist: %v", err)
+			df.listErrors[listKey("blocklist", list)] = err.Error()
 			continue
 		}
 		df.BlocklistTries[list] = trie
+		df.listStats[listKey("blocklist", list)] = stats
 		log.Printf("Blocklist loaded: %s", list)
 	}
 
 	// Load whitelists
 	for _, list := range whitelists {
 		path := filepath.Join(df.WhitelistDir, list)
-		trie, err := LoadDomainList(path)
+		trie, stats, err := LoadDomainList(path)
 		if err != nil {
 			log.Printf("Warning: Could not load whitelist: %v", err)
+			df.listErrors[listKey("whitelist", list)] = err.Error()
 			continue
 		}
 		df.WhitelistTries[list] = trie
+		df.listStats[listKey("whitelist", list)] = stats
 		log.Printf("Whitelist loaded: %s", list)
 	}
 
-	log.Printf("DNS filtering system initialized with %d clients, %d blocklists, and %d whitelists",
-		len(df.Clients), len(df.BlocklistTries), len(df.WhitelistTries))
+	// Load IP blocklists
+	for _, list := range ipBlocklists {
+		path := filepath.Join(df.IPBlocklistDir, list)
+		ipList, err := LoadIPList(path)
+		if err != nil {
+			log.Printf("Warning: Could not load ipblocklist: %v", err)
+			df.listErrors[listKey("ipblocklist", list)] = err.Error()
+			continue
+		}
+		df.IPBlocklists[list] = ipList
+		log.Printf("IP blocklist loaded: %s", list)
+	}
+
+	log.Printf("DNS filtering system initialized with %d clients, %d blocklists, %d whitelists, and %d ipblocklists",
+		len(df.Clients), len(df.BlocklistTries), len(df.WhitelistTries), len(df.IPBlocklists))
+	if configErr != nil {
+		return fmt.Errorf("error loading client configuration: %v", configErr)
+	}
 	return nil
 }
 
 // collectUniqueListFiles collects all unique list files from client configuration
-func (df *DNSFilter) collectUniqueListFiles() ([]string, []string) {
+func (df *DNSFilter) collectUniqueListFiles() ([]string, []string, []string) {
 	blocklistsMap := make(map[string]bool)
 	whitelistsMap := make(map[string]bool)
+	ipBlocklistsMap := make(map[string]bool)
 
 	for _, config := range df.Clients {
 		for _, list := range config.BlocklistRefs {
@@ -388,12 +725,56 @@ func (df *DNSFilter) collectUniqueListFiles() ([]string, []string) {
 		for _, list := range config.WhitelistRefs {
 			whitelistsMap[list] = true
 		}
+		for _, list := range config.IPBlocklistRefs {
+			ipBlocklistsMap[list] = true
+		}
 	}
 
 	blocklists := mapKeysToSlice(blocklistsMap)
 	whitelists := mapKeysToSlice(whitelistsMap)
+	ipBlocklists := mapKeysToSlice(ipBlocklistsMap)
+
+	return blocklists, whitelists, ipBlocklists
+}
+
+// listFilesInDir returns the names of the list files in a directory, skipping
+// subdirectories and hidden or temporary files
+func listFilesInDir(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Warning: Could not read directory %s: %v", dir, err)
+		return nil
+	}
+
+	result := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || isIgnoredListFile(entry.Name()) {
+			continue
+		}
+		result = append(result, entry.Name())
+	}
+	return result
+}
+
+// isIgnoredListFile checks if a file name is hidden or an editor temporary file
+func isIgnoredListFile(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") ||
+		strings.HasSuffix(name, ".swp") || strings.HasSuffix(name, ".tmp")
+}
 
-	return blocklists, whitelists
+// mergeUnique appends the items of b missing in a
+func mergeUnique(a, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	for _, item := range a {
+		seen[item] = true
+	}
+	for _, item := range b {
+		if !seen[item] {
+			a = append(a, item)
+			seen[item] = true
+		}
+	}
+	return a
 }
 
 // mapKeysToSlice converts map keys to a slice
@@ -414,6 +795,10 @@ func ensureDirExists(dir string) {
 
 // GetListContent returns the content of a list
 func (df *DNSFilter) GetListContent(listName, listType string) (*ListContent, error) {
+	if listType == "ipblocklist" {
+		return df.getIPListContent(listName)
+	}
+
 	df.mutex.RLock()
 	defer df.mutex.RUnlock()
 
@@ -435,15 +820,44 @@ func (df *DNSFilter) GetListContent(listName, listType string) (*ListContent, er
 	domains := []string{}
 	extractDomainsFromTrie(trie, []string{}, &domains)
 
-	return &ListContent{
-		Name:    listName,
-		Type:    listType,
-		Domains: domains,
-	}, nil
+	content := &ListContent{
+		Name:         listName,
+		Type:         listType,
+		Domains:      domains,
+		Subscription: df.copySubscription(listType, listName),
+	}
+	if stats, exists := df.listStats[listKey(listType, listName)]; exists {
+		content.Format = stats.Format
+		content.Stats = &stats
+	}
+
+	return content, nil
 }
 
-// CreateList creates a new list
+// CreateList creates a new list, optionally subscribed to a remote source
 func (df *DNSFilter) CreateList(list *ListContent) error {
+	if err := validateListFormat(list.Type, list.Format); err != nil {
+		return err
+	}
+	if err := validateSubscription(list.Type, list.Subscription); err != nil {
+		return err
+	}
+
+	var err error
+	if list.Type == "ipblocklist" {
+		err = df.createIPList(list)
+	} else {
+		err = df.createDomainList(list)
+	}
+	if err != nil {
+		return err
+	}
+
+	return df.setSubscription(list.Type, list.Name, list.Subscription)
+}
+
+// createDomainList creates a new blocklist or whitelist
+func (df *DNSFilter) createDomainList(list *ListContent) error {
 	df.mutex.Lock()
 	defer df.mutex.Unlock()
 
@@ -460,14 +874,14 @@ func (df *DNSFilter) CreateList(list *ListContent) error {
 		return fmt.Errorf("invalid list type: %s", list.Type)
 	}
 
-	// Create new trie
-	root := NewNode()
-
-	// Add all domains
-	for _, domainEntry := range list.Domains {
-		domain, exceptions := ParseDomainWithExceptions(domainEntry)
-		InsertDomain(root, domain, exceptions)
+	// Create new trie, leaving out rules that cannot be represented
+	root, stats := ParseDomainLines(list.Domains, list.Format)
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("invalid rule %s", stats.Errors[0])
 	}
+	list.Format = stats.Format
+	list.Stats = &stats
+	df.listStats[listKey(list.Type, list.Name)] = stats
 
 	// Store in memory
 	if list.Type == "blocklist" {
@@ -477,11 +891,34 @@ func (df *DNSFilter) CreateList(list *ListContent) error {
 	}
 
 	// Save to file
-	return df.SaveDomainList(list.Name, list.Type, list.Domains)
+	return df.SaveDomainList(list.Name, list.Type, withFormatHeader(stats.Format, list.Domains))
 }
 
-// UpdateList updates an existing list
+// UpdateList updates an existing list. The subscription of the list is
+// replaced as well, a list without subscription is managed manually.
 func (df *DNSFilter) UpdateList(list *ListContent) error {
+	if err := validateListFormat(list.Type, list.Format); err != nil {
+		return err
+	}
+	if err := validateSubscription(list.Type, list.Subscription); err != nil {
+		return err
+	}
+
+	var err error
+	if list.Type == "ipblocklist" {
+		err = df.updateIPList(list)
+	} else {
+		err = df.updateDomainList(list)
+	}
+	if err != nil {
+		return err
+	}
+
+	return df.setSubscription(list.Type, list.Name, list.Subscription)
+}
+
+// updateDomainList updates an existing blocklist or whitelist
+func (df *DNSFilter) updateDomainList(list *ListContent) error {
 	df.mutex.Lock()
 	defer df.mutex.Unlock()
 
@@ -499,14 +936,14 @@ func (df *DNSFilter) UpdateList(list *ListContent) error {
 		return fmt.Errorf("list not found: %s", list.Name)
 	}
 
-	// Create new trie
-	root := NewNode()
-
-	// Add all domains
-	for _, domainEntry := range list.Domains {
-		domain, exceptions := ParseDomainWithExceptions(domainEntry)
-		InsertDomain(root, domain, exceptions)
+	// Create new trie, leaving out rules that cannot be represented
+	root, stats := ParseDomainLines(list.Domains, list.Format)
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("invalid rule %s", stats.Errors[0])
 	}
+	list.Format = stats.Format
+	list.Stats = &stats
+	df.listStats[listKey(list.Type, list.Name)] = stats
 
 	// Update in memory
 	if list.Type == "blocklist" {
@@ -516,14 +953,57 @@ func (df *DNSFilter) UpdateList(list *ListContent) error {
 	}
 
 	// Save to file
-	return df.SaveDomainList(list.Name, list.Type, list.Domains)
+	return df.SaveDomainList(list.Name, list.Type, withFormatHeader(stats.Format, list.Domains))
 }
 
-// DeleteList deletes a list
+// DeleteList deletes a list and its subscription. Both are removed at once,
+// so a refresh running meanwhile cannot bring the list back.
 func (df *DNSFilter) DeleteList(listName, listType string) error {
+	key := listKey(listType, listName)
+
 	df.mutex.Lock()
-	defer df.mutex.Unlock()
+	var err error
+	if listType == "ipblocklist" {
+		err = df.deleteIPList(listName)
+	} else {
+		err = df.deleteDomainList(listName, listType)
+	}
+	_, subscribed := df.Subscriptions[key]
+	var data []byte
+	var version uint64
+	if err == nil && subscribed {
+		delete(df.Subscriptions, key)
+		data, version, err = df.encodeSubscriptions()
+	}
+	df.mutex.Unlock()
 
+	if err != nil || !subscribed {
+		return err
+	}
+	return df.writeSubscriptions(data, version)
+}
+
+// listLoaded checks if a list is loaded, or was found but could not be
+// loaded. The caller must hold the lock.
+func (df *DNSFilter) listLoaded(listType, listName string) bool {
+	var exists bool
+	switch listType {
+	case "blocklist":
+		_, exists = df.BlocklistTries[listName]
+	case "whitelist":
+		_, exists = df.WhitelistTries[listName]
+	case "ipblocklist":
+		_, exists = df.IPBlocklists[listName]
+	}
+	if !exists {
+		_, exists = df.listErrors[listKey(listType, listName)]
+	}
+	return exists
+}
+
+// deleteDomainList deletes a blocklist or whitelist, the caller must hold the
+// lock
+func (df *DNSFilter) deleteDomainList(listName, listType string) error {
 	// Check if list exists
 	var exists bool
 	if listType == "blocklist" {
@@ -544,6 +1024,8 @@ func (df *DNSFilter) DeleteList(listName, listType string) error {
 	} else {
 		delete(df.WhitelistTries, listName)
 	}
+	delete(df.listStats, listKey(listType, listName))
+	delete(df.listErrors, listKey(listType, listName))
 
 	// Remove file
 	var dirPath string
@@ -565,27 +1047,12 @@ func (df *DNSFilter) DeleteList(listName, listType string) error {
 }
 
 // removeListReferencesFromClients removes references to a list from clients
+// and from the unknown client templates
 func (df *DNSFilter) removeListReferencesFromClients(listName, listType string) {
 	updated := false
 
 	for ip, config := range df.Clients {
-		clientUpdated := false
-
-		if listType == "blocklist" {
-			newBlocklists := removeFromSlice(config.BlocklistRefs, listName)
-			if len(newBlocklists) != len(config.BlocklistRefs) {
-				config.BlocklistRefs = newBlocklists
-				clientUpdated = true
-			}
-		} else {
-			newWhitelists := removeFromSlice(config.WhitelistRefs, listName)
-			if len(newWhitelists) != len(config.WhitelistRefs) {
-				config.WhitelistRefs = newWhitelists
-				clientUpdated = true
-			}
-		}
-
-		if clientUpdated {
+		if removeListReference(&config, listName, listType) {
 			df.Clients[ip] = config
 			updated = true
 		}
@@ -596,6 +1063,45 @@ func (df *DNSFilter) removeListReferencesFromClients(listName, listType string)
 			log.Printf("Warning: Could not save client configuration: %v", err)
 		}
 	}
+
+	df.removeListReferencesFromProfiles(listName, listType)
+	df.removeListReferencesFromPolicy(listName, listType)
+}
+
+// removeListReference removes a reference to a list from a client
+// configuration and its schedules and reports whether it had one
+func removeListReference(config *ClientConfig, listName, listType string) bool {
+	var refs []*[]string
+	if listType == "blocklist" {
+		refs = append(refs, &config.BlocklistRefs)
+	} else if listType == "ipblocklist" {
+		refs = append(refs, &config.IPBlocklistRefs)
+	} else {
+		refs = append(refs, &config.WhitelistRefs)
+	}
+
+	// Schedules only add domain lists. They are copied first as the stored
+	// configuration shares them.
+	if listType != "ipblocklist" && len(config.Schedules) > 0 {
+		config.Schedules = copySchedules(config.Schedules)
+		for i := range config.Schedules {
+			if listType == "blocklist" {
+				refs = append(refs, &config.Schedules[i].BlocklistRefs)
+			} else {
+				refs = append(refs, &config.Schedules[i].WhitelistRefs)
+			}
+		}
+	}
+
+	removed := false
+	for _, ref := range refs {
+		newRefs := removeFromSlice(*ref, listName)
+		if len(newRefs) != len(*ref) {
+			*ref = newRefs
+			removed = true
+		}
+	}
+	return removed
 }
 
 // removeFromSlice removes an item from a slice
@@ -611,6 +1117,13 @@ func removeFromSlice(slice []string, item string) []string {
 
 // AddDomains adds domains to a list
 func (df *DNSFilter) AddDomains(listName, listType string, domains []string) error {
+	if err := df.checkNotSubscribed(listType, listName); err != nil {
+		return err
+	}
+	if listType == "ipblocklist" {
+		return df.addIPEntries(listName, domains)
+	}
+
 	df.mutex.Lock()
 	defer df.mutex.Unlock()
 
@@ -629,10 +1142,46 @@ func (df *DNSFilter) AddDomains(listName, listType string, domains []string) err
 		return fmt.Errorf("list not found: %s", listName)
 	}
 
-	// Add new domains to trie
+	// Check all entries first by adding them to an empty trie, so an invalid
+	// one leaves the list unchanged
+	rules := []listRule{}
+	added := NewNode()
 	for _, domainEntry := range domains {
-		domain, exceptions := ParseDomainWithExceptions(domainEntry)
-		InsertDomain(trie, domain, exceptions)
+		entryRules, reason := parseDomainsRule(strings.TrimSpace(domainEntry))
+		if reason != "" {
+			return fmt.Errorf("invalid rule %s: %s", domainEntry, reason)
+		}
+		for _, rule := range entryRules {
+			if rule.allow {
+				continue
+			}
+			if err := insertRule(added, rule); err != nil {
+				return fmt.Errorf("invalid rule %s: %v", domainEntry, err)
+			}
+		}
+		rules = append(rules, entryRules...)
+	}
+
+	// Allow rules need a block rule to attach to, in the list or the request
+	for _, rule := range rules {
+		if rule.allow && !hasCoveringRule(trie, rule.domain) && !hasCoveringRule(added, rule.domain) {
+			return fmt.Errorf("invalid rule @@%s: no block rule to allow", rule.domain)
+		}
+	}
+
+	// Add new domains to trie, allow rules once all block rules are in
+	for _, rule := range rules {
+		if rule.allow {
+			continue
+		}
+		if err := insertRule(trie, rule); err != nil {
+			return fmt.Errorf("error adding rule %s: %v", rule.domain, err)
+		}
+	}
+	for _, rule := range rules {
+		if rule.allow {
+			insertAllowRule(trie, rule.domain)
+		}
 	}
 
 	// Update in memory
@@ -645,6 +1194,7 @@ func (df *DNSFilter) AddDomains(listName, listType string, domains []string) err
 	// Get current domains for file update
 	allDomains := []string{}
 	extractDomainsFromTrie(trie, []string{}, &allDomains)
+	df.savedListStats(listType, listName, trie, allDomains)
 
 	// Save to file
 	return df.SaveDomainList(listName, listType, allDomains)
@@ -652,6 +1202,13 @@ func (df *DNSFilter) AddDomains(listName, listType string, domains []string) err
 
 // RemoveDomains removes domains from a list
 func (df *DNSFilter) RemoveDomains(listName, listType string, domains []string) error {
+	if err := df.checkNotSubscribed(listType, listName); err != nil {
+		return err
+	}
+	if listType == "ipblocklist" {
+		return df.removeIPEntries(listName, domains)
+	}
+
 	df.mutex.Lock()
 	defer df.mutex.Unlock()
 
@@ -680,16 +1237,22 @@ func (df *DNSFilter) RemoveDomains(listName, listType string, domains []string)
 	// Create map of domains to remove for fast lookup
 	domainsToRemove := make(map[string]bool)
 	for _, domain := range domains {
-		baseDomain, _ := ParseDomainWithExceptions(domain)
-		domainsToRemove[baseDomain] = true
+		domainsToRemove[ruleKey(domain)] = true
 	}
 
 	// Add only domains that should not be removed
 	remainingDomains := []string{}
 	for _, domainEntry := range currentDomains {
-		baseDomain, exceptions := ParseDomainWithExceptions(domainEntry)
-		if !domainsToRemove[baseDomain] {
-			InsertDomain(root, baseDomain, exceptions)
+		if !domainsToRemove[ruleKey(domainEntry)] {
+			rules, reason := parseDomainsRule(domainEntry)
+			if reason != "" {
+				return fmt.Errorf("invalid rule %s in list %s: %s", domainEntry, listName, reason)
+			}
+			for _, rule := range rules {
+				if err := insertRule(root, rule); err != nil {
+					return fmt.Errorf("invalid rule %s in list %s: %v", domainEntry, listName, err)
+				}
+			}
 			remainingDomains = append(remainingDomains, domainEntry)
 		}
 	}
@@ -700,6 +1263,7 @@ func (df *DNSFilter) RemoveDomains(listName, listType string, domains []string)
 	} else {
 		df.WhitelistTries[listName] = root
 	}
+	df.savedListStats(listType, listName, root, remainingDomains)
 
 	// Save to file
 	return df.SaveDomainList(listName, listType, remainingDomains)
@@ -713,30 +1277,53 @@ func (df *DNSFilter) GetAllLists() []ListMetadata {
 	result := []ListMetadata{}
 
 	// Add blocklists
-	for name, trie := range df.BlocklistTries {
-		count := countDomainsInTrie(trie)
+	for name := range df.BlocklistTries {
+		stats := df.listStats[listKey("blocklist", name)]
 		filePath := filepath.Join(df.BlocklistDir, name)
 		lastModified := getLastModifiedTime(filePath)
 
 		result = append(result, ListMetadata{
 			Name:         name,
 			Type:         "blocklist",
-			Count:        count,
+			Count:        stats.count,
 			LastModified: lastModified,
+			Error:        df.listErrors[listKey("blocklist", name)],
+			Source:       df.subscriptionSource("blocklist", name),
+			Format:       stats.Format,
+			Skipped:      stats.Skipped,
 		})
 	}
 
 	// Add whitelists
-	for name, trie := range df.WhitelistTries {
-		count := countDomainsInTrie(trie)
+	for name := range df.WhitelistTries {
+		stats := df.listStats[listKey("whitelist", name)]
 		filePath := filepath.Join(df.WhitelistDir, name)
 		lastModified := getLastModifiedTime(filePath)
 
 		result = append(result, ListMetadata{
 			Name:         name,
 			Type:         "whitelist",
-			Count:        count,
+			Count:        stats.count,
+			LastModified: lastModified,
+			Error:        df.listErrors[listKey("whitelist", name)],
+			Source:       df.subscriptionSource("whitelist", name),
+			Format:       stats.Format,
+			Skipped:      stats.Skipped,
+		})
+	}
+
+	// Add IP blocklists
+	for name, list := range df.IPBlocklists {
+		filePath := filepath.Join(df.IPBlocklistDir, name)
+		lastModified := getLastModifiedTime(filePath)
+
+		result = append(result, ListMetadata{
+			Name:         name,
+			Type:         "ipblocklist",
+			Count:        len(list.Prefixes),
 			LastModified: lastModified,
+			Error:        df.listErrors[listKey("ipblocklist", name)],
+			Source:       df.subscriptionSource("ipblocklist", name),
 		})
 	}
 
@@ -760,29 +1347,51 @@ func (df *DNSFilter) GetListsByType(listType string) []ListMetadata {
 	result := []ListMetadata{}
 
 	if listType == "blocklist" {
-		for name, trie := range df.BlocklistTries {
-			count := countDomainsInTrie(trie)
+		for name := range df.BlocklistTries {
+			stats := df.listStats[listKey("blocklist", name)]
 			filePath := filepath.Join(df.BlocklistDir, name)
 			lastModified := getLastModifiedTime(filePath)
 
 			result = append(result, ListMetadata{
 				Name:         name,
 				Type:         "blocklist",
-				Count:        count,
+				Count:        stats.count,
 				LastModified: lastModified,
+				Error:        df.listErrors[listKey("blocklist", name)],
+				Source:       df.subscriptionSource("blocklist", name),
+				Format:       stats.Format,
+				Skipped:      stats.Skipped,
 			})
 		}
 	} else if listType == "whitelist" {
-		for name, trie := range df.WhitelistTries {
-			count := countDomainsInTrie(trie)
+		for name := range df.WhitelistTries {
+			stats := df.listStats[listKey("whitelist", name)]
 			filePath := filepath.Join(df.WhitelistDir, name)
 			lastModified := getLastModifiedTime(filePath)
 
 			result = append(result, ListMetadata{
 				Name:         name,
 				Type:         "whitelist",
-				Count:        count,
+				Count:        stats.count,
+				LastModified: lastModified,
+				Error:        df.listErrors[listKey("whitelist", name)],
+				Source:       df.subscriptionSource("whitelist", name),
+				Format:       stats.Format,
+				Skipped:      stats.Skipped,
+			})
+		}
+	} else if listType == "ipblocklist" {
+		for name, list := range df.IPBlocklists {
+			filePath := filepath.Join(df.IPBlocklistDir, name)
+			lastModified := getLastModifiedTime(filePath)
+
+			result = append(result, ListMetadata{
+				Name:         name,
+				Type:         "ipblocklist",
+				Count:        len(list.Prefixes),
 				LastModified: lastModified,
+				Error:        df.listErrors[listKey("ipblocklist", name)],
+				Source:       df.subscriptionSource("ipblocklist", name),
 			})
 		}
 	}
@@ -797,43 +1406,61 @@ func (df *DNSFilter) GetAllClients() []ClientConfig {
 
 	result := []ClientConfig{}
 	for ip, config := range df.Clients {
-		clientConfig := ClientConfig{
-			IP:            ip,
-			BlocklistRefs: make([]string, len(config.BlocklistRefs)),
-			WhitelistRefs: make([]string, len(config.WhitelistRefs)),
-			Mode:          config.Mode,
-		}
-
-		copy(clientConfig.BlocklistRefs, config.BlocklistRefs)
-		copy(clientConfig.WhitelistRefs, config.WhitelistRefs)
-
-		result = append(result, clientConfig)
+		result = append(result, copyClientConfig(ip, config))
 	}
 
 	return result
 }
 
-// GetClientByIP returns the configuration for a specific client
+// GetClientByIP returns the configuration for a specific client entry, an
+// address or a network
 func (df *DNSFilter) GetClientByIP(ip string) (*ClientConfig, error) {
 	df.mutex.RLock()
 	defer df.mutex.RUnlock()
 
-	config, exists := df.Clients[ip]
+	key := df.clientKey(ip)
+	config, exists := df.Clients[key]
 	if !exists {
 		return nil, fmt.Errorf("client not found: %s", ip)
 	}
 
+	result := copyClientConfig(key, config)
+	return &result, nil
+}
+
+// clientKey returns the key of the client entry stored for an address or
+// network, which may be written differently than the key, e.g. "10.8.0.2/32"
+// for "10.8.0.2". The caller must hold the lock.
+func (df *DNSFilter) clientKey(ip string) string {
+	if _, exists := df.Clients[ip]; exists {
+		return ip
+	}
+	if prefix, _, err := ParseClientKey(ip); err == nil {
+		if key, exists := df.clientIndex.byPrefix[prefix]; exists {
+			return key
+		}
+	}
+	return ip
+}
+
+// copyClientConfig returns a deep copy of a client configuration with the IP set
+func copyClientConfig(ip string, config ClientConfig) ClientConfig {
 	result := ClientConfig{
-		IP:            ip,
-		BlocklistRefs: make([]string, len(config.BlocklistRefs)),
-		WhitelistRefs: make([]string, len(config.WhitelistRefs)),
-		Mode:          config.Mode,
+		IP:              ip,
+		BlocklistRefs:   make([]string, len(config.BlocklistRefs)),
+		WhitelistRefs:   make([]string, len(config.WhitelistRefs)),
+		IPBlocklistRefs: make([]string, len(config.IPBlocklistRefs)),
+		Mode:            config.Mode,
+		BlockResponse:   config.BlockResponse,
+		Profile:         config.Profile,
+		Schedules:       copySchedules(config.Schedules),
 	}
 
 	copy(result.BlocklistRefs, config.BlocklistRefs)
 	copy(result.WhitelistRefs, config.WhitelistRefs)
+	copy(result.IPBlocklistRefs, config.IPBlocklistRefs)
 
-	return &result, nil
+	return result
 }
 
 // CreateClient creates a new client
@@ -846,31 +1473,65 @@ func (df *DNSFilter) CreateClient(client *ClientConfig) error {
 		return fmt.Errorf("client already exists: %s", client.IP)
 	}
 
+	// Check the address or network, which must not duplicate another entry
+	key, err := df.canonicalClientKey(client.IP, "")
+	if err != nil {
+		return err
+	}
+
+	// Check references, mode and block response
+	if err := df.validateClientConfig(client); err != nil {
+		return err
+	}
+
+	// Store a copy in memory, under the canonical form of the key
+	client.IP = key
+	df.Clients[key] = copyClientConfig("", *client)
+	df.buildClientIndex()
+
+	// Save to file
+	return df.SaveClientConfig()
+}
+
+// validateClientConfig checks a client configuration before it is stored
+func (df *DNSFilter) validateClientConfig(client *ClientConfig) error {
 	// Check if all referenced lists exist
 	if err := df.validateListReferences(client); err != nil {
 		return err
 	}
 
+	// Check profile, a client using one may leave the mode to it
+	if client.Profile != "" {
+		if _, exists := df.Profiles[client.Profile]; !exists {
+			return fmt.Errorf("referenced profile not found: %s", client.Profile)
+		}
+	}
+
 	// Check mode
-	if client.Mode != "blocklist" && client.Mode != "whitelist" {
+	if !IsValidMode(client.Mode) && !(client.Profile != "" && client.Mode == "") {
 		return fmt.Errorf("invalid mode: %s", client.Mode)
 	}
 
-	// Copy client configuration
-	config := ClientConfig{
-		BlocklistRefs: make([]string, len(client.BlocklistRefs)),
-		WhitelistRefs: make([]string, len(client.WhitelistRefs)),
-		Mode:          client.Mode,
+	// Check block response, empty means the server default
+	if client.BlockResponse != "" && !IsValidBlockResponse(client.BlockResponse) {
+		return fmt.Errorf("invalid block response: %s", client.BlockResponse)
 	}
 
-	copy(config.BlocklistRefs, client.BlocklistRefs)
-	copy(config.WhitelistRefs, client.WhitelistRefs)
-
-	// Store in memory
-	df.Clients[client.IP] = config
+	// Check schedules and the lists they add
+	for i := range client.Schedules {
+		schedule := &client.Schedules[i]
+		if err := validateSchedule(schedule); err != nil {
+			return fmt.Errorf("%s: %v", schedule.label(i), err)
+		}
+		if err := df.validateListReferences(&ClientConfig{
+			BlocklistRefs: schedule.BlocklistRefs,
+			WhitelistRefs: schedule.WhitelistRefs,
+		}); err != nil {
+			return fmt.Errorf("%s: %v", schedule.label(i), err)
+		}
+	}
 
-	// Save to file
-	return df.SaveClientConfig()
+	return nil
 }
 
 // validateListReferences checks if all referenced lists exist
@@ -885,6 +1546,11 @@ func (df *DNSFilter) validateListReferences(client *ClientConfig) error {
 			return fmt.Errorf("referenced whitelist not found: %s", listName)
 		}
 	}
+	for _, listName := range client.IPBlocklistRefs {
+		if _, exists := df.IPBlocklists[listName]; !exists {
+			return fmt.Errorf("referenced ipblocklist not found: %s", listName)
+		}
+	}
 	return nil
 }
 
@@ -894,32 +1560,18 @@ func (df *DNSFilter) UpdateClient(client *ClientConfig) error {
 	defer df.mutex.Unlock()
 
 	// Check if client exists
-	if _, exists := df.Clients[client.IP]; !exists {
+	key := df.clientKey(client.IP)
+	if _, exists := df.Clients[key]; !exists {
 		return fmt.Errorf("client not found: %s", client.IP)
 	}
 
-	// Check if all referenced lists exist
-	if err := df.validateListReferences(client); err != nil {
+	// Check references, mode and block response
+	if err := df.validateClientConfig(client); err != nil {
 		return err
 	}
 
-	// Check mode
-	if client.Mode != "blocklist" && client.Mode != "whitelist" {
-		return fmt.Errorf("invalid mode: %s", client.Mode)
-	}
-
-	// Copy client configuration
-	config := ClientConfig{
-		BlocklistRefs: make([]string, len(client.BlocklistRefs)),
-		WhitelistRefs: make([]string, len(client.WhitelistRefs)),
-		Mode:          client.Mode,
-	}
-
-	copy(config.BlocklistRefs, client.BlocklistRefs)
-	copy(config.WhitelistRefs, client.WhitelistRefs)
-
-	// Store in memory
-	df.Clients[client.IP] = config
+	// Store a copy in memory
+	df.Clients[key] = copyClientConfig("", *client)
 
 	// Save to file
 	return df.SaveClientConfig()
@@ -931,12 +1583,20 @@ func (df *DNSFilter) DeleteClient(ip string) error {
 	defer df.mutex.Unlock()
 
 	// Check if client exists
-	if _, exists := df.Clients[ip]; !exists {
+	key := df.clientKey(ip)
+	if _, exists := df.Clients[key]; !exists {
 		return fmt.Errorf("client not found: %s", ip)
 	}
 
-	// Remove from memory
-	delete(df.Clients, ip)
+	// Remove from memory, with the overrides of the client
+	delete(df.Clients, key)
+	df.buildClientIndex()
+	if _, exists := df.Overrides[key]; exists {
+		delete(df.Overrides, key)
+		if err := df.saveOverrides(); err != nil {
+			log.Printf("Warning: Could not save overrides: %v", err)
+		}
+	}
 
 	// Save to file
 	return df.SaveClientConfig()
@@ -944,55 +1604,169 @@ func (df *DNSFilter) DeleteClient(ip string) error {
 
 // CheckDomain checks if a client is allowed to access a domain
 func (df *DNSFilter) CheckDomain(clientIP, domain string) bool {
+	return df.Evaluate(clientIP, domain).Allowed
+}
+
+// Evaluate decides if a client is allowed to access a domain and explains the
+// decision: which list and rule decided, whether an exception of a rule fired
+// and whether the client was known at all
+func (df *DNSFilter) Evaluate(clientIP, domain string) Verdict {
 	df.mutex.RLock()
 	defer df.mutex.RUnlock()
 
-	// Get client configuration
-	config, exists := df.Clients[clientIP]
-	if !exists {
-		log.Printf("Unknown client: %s", clientIP)
-		return false // Unknown client
+	verdict := Verdict{
+		ClientIP: clientIP,
+		Domain:   domain,
 	}
 
-	// Blocklist mode
-	if config.Mode == "blocklist" {
+	// Get client configuration, from the entry for the address or the most
+	// specific network containing it
+	key, config, exists := df.resolveClient(clientIP)
+	if !exists {
+		verdict.UnknownClient = true
+		policy := df.unknownClientPolicy()
+		verdict.Policy = policy.Action
+		switch policy.Action {
+		case UnknownClientAllow:
+			verdict.Allowed = true
+			return verdict // Unknown client, allowed by policy
+		case UnknownClientTemplate:
+			config = *policy.Template // Unknown client, filtered like a configured one
+		default:
+			log.Printf("Unknown client: %s", clientIP)
+			return verdict // Unknown client, denied by policy
+		}
+	}
+	now := df.clock()
+	config = df.effectiveConfig(config)
+	config, verdict.Schedules = applySchedules(config, now)
+	verdict.Client = key
+	verdict.Profile = config.Profile
+	verdict.Mode = config.Mode
+	verdict.BlockResponse = config.BlockResponse
+
+	// Overrides of the client entry come before its lists
+	if override, matched := df.matchOverride(key, domain, now); matched {
+		log.Printf("Domain %s for client %s decided by %s override %s until %s",
+			domain, clientIP, override.Action, override.ID, override.Expires.Format(time.RFC3339))
+		verdict.Override = override.Action
+		verdict.OverrideID = override.ID
+		verdict.Rule = override.Domain
+		verdict.Allowed = override.Action != OverrideBlock
+		return verdict
+	}
+
+	switch config.Mode {
+	case "blocklist":
 		// Check if domain is blocked in ANY of the blocklists
-		for _, listName := range config.BlocklistRefs {
-			trie, exists := df.BlocklistTries[listName]
-			if !exists {
-				log.Printf("Warning: Referenced blocklist not found: %s", listName)
-				continue
-			}
+		if listName, match, blocked := df.matchLists("blocklist", config.BlocklistRefs, domain); blocked {
+			log.Printf("Domain %s for client %s blocked by blocklist %s (%s)",
+				domain, clientIP, listName, match.Rule)
+			verdict.setList("blocklist", listName, match)
+			return verdict // Domain is blocked
+		} else if match.Exception {
+			verdict.setList("blocklist", listName, match)
+		}
+		verdict.Allowed = true
+		return verdict // Domain is allowed (not in any blocklist)
 
-			if IsDomainBlocked(trie, domain) {
-				log.Printf("Domain %s for client %s blocked by blocklist %s",
-					domain, clientIP, listName)
-				return false // Domain is blocked
+	case "whitelist":
+		// Check if domain is allowed in ANY of the whitelists
+		if listName, match, allowed := df.matchLists("whitelist", config.WhitelistRefs, domain); allowed {
+			log.Printf("Domain %s for client %s allowed by whitelist %s (%s)",
+				domain, clientIP, listName, match.Rule)
+			verdict.setList("whitelist", listName, match)
+			verdict.Allowed = true
+			return verdict // Domain is allowed
+		} else if match.Exception {
+			verdict.setList("whitelist", listName, match)
+		}
+		log.Printf("Domain %s for client %s blocked (not in whitelist)", domain, clientIP)
+		if verdict.ListType == "" {
+			verdict.ListType = "whitelist"
+		}
+		return verdict // Domain is blocked (not in any whitelist)
+
+	case "mixed":
+		// Whitelists override blocklists
+		if listName, match, allowed := df.matchLists("whitelist", config.WhitelistRefs, domain); allowed {
+			log.Printf("Domain %s for client %s allowed by whitelist %s (%s)",
+				domain, clientIP, listName, match.Rule)
+			verdict.setList("whitelist", listName, match)
+			verdict.Allowed = true
+			return verdict // Domain is allowed, whatever the blocklists say
+		}
+		if listName, match, blocked := df.matchLists("blocklist", config.BlocklistRefs, domain); blocked {
+			log.Printf("Domain %s for client %s blocked by blocklist %s (%s)",
+				domain, clientIP, listName, match.Rule)
+			verdict.setList("blocklist", listName, match)
+			return verdict // Domain is blocked
+		} else if match.Exception {
+			verdict.setList("blocklist", listName, match)
+		}
+		verdict.Allowed = true
+		return verdict // Domain is allowed (not in any blocklist)
+
+	case "strict":
+		// Domain must be in a whitelist, and in none of the blocklists
+		allowListName, allowMatch, allowed := df.matchLists("whitelist", config.WhitelistRefs, domain)
+		if !allowed {
+			log.Printf("Domain %s for client %s blocked (not in whitelist)", domain, clientIP)
+			if allowMatch.Exception {
+				verdict.setList("whitelist", allowListName, allowMatch)
+			} else {
+				verdict.ListType = "whitelist"
 			}
+			return verdict // Domain is blocked (not in any whitelist)
+		}
+		if listName, match, blocked := df.matchLists("blocklist", config.BlocklistRefs, domain); blocked {
+			log.Printf("Domain %s for client %s blocked by blocklist %s (%s) despite whitelist %s",
+				domain, clientIP, listName, match.Rule, allowListName)
+			verdict.setList("blocklist", listName, match)
+			return verdict // Domain is blocked
 		}
-		return true // Domain is allowed (not in any blocklist)
+		verdict.setList("whitelist", allowListName, allowMatch)
+		verdict.Allowed = true
+		return verdict // Domain is allowed (whitelisted and not blocked)
 	}
 
-	// Whitelist mode
-	if config.Mode == "whitelist" {
-		// Check if domain is allowed in ANY of the whitelists
-		for _, listName := range config.WhitelistRefs {
-			trie, exists := df.WhitelistTries[listName]
-			if !exists {
-				log.Printf("Warning: Referenced whitelist not found: %s", listName)
-				continue
-			}
+	log.Printf("Invalid mode for client %s: %s", clientIP, config.Mode)
+	return verdict // Default behavior for invalid mode
+}
 
-			if IsDomainAllowed(trie, domain) {
-				log.Printf("Domain %s for client %s allowed by whitelist %s",
-					domain, clientIP, listName)
-				return true // Domain is allowed
-			}
+// matchLists looks up a domain in the referenced lists of a type. It returns
+// the first list with a rule matching the domain; if there is none, the first
+// list where an exception of a rule excluded it, if any.
+func (df *DNSFilter) matchLists(listType string, refs []string, domain string) (string, Match, bool) {
+	tries := df.BlocklistTries
+	if listType == "whitelist" {
+		tries = df.WhitelistTries
+	}
+
+	exceptionList, exception := "", Match{}
+	for _, listName := range refs {
+		trie, exists := tries[listName]
+		if !exists {
+			log.Printf("Warning: Referenced %s not found: %s", listType, listName)
+			continue
+		}
+
+		match := MatchDomain(trie, domain)
+		if match.Matched {
+			return listName, match, true
+		}
+		if match.Exception && !exception.Exception {
+			exceptionList, exception = listName, match
 		}
-		log.Printf("Domain %s for client %s blocked (not in whitelist)", domain, clientIP)
-		return false // Domain is blocked (not in any whitelist)
 	}
 
-	log.Printf("Invalid mode for client %s: %s", clientIP, config.Mode)
-	return false // Default behavior for invalid mode
+	return exceptionList, exception, false
+}
+
+// setList records the list and rule that decided a verdict
+func (v *Verdict) setList(listType, listName string, match Match) {
+	v.ListType = listType
+	v.ListName = listName
+	v.Rule = match.Rule
+	v.Exception = match.Exception
 }
@@ -0,0 +1,373 @@
+package dnslookup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestFilter initializes a filter in a temporary directory with a client
+// configuration and list files keyed like "blocklist/ads"
+func newTestFilter(t *testing.T, clients string, lists map[string]string) *DNSFilter {
+	t.Helper()
+
+	df := newTestFiles(t, clients, lists)
+	if err := df.Initialize(); err != nil {
+		t.Fatalf("Expected no error initializing the filter, got %v", err)
+	}
+	return df
+}
+
+// newTestFiles writes the files of newTestFilter and returns the filter
+// without initializing it
+func newTestFiles(t *testing.T, clients string, lists map[string]string) *DNSFilter {
+	t.Helper()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "etc", "clients.json"), clients)
+	for key, content := range lists {
+		listType, listName, _ := strings.Cut(key, "/")
+		writeTestFile(t, filepath.Join(dir, listType+"s", listName), content)
+	}
+
+	df := NewDNSFilter(filepath.Join(dir, "etc", "clients.json"),
+		filepath.Join(dir, "blocklists"), filepath.Join(dir, "whitelists"), filepath.Join(dir, "ipblocklists"))
+	t.Cleanup(func() { df.Close() })
+	return df
+}
+
+// writeTestFile writes a file, creating its directory
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitializeBrokenConfig(t *testing.T) {
+	df := newTestFiles(t, `{"10.0.0.1": {"profile": "kids", "mode": `, map[string]string{
+		"blocklist/ads": "ads.example.com\n",
+	})
+	writeTestFile(t, df.profilesPath(), `{"kids": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}}`)
+
+	err := df.Initialize()
+	if err == nil || !strings.Contains(err.Error(), "client configuration") {
+		t.Fatalf("Expected an error loading the client configuration, got %v", err)
+	}
+	if df.GetStatus().ConfigError == "" {
+		t.Errorf("Expected the error in the status")
+	}
+
+	// Everything but the clients is loaded regardless
+	if df.BlocklistTries["ads"] == nil {
+		t.Errorf("Expected blocklist ads to be loaded")
+	}
+	if _, exists := df.Profiles["kids"]; !exists {
+		t.Errorf("Expected profile kids to be loaded")
+	}
+
+	// Fixing the file is enough for the client to be filtered
+	writeTestFile(t, df.ConfigPath, `{"10.0.0.1": {"blocklists": [], "whitelists": [], "profile": "kids", "mode": ""}}`)
+	df.reloadClientConfig()
+	if df.CheckDomain("10.0.0.1", "ads.example.com") {
+		t.Errorf("Expected ads.example.com to be blocked after fixing the client configuration")
+	}
+	if df.GetStatus().ConfigError != "" {
+		t.Errorf("Expected no error in the status, got %s", df.GetStatus().ConfigError)
+	}
+}
+
+func TestExactRules(t *testing.T) {
+	root, stats := ParseDomainLines([]string{
+		"=exact.example.com",
+		"|pipe.example.com|",
+		"=Upper.Example.COM.",
+		"=example.org",
+		"cdn.example.org",
+		"example.net !www",
+		"=www.example.net",
+		"=ads*.example.com",
+		"=bad domain",
+	}, FormatDomains)
+	if stats.Rules != 7 || stats.Skipped != 2 {
+		t.Fatalf("Expected 7 rules with 2 skipped, got %d with %d skipped (%v)", stats.Rules, stats.Skipped, stats.Samples)
+	}
+
+	tests := []struct {
+		name    string
+		matched bool
+		rule    string
+	}{
+		{"exact.example.com", true, "=exact.example.com"},
+		{"www.exact.example.com", false, ""},
+		{"pipe.example.com.", true, "=pipe.example.com"},
+		{"upper.example.com", true, "=upper.example.com"},
+		{"example.com", false, ""},
+		{"example.org", true, "=example.org"},
+		{"cdn.example.org", true, "cdn.example.org"},
+		{"www.example.org", false, ""},
+		{"www.example.net", true, "=www.example.net"}, // An exact rule for an exception takes precedence
+		{"mail.www.example.net", false, "example.net !www"},
+		{"mail.example.net", true, "example.net !www"},
+	}
+
+	for i, tc := range tests {
+		match := MatchDomain(root, tc.name)
+		if match.Matched != tc.matched || match.Rule != tc.rule {
+			t.Errorf("Test %d: expected %s matched %v by %q, got %v by %q", i, tc.name, tc.matched, tc.rule, match.Matched, match.Rule)
+		}
+	}
+}
+
+func TestExactRuleKeys(t *testing.T) {
+	tests := []struct {
+		entry string
+		key   string
+	}{
+		{"=example.com", "=example.com"},
+		{"=Example.COM.", "=example.com"},
+		{"|example.com|", "=example.com"},
+		{"example.com", "example.com"},
+		{"example.com !mail", "example.com"},
+		{"=example.com !mail", "=example.com !mail"}, // Invalid, compared as written
+	}
+
+	for i, tc := range tests {
+		if key := ruleKey(tc.entry); key != tc.key {
+			t.Errorf("Test %d: expected key %q for %q, got %q", i, tc.key, tc.entry, key)
+		}
+	}
+}
+
+func TestExactRulesInList(t *testing.T) {
+	df := newTestFilter(t, `{"10.0.0.1": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}}`,
+		map[string]string{"blocklist/ads": "ads.example.com\n"})
+
+	if err := df.AddDomains("ads", "blocklist", []string{"|exact.example.com|", "=example.org"}); err != nil {
+		t.Fatalf("Expected no error adding exact rules, got %v", err)
+	}
+	if df.CheckDomain("10.0.0.1", "exact.example.com") || !df.CheckDomain("10.0.0.1", "www.exact.example.com") {
+		t.Errorf("Expected only exact.example.com itself to be blocked")
+	}
+
+	// Exact rules are saved as "=name" and read back as exact rules
+	root, _, err := LoadDomainList(filepath.Join(df.BlocklistDir, "ads"))
+	if err != nil {
+		t.Fatalf("Expected no error loading the list, got %v", err)
+	}
+	if match := MatchDomain(root, "exact.example.com"); match.Rule != "=exact.example.com" {
+		t.Errorf("Expected the saved list to match exact.example.com by =exact.example.com, got %q", match.Rule)
+	}
+	if IsDomainBlocked(root, "www.example.org") {
+		t.Errorf("Expected the saved list not to match www.example.org")
+	}
+
+	// Exact rules are removed in either notation
+	if err := df.RemoveDomains("ads", "blocklist", []string{"=exact.example.com", "|example.org|"}); err != nil {
+		t.Fatalf("Expected no error removing exact rules, got %v", err)
+	}
+	content, err := df.GetListContent("ads", "blocklist")
+	if err != nil {
+		t.Fatalf("Expected no error getting the list, got %v", err)
+	}
+	if len(content.Domains) != 1 || content.Domains[0] != "ads.example.com" {
+		t.Errorf("Expected only ads.example.com to remain, got %v", content.Domains)
+	}
+}
+
+func TestDeepExceptions(t *testing.T) {
+	lines := []string{
+		"example.com !mail, !eu.forum, !b.c",
+		"eu.mail.example.com",
+		"deep.x.b.c.example.com !y",
+		"ads.example.net",
+		"@@a.b.ads.example.net",
+	}
+	tests := []struct {
+		name      string
+		matched   bool
+		exception bool
+	}{
+		{"example.com", true, false},
+		{"www.example.com", true, false},
+		{"mail.example.com", false, true},
+		{"smtp.mail.example.com", false, true},
+		{"eu.mail.example.com", true, false}, // A rule below an exception takes precedence
+		{"x.eu.mail.example.com", true, false},
+		{"forum.example.com", true, false},
+		{"eu.forum.example.com", false, true},
+		{"x.eu.forum.example.com", false, true},
+		{"us.forum.example.com", true, false},
+		{"c.example.com", true, false},
+		{"b.c.example.com", false, true},
+		{"x.b.c.example.com", false, true},
+		{"deep.x.b.c.example.com", true, false},
+		{"y.deep.x.b.c.example.com", false, true},
+		{"b.ads.example.net", true, false},
+		{"a.b.ads.example.net", false, true}, // Allow rules become deep exceptions
+		{"x.a.b.ads.example.net", false, true},
+	}
+
+	root, stats := ParseDomainLines(lines, FormatDomains)
+	if stats.Rules != len(lines) || stats.Skipped != 0 {
+		t.Fatalf("Expected %d rules, got %d with %d skipped (%v)", len(lines), stats.Rules, stats.Skipped, stats.Samples)
+	}
+
+	// The saved form of the list matches the same names
+	saved := []string{}
+	extractDomainsFromTrie(root, []string{}, &saved)
+	reloaded, _ := ParseDomainLines(saved, FormatDomains)
+
+	for i, tc := range tests {
+		for _, trie := range []*Node{root, reloaded} {
+			match := MatchDomain(trie, tc.name)
+			if match.Matched != tc.matched || match.Exception != tc.exception {
+				t.Errorf("Test %d: expected %s matched %v with exception %v, got %v with %v (%q)", i,
+					tc.name, tc.matched, tc.exception, match.Matched, match.Exception, match.Rule)
+			}
+		}
+	}
+}
+
+func TestEvaluateMixedStrict(t *testing.T) {
+	df := newTestFilter(t, `{
+		"10.0.0.1": {"blocklists": ["ads"], "whitelists": ["allowed"], "mode": "mixed"},
+		"10.0.0.2": {"blocklists": ["ads"], "whitelists": ["allowed"], "mode": "strict"}
+	}`, map[string]string{
+		"blocklist/ads":     "example.com !mail\nads.example.net\nads.example.org\n",
+		"whitelist/allowed": "www.example.com\nexample.org !ads\n",
+	})
+
+	tests := []struct {
+		clientIP  string
+		domain    string
+		allowed   bool
+		listType  string
+		listName  string
+		exception bool
+	}{
+		// Whitelisted and blocked
+		{"10.0.0.1", "www.example.com", true, "whitelist", "allowed", false},
+		{"10.0.0.2", "www.example.com", false, "blocklist", "ads", false},
+		// Only blocked
+		{"10.0.0.1", "ads.example.net", false, "blocklist", "ads", false},
+		{"10.0.0.2", "ads.example.net", false, "whitelist", "", false},
+		// Only whitelisted
+		{"10.0.0.1", "example.org", true, "whitelist", "allowed", false},
+		{"10.0.0.2", "example.org", true, "whitelist", "allowed", false},
+		// Neither
+		{"10.0.0.1", "example.net", true, "", "", false},
+		{"10.0.0.2", "example.net", false, "whitelist", "", false},
+		// An exception of the whitelist rule, so the blocklist decides
+		{"10.0.0.1", "ads.example.org", false, "blocklist", "ads", false},
+		{"10.0.0.2", "ads.example.org", false, "whitelist", "allowed", true},
+		// An exception of the blocklist rule
+		{"10.0.0.1", "mail.example.com", true, "blocklist", "ads", true},
+		{"10.0.0.2", "mail.example.com", false, "whitelist", "", false},
+	}
+
+	for i, tc := range tests {
+		verdict := df.Evaluate(tc.clientIP, tc.domain)
+		if verdict.Allowed != tc.allowed || verdict.ListType != tc.listType || verdict.ListName != tc.listName || verdict.Exception != tc.exception {
+			t.Errorf("Test %d: expected %s for %s allowed %v by %s %q with exception %v, got %v by %s %q with %v", i,
+				tc.domain, tc.clientIP, tc.allowed, tc.listType, tc.listName, tc.exception,
+				verdict.Allowed, verdict.ListType, verdict.ListName, verdict.Exception)
+		}
+	}
+}
+
+func TestListCounts(t *testing.T) {
+	df := newTestFilter(t, `{}`, map[string]string{
+		"blocklist/ads":     "ads.example.com\nads.example.com\ntracker*.example.com\n",
+		"whitelist/allowed": "www.example.com\n",
+	})
+
+	counts := func() map[string]int {
+		result := make(map[string]int)
+		for _, list := range df.GetAllLists() {
+			result[listKey(list.Type, list.Name)] = list.Count
+		}
+		for _, list := range df.GetListsByType("blocklist") {
+			if result[listKey(list.Type, list.Name)] != list.Count {
+				t.Errorf("Expected the count of %s by type to be %d, got %d", list.Name, result[listKey(list.Type, list.Name)], list.Count)
+			}
+		}
+		return result
+	}
+
+	tests := []struct {
+		change func() error
+		ads    int
+	}{
+		{func() error { return nil }, 2}, // Duplicates count once
+		{func() error { return df.AddDomains("ads", "blocklist", []string{"ads.example.net", "=example.org"}) }, 4},
+		{func() error { return df.RemoveDomains("ads", "blocklist", []string{"ads.example.com"}) }, 3},
+		{func() error {
+			return df.UpdateList(&ListContent{Name: "ads", Type: "blocklist", Domains: []string{"ads.example.com"}})
+		}, 1},
+	}
+
+	for i, tc := range tests {
+		if err := tc.change(); err != nil {
+			t.Fatalf("Test %d: expected no error changing the list, got %v", i, err)
+		}
+		result := counts()
+		if result["blocklist/ads"] != tc.ads || result["whitelist/allowed"] != 1 {
+			t.Errorf("Test %d: expected %d rules in ads and 1 in allowed, got %v", i, tc.ads, result)
+		}
+		if count := countDomainsInTrie(df.BlocklistTries["ads"]); count != tc.ads {
+			t.Errorf("Test %d: expected %d rules in the trie, got %d", i, tc.ads, count)
+		}
+	}
+}
+
+func TestListStatsAfterChange(t *testing.T) {
+	df := newTestFilter(t, `{}`, map[string]string{
+		"blocklist/ads": "||ads.example.com^\n||tracker.example.com^$third-party\n",
+	})
+
+	tests := []struct {
+		change  func() error
+		format  string
+		rules   int
+		skipped int
+	}{
+		{func() error { return nil }, FormatABP, 1, 1},
+		// The list is saved from its rules in domains format, without the skipped ones
+		{func() error { return df.AddDomains("ads", "blocklist", []string{"new.example.com"}) }, FormatDomains, 2, 0},
+		{func() error { return df.RemoveDomains("ads", "blocklist", []string{"ads.example.com"}) }, FormatDomains, 1, 0},
+	}
+
+	for i, tc := range tests {
+		if err := tc.change(); err != nil {
+			t.Fatalf("Test %d: expected no error changing the list, got %v", i, err)
+		}
+
+		content, err := df.GetListContent("ads", "blocklist")
+		if err != nil {
+			t.Fatalf("Test %d: expected no error getting the list, got %v", i, err)
+		}
+		if content.Format != tc.format || content.Stats.Rules != tc.rules || content.Stats.Skipped != tc.skipped {
+			t.Errorf("Test %d: expected %s with %d rules and %d skipped, got %s with %d and %d", i,
+				tc.format, tc.rules, tc.skipped, content.Format, content.Stats.Rules, content.Stats.Skipped)
+		}
+		lists := df.GetAllLists()
+		if len(lists) != 1 || lists[0].Format != tc.format || lists[0].Skipped != tc.skipped || lists[0].Count != tc.rules {
+			t.Errorf("Test %d: expected the metadata to report %s with %d skipped, got %+v", i, tc.format, tc.skipped, lists)
+		}
+
+		// The stats are the ones of the file
+		_, stats, err := LoadDomainList(filepath.Join(df.BlocklistDir, "ads"))
+		if err != nil {
+			t.Fatalf("Test %d: expected no error loading the list, got %v", i, err)
+		}
+		if stats.Format != tc.format || stats.Rules != tc.rules || stats.Skipped != tc.skipped {
+			t.Errorf("Test %d: expected the file to hold %s with %d rules and %d skipped, got %+v", i, tc.format, tc.rules, tc.skipped, stats)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package dnslookup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PatternRule is a glob or regular expression rule of a domain list, for
+// names the trie cannot express
+type PatternRule struct {
+	Rule  string // Rule as written, e.g. "ads*.example.com" or "/^track[0-9]+\./"
+	regex *regexp.Regexp
+}
+
+// IsPatternRule checks if a domain list entry is a glob or regular expression
+// rule rather than a domain
+func IsPatternRule(entry string) bool {
+	return strings.Contains(entry, "*") || isRegexRule(entry)
+}
+
+// isRegexRule checks if an entry is a regular expression rule like "/^ads\./"
+func isRegexRule(entry string) bool {
+	return len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/")
+}
+
+// CompilePatternRule compiles a pattern rule. A glob, where "*" stands for any
+// characters, covers the matching names and their subdomains like any other
+// rule. A regular expression between slashes is matched against the whole
+// name, without the trailing dot, and is anchored by the rule itself.
+func CompilePatternRule(rule string) (*PatternRule, error) {
+	if isRegexRule(rule) {
+		regex, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %s: %v", rule, err)
+		}
+		return &PatternRule{Rule: rule, regex: regex}, nil
+	}
+
+	glob := strings.ToLower(strings.TrimSuffix(rule, "."))
+	if strings.Trim(glob, "*.") == "" {
+		return nil, fmt.Errorf("glob %s matches every name", rule)
+	}
+	if _, ok := normalizeDomain(strings.ReplaceAll(glob, "*", "x")); !ok {
+		return nil, fmt.Errorf("invalid glob %s", rule)
+	}
+
+	expr := "^(?:.*\\.)?" + strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*") + "$"
+	return &PatternRule{Rule: glob, regex: regexp.MustCompile(expr)}, nil
+}
+
+// Match checks if a name matches the rule
+func (p *PatternRule) Match(name string) bool {
+	return p.regex.MatchString(name)
+}
+
+// addPattern adds a pattern rule to the root of a trie, unless the trie
+// already has it
+func (n *Node) addPattern(rule *PatternRule) {
+	for _, existing := range n.Patterns {
+		if existing.Rule == rule.Rule {
+			return
+		}
+	}
+	n.Patterns = append(n.Patterns, rule)
+}
+
+// matchPatterns returns the first pattern rule of a trie matching domain
+func matchPatterns(root *Node, domain string) (string, bool) {
+	if len(root.Patterns) == 0 {
+		return "", false
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, rule := range root.Patterns {
+		if rule.Match(name) {
+			return rule.Rule, true
+		}
+	}
+	return "", false
+}
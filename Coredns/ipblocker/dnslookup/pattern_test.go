@@ -0,0 +1,102 @@
+package dnslookup
+
+import (
+	"testing"
+)
+
+func TestCompilePatternRule(t *testing.T) {
+	tests := []struct {
+		rule      string
+		err       bool
+		matched   []string
+		unmatched []string
+	}{
+		{
+			rule:      "ads*.example.com",
+			matched:   []string{"ads.example.com", "ads1.example.com", "adserver.example.com", "cdn.ads2.example.com"},
+			unmatched: []string{"example.com", "myads.example.com", "ads.example.com.evil.net", "ads.example.net"},
+		},
+		{
+			rule:      "*.tracking.example.org",
+			matched:   []string{"a.tracking.example.org", "a.b.tracking.example.org"},
+			unmatched: []string{"tracking.example.org", "tracking.example.org.net"},
+		},
+		{
+			rule:      "Track*.Example.NET.",
+			matched:   []string{"tracker.example.net"},
+			unmatched: []string{"example.net"},
+		},
+		{
+			rule:      `/^track[0-9]+\./`,
+			matched:   []string{"track1.example.com", "track42.example.net"},
+			unmatched: []string{"track.example.com", "cdn.track1.example.com"},
+		},
+		{
+			rule:      `/(^|\.)doubleclick\.net$/`,
+			matched:   []string{"doubleclick.net", "ad.doubleclick.net"},
+			unmatched: []string{"notdoubleclick.net", "doubleclick.net.example.com"},
+		},
+		{rule: "*", err: true},
+		{rule: "*.*", err: true},
+		{rule: "ads*.exa mple.com", err: true},
+		{rule: "/[/", err: true},
+	}
+
+	for i, tc := range tests {
+		pattern, err := CompilePatternRule(tc.rule)
+		if (err != nil) != tc.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tc.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, name := range tc.matched {
+			if !pattern.Match(name) {
+				t.Errorf("Test %d: expected %s to match %s", i, tc.rule, name)
+			}
+		}
+		for _, name := range tc.unmatched {
+			if pattern.Match(name) {
+				t.Errorf("Test %d: expected %s not to match %s", i, tc.rule, name)
+			}
+		}
+	}
+}
+
+func TestMatchDomainPatterns(t *testing.T) {
+	root, stats := ParseDomainLines([]string{
+		"ads*.example.com",
+		"ads*.example.com",
+		`/^track[0-9]+\./`,
+		"static.example.com !cdn",
+		"ads*.example.com !cdn",
+		"/(/",
+	}, FormatDomains)
+	if stats.Rules != 4 || stats.Skipped != 2 || len(stats.Errors) != 1 {
+		t.Fatalf("Expected 4 rules with 2 skipped and 1 error, got %d with %d skipped and %d errors (%v)",
+			stats.Rules, stats.Skipped, len(stats.Errors), stats.Samples)
+	}
+	if len(root.Patterns) != 2 {
+		t.Errorf("Expected duplicate patterns to be added once, got %d patterns", len(root.Patterns))
+	}
+
+	tests := []struct {
+		name    string
+		matched bool
+		rule    string
+	}{
+		{"ads1.example.com.", true, "ads*.example.com"},
+		{"track7.example.net", true, `/^track[0-9]+\./`},
+		{"static.example.com", true, "static.example.com !cdn"},
+		{"cdn.static.example.com", false, "static.example.com !cdn"}, // Exceptions of domain rules still apply
+		{"www.example.com", false, ""},
+	}
+
+	for i, tc := range tests {
+		match := MatchDomain(root, tc.name)
+		if match.Matched != tc.matched || match.Rule != tc.rule {
+			t.Errorf("Test %d: expected %s matched %v by %q, got %v by %q", i, tc.name, tc.matched, tc.rule, match.Matched, match.Rule)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package dnslookup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Unknown client policies, selecting how queries of clients without a
+// configuration are handled
+const (
+	UnknownClientDeny     = "deny"     // Block every query
+	UnknownClientAllow    = "allow"    // Allow every query
+	UnknownClientTemplate = "template" // Filter with the template configuration
+)
+
+// Unknown client settings and limits
+const (
+	policyFile        = "policy.json"
+	maxUnknownClients = 1000 // Unknown clients tracked, the least recently seen are dropped
+)
+
+// UnknownClientPolicy decides how queries of clients without a configuration
+// are handled
+type UnknownClientPolicy struct {
+	Action   string        `json:"action"`             // "deny", "allow" or "template"
+	Template *ClientConfig `json:"template,omitempty"` // Configuration applied with the "template" action
+}
+
+// UnknownClient counts the queries of a client without a configuration
+type UnknownClient struct {
+	IP        string    `json:"ip"`
+	Queries   uint64    `json:"queries"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// UnknownClientReport shows the unknown client policy and the clients it
+// applied to
+type UnknownClientReport struct {
+	Policy  UnknownClientPolicy `json:"policy"`
+	Source  string              `json:"source"`  // "corefile" or "api", where the policy was set
+	Queries uint64              `json:"queries"` // Queries of unknown clients since the start
+	Clients []UnknownClient     `json:"clients"` // Unknown clients, most queries first
+}
+
+// DefaultUnknownClientPolicy returns the policy used unless one is configured,
+// which blocks unknown clients
+func DefaultUnknownClientPolicy() UnknownClientPolicy {
+	return UnknownClientPolicy{Action: UnknownClientDeny}
+}
+
+// ParseUnknownClientPolicy parses the arguments of the unknown_clients
+// directive: "deny", "allow" or "template MODE [TYPE/NAME...]", where the
+// lists are given like "blocklist/ads"
+func ParseUnknownClientPolicy(args []string) (UnknownClientPolicy, error) {
+	if len(args) == 0 {
+		return UnknownClientPolicy{}, fmt.Errorf("missing unknown client policy")
+	}
+
+	switch args[0] {
+	case UnknownClientDeny, UnknownClientAllow:
+		if len(args) > 1 {
+			return UnknownClientPolicy{}, fmt.Errorf("unknown client policy %s takes no arguments", args[0])
+		}
+		return UnknownClientPolicy{Action: args[0]}, nil
+	case UnknownClientTemplate:
+	default:
+		return UnknownClientPolicy{}, fmt.Errorf("invalid unknown client policy: %s", args[0])
+	}
+
+	if len(args) < 2 {
+		return UnknownClientPolicy{}, fmt.Errorf("unknown client template needs a mode")
+	}
+	template := &ClientConfig{
+		BlocklistRefs: []string{},
+		WhitelistRefs: []string{},
+		Mode:          args[1],
+	}
+	if !IsValidMode(template.Mode) {
+		return UnknownClientPolicy{}, fmt.Errorf("invalid mode: %s", template.Mode)
+	}
+
+	for _, ref := range args[2:] {
+		listType, listName, found := strings.Cut(ref, "/")
+		if !found || listName == "" {
+			return UnknownClientPolicy{}, fmt.Errorf("invalid list reference %s, expected TYPE/NAME", ref)
+		}
+		if listType == "blocklist" {
+			template.BlocklistRefs = append(template.BlocklistRefs, listName)
+		} else if listType == "whitelist" {
+			template.WhitelistRefs = append(template.WhitelistRefs, listName)
+		} else if listType == "ipblocklist" {
+			template.IPBlocklistRefs = append(template.IPBlocklistRefs, listName)
+		} else {
+			return UnknownClientPolicy{}, fmt.Errorf("invalid list type in %s", ref)
+		}
+	}
+
+	return UnknownClientPolicy{Action: UnknownClientTemplate, Template: template}, nil
+}
+
+// copyUnknownClientPolicy returns a deep copy of a policy
+func copyUnknownClientPolicy(policy UnknownClientPolicy) UnknownClientPolicy {
+	result := UnknownClientPolicy{Action: policy.Action}
+	if policy.Template != nil {
+		template := copyClientConfig("", *policy.Template)
+		result.Template = &template
+	}
+	return result
+}
+
+// LoadUnknownClientPolicy loads the unknown client policy set through the API
+// from a JSON file. It returns nil if there is none.
+func LoadUnknownClientPolicy(filename string) (*UnknownClientPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading unknown client policy: %v", err)
+	}
+
+	var policy UnknownClientPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("error parsing unknown client policy: %v", err)
+	}
+	if err := checkUnknownClientPolicy(&policy); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// checkUnknownClientPolicy checks the action and the template mode of a policy
+func checkUnknownClientPolicy(policy *UnknownClientPolicy) error {
+	switch policy.Action {
+	case UnknownClientDeny, UnknownClientAllow:
+		policy.Template = nil
+		return nil
+	case UnknownClientTemplate:
+		if policy.Template == nil {
+			return fmt.Errorf("unknown client policy %s needs a template", policy.Action)
+		}
+		if !IsValidMode(policy.Template.Mode) && !(policy.Template.Profile != "" && policy.Template.Mode == "") {
+			return fmt.Errorf("invalid mode: %s", policy.Template.Mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid unknown client policy: %s", policy.Action)
+	}
+}
+
+// policyPath returns the file the unknown client policy is stored in, next to
+// the client configuration
+func (df *DNSFilter) policyPath() string {
+	return filepath.Join(filepath.Dir(df.ConfigPath), policyFile)
+}
+
+// SetDefaultUnknownClientPolicy sets the policy for unknown clients that
+// applies unless one was set through the API, usually from the Corefile
+func (df *DNSFilter) SetDefaultUnknownClientPolicy(policy UnknownClientPolicy) {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	df.defaultPolicy = copyUnknownClientPolicy(policy)
+}
+
+// unknownClientPolicy returns the policy for unknown clients in effect. The
+// caller must hold the lock.
+func (df *DNSFilter) unknownClientPolicy() UnknownClientPolicy {
+	if df.unknownPolicy != nil {
+		return *df.unknownPolicy
+	}
+	return df.defaultPolicy
+}
+
+// SetUnknownClientPolicy sets the policy for unknown clients and saves it, so
+// it overrides the Corefile from now on
+func (df *DNSFilter) SetUnknownClientPolicy(policy *UnknownClientPolicy) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if err := checkUnknownClientPolicy(policy); err != nil {
+		return err
+	}
+	if policy.Template != nil {
+		if err := df.validateClientConfig(policy.Template); err != nil {
+			return err
+		}
+	}
+
+	// Keep the previous policy if the new one cannot be saved, so the policy
+	// in effect is the one applied after a restart
+	previous := df.unknownPolicy
+	stored := copyUnknownClientPolicy(*policy)
+	df.unknownPolicy = &stored
+	if err := df.saveUnknownClientPolicy(); err != nil {
+		df.unknownPolicy = previous
+		return err
+	}
+	return nil
+}
+
+// ResetUnknownClientPolicy removes the policy set through the API, so the one
+// from the Corefile applies again
+func (df *DNSFilter) ResetUnknownClientPolicy() error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if err := os.Remove(df.policyPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing unknown client policy: %v", err)
+	}
+	df.unknownPolicy = nil
+	return nil
+}
+
+// saveUnknownClientPolicy saves the policy set through the API, the caller
+// must hold the lock
+func (df *DNSFilter) saveUnknownClientPolicy() error {
+	data, err := json.MarshalIndent(df.unknownPolicy, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding unknown client policy: %v", err)
+	}
+
+	if err := os.WriteFile(df.policyPath(), data, 0644); err != nil {
+		return fmt.Errorf("error writing unknown client policy: %v", err)
+	}
+
+	return nil
+}
+
+// removeListReferencesFromPolicy removes references to a deleted list from
+// the unknown client templates. The caller must hold the lock.
+func (df *DNSFilter) removeListReferencesFromPolicy(listName, listType string) {
+	if df.defaultPolicy.Template != nil {
+		removeListReference(df.defaultPolicy.Template, listName, listType)
+	}
+
+	if df.unknownPolicy != nil && df.unknownPolicy.Template != nil {
+		if removeListReference(df.unknownPolicy.Template, listName, listType) {
+			if err := df.saveUnknownClientPolicy(); err != nil {
+				log.Printf("Warning: Could not save unknown client policy: %v", err)
+			}
+		}
+	}
+}
+
+// RecordUnknownClient counts a query of a client without a configuration
+func (df *DNSFilter) RecordUnknownClient(ip string) {
+	df.unknownMutex.Lock()
+	defer df.unknownMutex.Unlock()
+
+	now := time.Now()
+	df.unknownQueries++
+
+	if element, exists := df.unknownClients[ip]; exists {
+		client := element.Value.(*UnknownClient)
+		client.Queries++
+		client.LastSeen = now
+		df.unknownOrder.MoveToFront(element)
+		return
+	}
+
+	if df.unknownOrder.Len() >= maxUnknownClients {
+		// Make room by dropping the client seen least recently
+		oldest := df.unknownOrder.Remove(df.unknownOrder.Back()).(*UnknownClient)
+		delete(df.unknownClients, oldest.IP)
+	}
+
+	client := &UnknownClient{IP: ip, Queries: 1, FirstSeen: now, LastSeen: now}
+	df.unknownClients[ip] = df.unknownOrder.PushFront(client)
+}
+
+// GetUnknownClients returns the unknown client policy and the clients without
+// a configuration that sent queries, most queries first. Clients that have
+// been configured since are left out.
+func (df *DNSFilter) GetUnknownClients() UnknownClientReport {
+	df.unknownMutex.Lock()
+	queries := df.unknownQueries
+	clients := make([]UnknownClient, 0, df.unknownOrder.Len())
+	for element := df.unknownOrder.Front(); element != nil; element = element.Next() {
+		clients = append(clients, *element.Value.(*UnknownClient))
+	}
+	df.unknownMutex.Unlock()
+
+	df.mutex.RLock()
+	report := UnknownClientReport{
+		Policy:  copyUnknownClientPolicy(df.unknownClientPolicy()),
+		Source:  "corefile",
+		Queries: queries,
+		Clients: []UnknownClient{},
+	}
+	if df.unknownPolicy != nil {
+		report.Source = "api"
+	}
+	for _, client := range clients {
+		if _, _, exists := df.resolveClient(client.IP); !exists {
+			report.Clients = append(report.Clients, client)
+		}
+	}
+	df.mutex.RUnlock()
+
+	sort.Slice(report.Clients, func(i, j int) bool {
+		if report.Clients[i].Queries != report.Clients[j].Queries {
+			return report.Clients[i].Queries > report.Clients[j].Queries
+		}
+		return report.Clients[i].IP < report.Clients[j].IP
+	})
+
+	return report
+}
@@ -0,0 +1,82 @@
+package dnslookup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordUnknownClient(t *testing.T) {
+	df := newTestFilter(t, `{"10.0.0.1": {"blocklists": [], "whitelists": [], "mode": "blocklist"}}`, nil)
+
+	// Fill the table, then see the first client again so the second one is
+	// the least recently seen
+	for i := 0; i < maxUnknownClients; i++ {
+		df.RecordUnknownClient(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	df.RecordUnknownClient("10.1.0.0")
+	df.RecordUnknownClient("10.2.0.1")
+	df.RecordUnknownClient("10.2.0.1")
+
+	report := df.GetUnknownClients()
+	if report.Queries != maxUnknownClients+3 {
+		t.Errorf("Expected %d queries, got %d", maxUnknownClients+3, report.Queries)
+	}
+	if len(report.Clients) != maxUnknownClients {
+		t.Fatalf("Expected %d clients, got %d", maxUnknownClients, len(report.Clients))
+	}
+
+	queries := make(map[string]uint64)
+	for _, client := range report.Clients {
+		queries[client.IP] = client.Queries
+	}
+	tests := []struct {
+		ip      string
+		queries uint64
+	}{
+		{"10.1.0.0", 2},
+		{"10.1.0.1", 0}, // Dropped to make room for 10.2.0.1
+		{"10.1.0.2", 1},
+		{"10.2.0.1", 2},
+	}
+	for i, tc := range tests {
+		if queries[tc.ip] != tc.queries {
+			t.Errorf("Test %d: expected %d queries of %s, got %d", i, tc.queries, tc.ip, queries[tc.ip])
+		}
+	}
+
+	// The most queries come first
+	if first := report.Clients[0].IP; first != "10.1.0.0" {
+		t.Errorf("Expected 10.1.0.0 first, got %s", first)
+	}
+}
+
+func TestUnknownClientPolicySaveFailure(t *testing.T) {
+	df := newTestFilter(t, `{"10.0.0.1": {"blocklists": [], "whitelists": [], "mode": "blocklist"}}`, nil)
+
+	if err := df.SetUnknownClientPolicy(&UnknownClientPolicy{Action: UnknownClientAllow}); err != nil {
+		t.Fatalf("Expected no error setting the policy, got %v", err)
+	}
+
+	// A directory in place of the file can neither be written nor removed
+	path := df.policyPath()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(path, "keep"), "")
+
+	if err := df.SetUnknownClientPolicy(&UnknownClientPolicy{Action: UnknownClientDeny}); err == nil {
+		t.Errorf("Expected an error saving the policy")
+	}
+	if !df.Evaluate("10.9.9.9", "example.com").Allowed {
+		t.Errorf("Expected the previous policy to stay in effect after a failed save")
+	}
+
+	if err := df.ResetUnknownClientPolicy(); err == nil {
+		t.Errorf("Expected an error removing the policy")
+	}
+	if !df.Evaluate("10.9.9.9", "example.com").Allowed {
+		t.Errorf("Expected the policy to stay in effect after a failed reset")
+	}
+}
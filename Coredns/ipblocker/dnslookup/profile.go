@@ -0,0 +1,269 @@
+package dnslookup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// profilesFile is the file the profiles are stored in, next to the client
+// configuration
+const profilesFile = "profiles.json"
+
+// Profile is a named filtering configuration shared by many clients, e.g.
+// "kids" or "iot"
+type Profile struct {
+	Name            string   `json:"name,omitempty"`          // Name (only for output)
+	BlocklistRefs   []string `json:"blocklists"`              // References to blocklists
+	WhitelistRefs   []string `json:"whitelists"`              // References to whitelists
+	IPBlocklistRefs []string `json:"ipblocklists,omitempty"`  // References to IP blocklists, checked against answers
+	Mode            string   `json:"mode"`                    // "blocklist", "whitelist", "mixed" or "strict"
+	BlockResponse   string   `json:"blockResponse,omitempty"` // Answer for blocked queries, empty for the server default
+}
+
+// LoadProfiles loads the profiles from a JSON file
+func LoadProfiles(filename string) (map[string]Profile, error) {
+	profiles := make(map[string]Profile)
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading profiles: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("error parsing profiles: %v", err)
+	}
+
+	return profiles, nil
+}
+
+// profilesPath returns the file the profiles are stored in
+func (df *DNSFilter) profilesPath() string {
+	return filepath.Join(filepath.Dir(df.ConfigPath), profilesFile)
+}
+
+// saveProfiles saves the profiles, the caller must hold the lock
+func (df *DNSFilter) saveProfiles() error {
+	data, err := json.MarshalIndent(df.Profiles, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding profiles: %v", err)
+	}
+
+	if err := os.WriteFile(df.profilesPath(), data, 0644); err != nil {
+		return fmt.Errorf("error writing profiles: %v", err)
+	}
+
+	return nil
+}
+
+// reloadProfiles reloads the profiles, keeping the current ones if the file
+// cannot be parsed
+func (df *DNSFilter) reloadProfiles() {
+	profiles, err := LoadProfiles(df.profilesPath())
+
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error reloading profiles, keeping previous ones: %v", err)
+		df.profilesError = err.Error()
+		return
+	}
+
+	df.Profiles = profiles
+	df.profilesError = ""
+	df.lastReload = time.Now()
+	log.Printf("Profiles reloaded with %d profiles", len(profiles))
+}
+
+// copyProfile returns a deep copy of a profile with the name set
+func copyProfile(name string, profile Profile) Profile {
+	result := Profile{
+		Name:            name,
+		BlocklistRefs:   make([]string, len(profile.BlocklistRefs)),
+		WhitelistRefs:   make([]string, len(profile.WhitelistRefs)),
+		IPBlocklistRefs: make([]string, len(profile.IPBlocklistRefs)),
+		Mode:            profile.Mode,
+		BlockResponse:   profile.BlockResponse,
+	}
+
+	copy(result.BlocklistRefs, profile.BlocklistRefs)
+	copy(result.WhitelistRefs, profile.WhitelistRefs)
+	copy(result.IPBlocklistRefs, profile.IPBlocklistRefs)
+
+	return result
+}
+
+// effectiveConfig returns the configuration that applies to a client: the
+// client's own if it uses no profile, otherwise its profile with the client's
+// lists added and its mode and block response overriding the profile's. The
+// caller must hold the lock.
+func (df *DNSFilter) effectiveConfig(config ClientConfig) ClientConfig {
+	if config.Profile == "" {
+		return config
+	}
+
+	profile, exists := df.Profiles[config.Profile]
+	if !exists {
+		log.Printf("Warning: Referenced profile not found: %s", config.Profile)
+		return config
+	}
+
+	result := ClientConfig{
+		Profile:         config.Profile,
+		BlocklistRefs:   mergeUnique(mergeUnique(nil, profile.BlocklistRefs), config.BlocklistRefs),
+		WhitelistRefs:   mergeUnique(mergeUnique(nil, profile.WhitelistRefs), config.WhitelistRefs),
+		IPBlocklistRefs: mergeUnique(mergeUnique(nil, profile.IPBlocklistRefs), config.IPBlocklistRefs),
+		Mode:            profile.Mode,
+		BlockResponse:   profile.BlockResponse,
+		Schedules:       config.Schedules,
+	}
+	if config.Mode != "" {
+		result.Mode = config.Mode
+	}
+	if config.BlockResponse != "" {
+		result.BlockResponse = config.BlockResponse
+	}
+
+	return result
+}
+
+// GetAllProfiles returns all profiles, sorted by name
+func (df *DNSFilter) GetAllProfiles() []Profile {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	result := []Profile{}
+	for name, profile := range df.Profiles {
+		result = append(result, copyProfile(name, profile))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result
+}
+
+// GetProfile returns a profile by name
+func (df *DNSFilter) GetProfile(name string) (*Profile, error) {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	profile, exists := df.Profiles[name]
+	if !exists {
+		return nil, fmt.Errorf("profile not found: %s", name)
+	}
+
+	result := copyProfile(name, profile)
+	return &result, nil
+}
+
+// CreateProfile creates a new profile
+func (df *DNSFilter) CreateProfile(profile *Profile) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if profile.Name == "" {
+		return fmt.Errorf("profile name is required")
+	}
+	if _, exists := df.Profiles[profile.Name]; exists {
+		return fmt.Errorf("profile already exists: %s", profile.Name)
+	}
+
+	if err := df.validateProfile(profile); err != nil {
+		return err
+	}
+
+	df.Profiles[profile.Name] = copyProfile("", *profile)
+	return df.saveProfiles()
+}
+
+// UpdateProfile updates an existing profile, which changes the filtering of
+// all clients using it
+func (df *DNSFilter) UpdateProfile(profile *Profile) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if _, exists := df.Profiles[profile.Name]; !exists {
+		return fmt.Errorf("profile not found: %s", profile.Name)
+	}
+
+	if err := df.validateProfile(profile); err != nil {
+		return err
+	}
+
+	df.Profiles[profile.Name] = copyProfile("", *profile)
+	return df.saveProfiles()
+}
+
+// DeleteProfile deletes a profile that no client uses anymore
+func (df *DNSFilter) DeleteProfile(name string) error {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if _, exists := df.Profiles[name]; !exists {
+		return fmt.Errorf("profile not found: %s", name)
+	}
+
+	users := []string{}
+	for ip, config := range df.Clients {
+		if config.Profile == name {
+			users = append(users, ip)
+		}
+	}
+	if policy := df.unknownClientPolicy(); policy.Template != nil && policy.Template.Profile == name {
+		users = append(users, "unknown clients")
+	}
+	if len(users) > 0 {
+		sort.Strings(users)
+		return fmt.Errorf("profile %s is used by %s", name, strings.Join(users, ", "))
+	}
+
+	delete(df.Profiles, name)
+	return df.saveProfiles()
+}
+
+// validateProfile checks a profile before it is stored, the caller must hold
+// the lock
+func (df *DNSFilter) validateProfile(profile *Profile) error {
+	return df.validateClientConfig(&ClientConfig{
+		BlocklistRefs:   profile.BlocklistRefs,
+		WhitelistRefs:   profile.WhitelistRefs,
+		IPBlocklistRefs: profile.IPBlocklistRefs,
+		Mode:            profile.Mode,
+		BlockResponse:   profile.BlockResponse,
+	})
+}
+
+// removeListReferencesFromProfiles removes references to a deleted list from
+// the profiles. The caller must hold the lock.
+func (df *DNSFilter) removeListReferencesFromProfiles(listName, listType string) {
+	updated := false
+
+	for name, profile := range df.Profiles {
+		config := ClientConfig{
+			BlocklistRefs:   profile.BlocklistRefs,
+			WhitelistRefs:   profile.WhitelistRefs,
+			IPBlocklistRefs: profile.IPBlocklistRefs,
+		}
+		if removeListReference(&config, listName, listType) {
+			profile.BlocklistRefs = config.BlocklistRefs
+			profile.WhitelistRefs = config.WhitelistRefs
+			profile.IPBlocklistRefs = config.IPBlocklistRefs
+			df.Profiles[name] = profile
+			updated = true
+		}
+	}
+
+	if updated {
+		if err := df.saveProfiles(); err != nil {
+			log.Printf("Warning: Could not save profiles: %v", err)
+		}
+	}
+}
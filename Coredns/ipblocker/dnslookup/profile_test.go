@@ -0,0 +1,197 @@
+package dnslookup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// profileClients uses the profile "kids": 10.0.0.1 as is, 10.0.0.2 with an
+// extra blocklist and 10.0.0.3 in whitelist mode with its own block response
+const profileClients = `{
+  "10.0.0.1": {"blocklists": [], "whitelists": [], "profile": "kids", "mode": ""},
+  "10.0.0.2": {"blocklists": ["social", "ads"], "whitelists": [], "profile": "kids", "mode": ""},
+  "10.0.0.3": {"blocklists": [], "whitelists": ["school"], "profile": "kids", "mode": "whitelist", "blockResponse": "refused"},
+  "10.0.0.4": {"blocklists": ["social"], "whitelists": [], "mode": "blocklist"}
+}`
+
+// newProfileTestFilter returns a filter with the clients of profileClients
+// and the profile "kids" blocking ads and allowing the school site
+func newProfileTestFilter(t *testing.T) *DNSFilter {
+	t.Helper()
+
+	df := newTestFilter(t, profileClients, map[string]string{
+		"blocklist/ads":    "ads.example.com\n",
+		"blocklist/social": "social.example.com\n",
+		"whitelist/school": "school.example.com\n",
+	})
+	err := df.CreateProfile(&Profile{
+		Name:          "kids",
+		BlocklistRefs: []string{"ads"},
+		WhitelistRefs: []string{"school"},
+		Mode:          "blocklist",
+		BlockResponse: "nodata",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error creating the profile, got %v", err)
+	}
+	return df
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	df := newProfileTestFilter(t)
+
+	tests := []struct {
+		ip            string
+		blocklists    []string
+		whitelists    []string
+		mode          string
+		blockResponse string
+	}{
+		{"10.0.0.1", []string{"ads"}, []string{"school"}, "blocklist", "nodata"},
+		{"10.0.0.2", []string{"ads", "social"}, []string{"school"}, "blocklist", "nodata"}, // Lists added without duplicates
+		{"10.0.0.3", []string{"ads"}, []string{"school"}, "whitelist", "refused"},          // Mode and block response of the client
+		{"10.0.0.4", []string{"social"}, []string{}, "blocklist", ""},                      // No profile
+	}
+
+	for i, tc := range tests {
+		config := df.effectiveConfig(df.Clients[tc.ip])
+		if !reflect.DeepEqual(config.BlocklistRefs, tc.blocklists) || !reflect.DeepEqual(config.WhitelistRefs, tc.whitelists) {
+			t.Errorf("Test %d: expected blocklists %v and whitelists %v, got %v and %v", i,
+				tc.blocklists, tc.whitelists, config.BlocklistRefs, config.WhitelistRefs)
+		}
+		if config.Mode != tc.mode || config.BlockResponse != tc.blockResponse {
+			t.Errorf("Test %d: expected mode %s with block response %q, got %s with %q", i,
+				tc.mode, tc.blockResponse, config.Mode, config.BlockResponse)
+		}
+	}
+
+	// The profile's lists are not changed by merging in the client's
+	if profile := df.Profiles["kids"]; !reflect.DeepEqual(profile.BlocklistRefs, []string{"ads"}) {
+		t.Errorf("Expected the profile to keep its blocklists, got %v", profile.BlocklistRefs)
+	}
+}
+
+func TestEvaluateProfile(t *testing.T) {
+	df := newProfileTestFilter(t)
+
+	tests := []struct {
+		ip       string
+		domain   string
+		allowed  bool
+		profile  string
+		mode     string
+		listName string
+	}{
+		{"10.0.0.1", "ads.example.com", false, "kids", "blocklist", "ads"},
+		{"10.0.0.1", "social.example.com", true, "kids", "blocklist", ""},
+		{"10.0.0.2", "social.example.com", false, "kids", "blocklist", "social"},
+		{"10.0.0.3", "school.example.com", true, "kids", "whitelist", "school"},
+		{"10.0.0.3", "www.example.com", false, "kids", "whitelist", ""},
+		{"10.0.0.4", "ads.example.com", true, "", "blocklist", ""},
+	}
+
+	for i, tc := range tests {
+		verdict := df.Evaluate(tc.ip, tc.domain)
+		if verdict.Allowed != tc.allowed || verdict.ListName != tc.listName {
+			t.Errorf("Test %d: expected %s for %s allowed %v by %q, got %v by %q", i,
+				tc.domain, tc.ip, tc.allowed, tc.listName, verdict.Allowed, verdict.ListName)
+		}
+		if verdict.Profile != tc.profile || verdict.Mode != tc.mode {
+			t.Errorf("Test %d: expected profile %q in mode %s, got %q in %s", i, tc.profile, tc.mode, verdict.Profile, verdict.Mode)
+		}
+	}
+
+	// Updating the profile changes the filtering of its clients right away
+	err := df.UpdateProfile(&Profile{Name: "kids", BlocklistRefs: []string{"ads", "social"}, WhitelistRefs: []string{}, Mode: "blocklist"})
+	if err != nil {
+		t.Fatalf("Expected no error updating the profile, got %v", err)
+	}
+	if verdict := df.Evaluate("10.0.0.1", "social.example.com"); verdict.Allowed || verdict.BlockResponse != "" {
+		t.Errorf("Expected social.example.com to be blocked with the default block response, got %+v", verdict)
+	}
+}
+
+func TestProfileCRUD(t *testing.T) {
+	df := newProfileTestFilter(t)
+
+	tests := []struct {
+		profile *Profile
+		err     string
+	}{
+		{&Profile{BlocklistRefs: []string{}, WhitelistRefs: []string{}, Mode: "blocklist"}, "name is required"},
+		{&Profile{Name: "kids", BlocklistRefs: []string{}, WhitelistRefs: []string{}, Mode: "blocklist"}, "already exists"},
+		{&Profile{Name: "iot", BlocklistRefs: []string{"missing"}, WhitelistRefs: []string{}, Mode: "blocklist"}, "missing"},
+		{&Profile{Name: "iot", BlocklistRefs: []string{}, WhitelistRefs: []string{}, Mode: "other"}, "mode"},
+		{&Profile{Name: "iot", BlocklistRefs: []string{"social"}, WhitelistRefs: []string{}, Mode: "blocklist"}, ""},
+	}
+
+	for i, tc := range tests {
+		err := df.CreateProfile(tc.profile)
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("Test %d: expected error %q, got %v", i, tc.err, err)
+		}
+	}
+
+	if err := df.UpdateProfile(&Profile{Name: "missing", BlocklistRefs: []string{}, WhitelistRefs: []string{}, Mode: "blocklist"}); err == nil {
+		t.Errorf("Expected an error updating a missing profile")
+	}
+
+	profiles := df.GetAllProfiles()
+	if len(profiles) != 2 || profiles[0].Name != "iot" || profiles[1].Name != "kids" {
+		t.Errorf("Expected profiles iot and kids, got %+v", profiles)
+	}
+
+	// The profiles are saved and loaded again
+	loaded, err := LoadProfiles(df.profilesPath())
+	if err != nil {
+		t.Fatalf("Expected no error loading the profiles, got %v", err)
+	}
+	if len(loaded) != 2 || !reflect.DeepEqual(loaded["iot"].BlocklistRefs, []string{"social"}) {
+		t.Errorf("Expected the saved profiles, got %+v", loaded)
+	}
+}
+
+func TestDeleteProfileInUse(t *testing.T) {
+	df := newProfileTestFilter(t)
+
+	if err := df.CreateProfile(&Profile{Name: "iot", BlocklistRefs: []string{"ads"}, WhitelistRefs: []string{}, Mode: "blocklist"}); err != nil {
+		t.Fatalf("Expected no error creating the profile, got %v", err)
+	}
+	err := df.SetUnknownClientPolicy(&UnknownClientPolicy{
+		Action:   UnknownClientTemplate,
+		Template: &ClientConfig{BlocklistRefs: []string{}, WhitelistRefs: []string{}, Profile: "iot"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error setting the policy, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"kids", "profile kids is used by 10.0.0.1, 10.0.0.2, 10.0.0.3"},
+		{"iot", "profile iot is used by unknown clients"},
+		{"missing", "profile not found: missing"},
+	}
+
+	for i, tc := range tests {
+		if err := df.DeleteProfile(tc.name); err == nil || err.Error() != tc.err {
+			t.Errorf("Test %d: expected error %q, got %v", i, tc.err, err)
+		}
+		if _, exists := df.Profiles[tc.name]; !exists && tc.name != "missing" {
+			t.Errorf("Test %d: expected profile %s to be kept", i, tc.name)
+		}
+	}
+
+	// Once no client uses it anymore, the profile can be deleted
+	if err := df.ResetUnknownClientPolicy(); err != nil {
+		t.Fatalf("Expected no error resetting the policy, got %v", err)
+	}
+	if err := df.DeleteProfile("iot"); err != nil {
+		t.Errorf("Expected no error deleting an unused profile, got %v", err)
+	}
+	if _, err := df.GetProfile("iot"); err == nil {
+		t.Errorf("Expected profile iot to be deleted")
+	}
+}
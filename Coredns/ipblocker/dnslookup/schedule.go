@@ -0,0 +1,232 @@
+package dnslookup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule changes the filtering of a client during a recurring time window,
+// e.g. blocking social media on school nights
+type Schedule struct {
+	Name          string   `json:"name,omitempty"`       // Name shown when the schedule applies
+	Days          []string `json:"days,omitempty"`       // Days the window starts on, "mon" to "sun", every day if empty
+	Start         string   `json:"start"`                // Start of the window, "HH:MM"
+	End           string   `json:"end"`                  // End of the window, "HH:MM", before the start for windows past midnight
+	Timezone      string   `json:"timezone,omitempty"`   // IANA time zone, e.g. "Europe/Berlin", the server's if empty
+	BlocklistRefs []string `json:"blocklists,omitempty"` // Blocklists added during the window
+	WhitelistRefs []string `json:"whitelists,omitempty"` // Whitelists added during the window
+	Mode          string   `json:"mode,omitempty"`       // Mode during the window, the client's if empty
+
+	// Window parsed from the fields above when the schedule is decoded or
+	// validated, so queries do not parse it again. loc is nil if the window
+	// is invalid, which makes the schedule inactive.
+	start, end int            // Minutes since midnight
+	days       uint8          // Bit per weekday the window starts on, 0 for every day
+	loc        *time.Location // Time zone of the window
+}
+
+// scheduleDays maps the day names of schedules to weekdays
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Time zones of schedules, cached as loading one reads the zone database
+var (
+	locationsMutex sync.Mutex
+	locations      = make(map[string]*time.Location)
+)
+
+// loadLocation returns the time zone of a schedule
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+
+	locationsMutex.Lock()
+	defer locationsMutex.Unlock()
+
+	if loc, exists := locations[name]; exists {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+// parseClock parses a time of day like "21:30" into minutes since midnight
+func parseClock(value string) (int, error) {
+	hours, minutes, found := strings.Cut(value, ":")
+	if !found || len(hours) != 2 || len(minutes) != 2 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	return h*60 + m, nil
+}
+
+// UnmarshalJSON decodes a schedule and parses its window. An invalid window
+// is reported by validateSchedule and leaves the schedule inactive.
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	type plain Schedule // Without this method
+	var decoded plain
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*s = Schedule(decoded)
+	s.parseWindow()
+	return nil
+}
+
+// parseWindow parses the days, times and time zone of a schedule
+func (s *Schedule) parseWindow() error {
+	s.loc = nil
+
+	var days uint8
+	for _, day := range s.Days {
+		weekday, exists := scheduleDays[day]
+		if !exists {
+			return fmt.Errorf("invalid schedule day %s, expected mon, tue, wed, thu, fri, sat or sun", day)
+		}
+		days |= 1 << weekday
+	}
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return err
+	}
+	loc, err := loadLocation(s.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid schedule timezone %s", s.Timezone)
+	}
+
+	s.start, s.end, s.days, s.loc = start, end, days, loc
+	return nil
+}
+
+// validateSchedule checks the window and mode of a schedule and keeps the
+// parsed window
+func validateSchedule(schedule *Schedule) error {
+	if err := schedule.parseWindow(); err != nil {
+		return err
+	}
+	if schedule.Mode != "" && !IsValidMode(schedule.Mode) {
+		schedule.loc = nil
+		return fmt.Errorf("invalid schedule mode: %s", schedule.Mode)
+	}
+	return nil
+}
+
+// Active checks if the window of a schedule contains now. A window with an
+// end before its start runs past midnight into the next day, and a window
+// with equal start and end lasts the whole day.
+func (s *Schedule) Active(now time.Time) bool {
+	if s.loc == nil {
+		return false // Invalid window
+	}
+
+	local := now.In(s.loc)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	switch {
+	case s.start < s.end:
+		return s.onDay(today) && minute >= s.start && minute < s.end
+	case s.start > s.end:
+		return (s.onDay(today) && minute >= s.start) || (s.onDay(yesterday) && minute < s.end)
+	default:
+		return s.onDay(today)
+	}
+}
+
+// onDay checks if a window of the schedule starts on a weekday
+func (s *Schedule) onDay(day time.Weekday) bool {
+	return s.days == 0 || s.days&(1<<day) != 0
+}
+
+// label returns the name of a schedule shown in verdicts, its position if it
+// has no name
+func (s *Schedule) label(index int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("schedule %d", index+1)
+}
+
+// copySchedules returns a deep copy of schedules
+func copySchedules(schedules []Schedule) []Schedule {
+	if schedules == nil {
+		return nil
+	}
+
+	result := make([]Schedule, len(schedules))
+	for i, schedule := range schedules {
+		result[i] = schedule
+		result[i].Days = append([]string(nil), schedule.Days...)
+		result[i].BlocklistRefs = append([]string(nil), schedule.BlocklistRefs...)
+		result[i].WhitelistRefs = append([]string(nil), schedule.WhitelistRefs...)
+	}
+	return result
+}
+
+// applySchedules returns a configuration with the schedules active at now
+// applied: their lists are added and the mode of the last one setting a mode
+// replaces the client's. It also returns the labels of the active schedules.
+func applySchedules(config ClientConfig, now time.Time) (ClientConfig, []string) {
+	var active []string
+	for i := range config.Schedules {
+		schedule := &config.Schedules[i]
+		if !schedule.Active(now) {
+			continue
+		}
+
+		if len(active) == 0 {
+			// Copy the lists before the first change, they belong to the client
+			config.BlocklistRefs = mergeUnique(nil, config.BlocklistRefs)
+			config.WhitelistRefs = mergeUnique(nil, config.WhitelistRefs)
+		}
+		active = append(active, schedule.label(i))
+
+		config.BlocklistRefs = mergeUnique(config.BlocklistRefs, schedule.BlocklistRefs)
+		config.WhitelistRefs = mergeUnique(config.WhitelistRefs, schedule.WhitelistRefs)
+		if schedule.Mode != "" {
+			config.Mode = schedule.Mode
+		}
+	}
+	return config, active
+}
+
+// SetClock replaces the clock schedules are evaluated with, e.g. by a fixed
+// time in tests. A nil clock restores the system clock.
+func (df *DNSFilter) SetClock(clock func() time.Time) {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if clock == nil {
+		clock = time.Now
+	}
+	df.clock = clock
+}
@@ -0,0 +1,99 @@
+package dnslookup
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // Time zones of the schedules, independent of the system
+)
+
+// scheduleClients adds the list "social" to clients during their schedules:
+// 10.0.0.1 on school nights past midnight, 10.0.0.2 during office hours in New
+// York and 10.0.0.3 all Saturday
+const scheduleClients = `{
+  "10.0.0.1": {"blocklists": [], "whitelists": [], "mode": "blocklist", "schedules": [
+    {"name": "school nights", "days": ["sun", "mon", "tue", "wed", "thu"], "start": "21:00", "end": "07:00", "timezone": "UTC", "blocklists": ["social"]}
+  ]},
+  "10.0.0.2": {"blocklists": [], "whitelists": [], "mode": "blocklist", "schedules": [
+    {"name": "office", "start": "08:00", "end": "16:00", "timezone": "America/New_York", "blocklists": ["social"]}
+  ]},
+  "10.0.0.3": {"blocklists": [], "whitelists": [], "mode": "blocklist", "schedules": [
+    {"name": "weekend", "days": ["sat"], "start": "00:00", "end": "00:00", "timezone": "UTC", "blocklists": ["social"]}
+  ]}
+}`
+
+func TestScheduleActive(t *testing.T) {
+	df := newTestFilter(t, scheduleClients, map[string]string{"blocklist/social": "social.example.com\n"})
+
+	// 2025-04-14 is a Monday; New York is at UTC-4 in April
+	tests := []struct {
+		client string
+		now    string
+		active bool
+	}{
+		// Window past midnight, starting on the listed days only
+		{"10.0.0.1", "2025-04-14T20:59:00Z", false},
+		{"10.0.0.1", "2025-04-14T21:00:00Z", true},
+		{"10.0.0.1", "2025-04-15T06:59:00Z", true}, // Started Monday
+		{"10.0.0.1", "2025-04-15T07:00:00Z", false},
+		{"10.0.0.1", "2025-04-14T03:00:00Z", true},  // Started Sunday
+		{"10.0.0.1", "2025-04-18T22:00:00Z", false}, // Friday
+		{"10.0.0.1", "2025-04-19T03:00:00Z", false}, // Would have started Friday
+
+		// Window in the client's time zone
+		{"10.0.0.2", "2025-04-14T11:59:00Z", false}, // 07:59 in New York
+		{"10.0.0.2", "2025-04-14T12:00:00Z", true},  // 08:00
+		{"10.0.0.2", "2025-04-14T19:59:00Z", true},  // 15:59
+		{"10.0.0.2", "2025-04-14T20:00:00Z", false}, // 16:00
+		{"10.0.0.2", "2025-04-15T02:00:00Z", false}, // 22:00 on Monday, 02:00 Tuesday in UTC
+
+		// Equal start and end, the whole day
+		{"10.0.0.3", "2025-04-18T23:59:00Z", false},
+		{"10.0.0.3", "2025-04-19T00:00:00Z", true},
+		{"10.0.0.3", "2025-04-19T23:59:00Z", true},
+		{"10.0.0.3", "2025-04-20T00:00:00Z", false},
+	}
+
+	for i, tc := range tests {
+		now, err := time.Parse(time.RFC3339, tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		df.SetClock(func() time.Time { return now })
+
+		verdict := df.Evaluate(tc.client, "social.example.com")
+		if verdict.Allowed == tc.active {
+			t.Errorf("Test %d: expected schedule of %s active=%t at %s, got allowed=%t", i, tc.client, tc.active, tc.now, verdict.Allowed)
+		}
+		if active := len(verdict.Schedules) > 0; active != tc.active {
+			t.Errorf("Test %d: expected schedule of %s active=%t at %s, got schedules %v", i, tc.client, tc.active, tc.now, verdict.Schedules)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		valid    bool
+	}{
+		{Schedule{Start: "21:00", End: "07:00"}, true},
+		{Schedule{Days: []string{"mon", "sun"}, Start: "00:00", End: "23:59", Timezone: "Europe/Berlin"}, true},
+		{Schedule{Start: "21:00", End: "07:00", Mode: "whitelist"}, true},
+		{Schedule{Days: []string{"monday"}, Start: "21:00", End: "07:00"}, false},
+		{Schedule{Start: "9:00", End: "17:00"}, false},
+		{Schedule{Start: "24:00", End: "07:00"}, false},
+		{Schedule{Start: "21:00", End: "07:60"}, false},
+		{Schedule{Start: "21:00", End: "07:00", Timezone: "Mars/Olympus"}, false},
+		{Schedule{Start: "21:00", End: "07:00", Mode: "paranoid"}, false},
+	}
+
+	for i, tc := range tests {
+		schedule := tc.schedule
+		err := validateSchedule(&schedule)
+		if (err == nil) != tc.valid {
+			t.Errorf("Test %d: expected valid=%t, got error %v", i, tc.valid, err)
+		}
+		if err != nil && schedule.Active(time.Now()) {
+			t.Errorf("Test %d: expected an invalid schedule to be inactive", i)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package dnslookup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Subscription settings and limits
+const (
+	subscriptionsFile        = "subscriptions.json"
+	defaultRefreshInterval   = 24 * time.Hour
+	minRefreshInterval       = time.Minute
+	refreshCheckInterval     = time.Minute
+	subscriptionFetchTimeout = 2 * time.Minute
+	maxSubscriptionSize      = 64 << 20 // 64 MiB
+)
+
+// Subscription is a remote source a list is periodically refreshed from
+type Subscription struct {
+	URL          string    `json:"url"`
+	Interval     string    `json:"interval,omitempty"`     // Refresh interval, e.g. "12h", 24h by default
+	Format       string    `json:"format,omitempty"`       // Format of the remote list
+	ETag         string    `json:"etag,omitempty"`         // ETag of the last fetched version
+	LastModified string    `json:"lastModified,omitempty"` // Last-Modified of the last fetched version
+	LastFetched  time.Time `json:"lastFetched,omitempty"`  // Last time the source was checked
+	LastUpdated  time.Time `json:"lastUpdated,omitempty"`  // Last time the list content changed
+	LastError    string    `json:"lastError,omitempty"`    // Error of the last check, the list keeps its content
+}
+
+// refreshInterval returns the parsed refresh interval of a subscription
+func (s *Subscription) refreshInterval() time.Duration {
+	interval, err := time.ParseDuration(s.Interval)
+	if err != nil || interval < minRefreshInterval {
+		return defaultRefreshInterval
+	}
+	return interval
+}
+
+// validateSubscription checks the settings of a subscription, nil is valid
+func validateSubscription(listType string, sub *Subscription) error {
+	if sub == nil {
+		return nil
+	}
+
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid subscription url: %s", sub.URL)
+	}
+
+	if sub.Interval != "" {
+		interval, err := time.ParseDuration(sub.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid subscription interval: %s", sub.Interval)
+		}
+		if interval < minRefreshInterval {
+			return fmt.Errorf("subscription interval must be at least %s", minRefreshInterval)
+		}
+	}
+
+	return validateListFormat(listType, sub.Format)
+}
+
+// LoadSubscriptions loads the subscriptions from a JSON file
+func LoadSubscriptions(filename string) (map[string]*Subscription, error) {
+	subscriptions := make(map[string]*Subscription)
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return subscriptions, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading subscriptions: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("error parsing subscriptions: %v", err)
+	}
+
+	return subscriptions, nil
+}
+
+// subscriptionsPath returns the file the subscriptions are stored in, next to
+// the client configuration
+func (df *DNSFilter) subscriptionsPath() string {
+	return filepath.Join(filepath.Dir(df.ConfigPath), subscriptionsFile)
+}
+
+// encodeSubscriptions encodes the subscriptions for writeSubscriptions, the
+// caller must hold the lock
+func (df *DNSFilter) encodeSubscriptions() ([]byte, uint64, error) {
+	data, err := json.MarshalIndent(df.Subscriptions, "", "  ")
+	if err != nil {
+		return nil, 0, fmt.Errorf("error encoding subscriptions: %v", err)
+	}
+
+	df.subscriptionsVersion++
+	return data, df.subscriptionsVersion, nil
+}
+
+// writeSubscriptions writes encoded subscriptions without holding the lock,
+// so lookups do not wait for the disk. A version older than the one on disk
+// is skipped.
+func (df *DNSFilter) writeSubscriptions(data []byte, version uint64) error {
+	df.subscriptionsSave.Lock()
+	defer df.subscriptionsSave.Unlock()
+
+	if version <= df.subscriptionsSaved {
+		return nil
+	}
+	if err := os.WriteFile(df.subscriptionsPath(), data, 0644); err != nil {
+		return fmt.Errorf("error writing subscriptions: %v", err)
+	}
+
+	df.subscriptionsSaved = version
+	return nil
+}
+
+// setSubscription replaces or, with a nil subscription, removes the
+// subscription of a list. A new subscription is fetched right away.
+func (df *DNSFilter) setSubscription(listType, listName string, sub *Subscription) error {
+	key := listKey(listType, listName)
+
+	df.mutex.Lock()
+	if sub == nil {
+		if _, exists := df.Subscriptions[key]; !exists {
+			df.mutex.Unlock()
+			return nil
+		}
+		delete(df.Subscriptions, key)
+	} else {
+		df.Subscriptions[key] = &Subscription{
+			URL:      sub.URL,
+			Interval: sub.Interval,
+			Format:   sub.Format,
+		}
+	}
+	data, version, err := df.encodeSubscriptions()
+	df.mutex.Unlock()
+
+	if err == nil {
+		err = df.writeSubscriptions(data, version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if sub != nil {
+		go func() {
+			if err := df.RefreshList(listName, listType); err != nil {
+				log.Printf("Warning: Could not refresh %s %s: %v", listType, listName, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// copySubscription returns a copy of the subscription of a list, or nil. The
+// caller must hold the lock.
+func (df *DNSFilter) copySubscription(listType, listName string) *Subscription {
+	sub, exists := df.Subscriptions[listKey(listType, listName)]
+	if !exists {
+		return nil
+	}
+	result := *sub
+	return &result
+}
+
+// subscriptionSource returns the URL a list is refreshed from, or an empty
+// string. The caller must hold the lock.
+func (df *DNSFilter) subscriptionSource(listType, listName string) string {
+	if sub, exists := df.Subscriptions[listKey(listType, listName)]; exists {
+		return sub.URL
+	}
+	return ""
+}
+
+// checkNotSubscribed rejects manual changes to a subscribed list, which the
+// next refresh would overwrite
+func (df *DNSFilter) checkNotSubscribed(listType, listName string) error {
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	if source := df.subscriptionSource(listType, listName); source != "" {
+		return fmt.Errorf("list %s is managed by its subscription to %s", listName, source)
+	}
+	return nil
+}
+
+// StartRefresher starts refreshing subscribed lists in the background when
+// their refresh interval has passed, and dropping expired overrides
+func (df *DNSFilter) StartRefresher() {
+	df.watchMutex.Lock()
+	defer df.watchMutex.Unlock()
+
+	if df.refresherStop != nil {
+		return // Already running
+	}
+
+	stop := make(chan struct{})
+	df.refresherStop = stop
+
+	go func() {
+		ticker := time.NewTicker(refreshCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			df.refreshDueLists()
+			df.pruneOverrides()
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopRefresher stops the background refresher, the caller must hold watchMutex
+func (df *DNSFilter) stopRefresher() {
+	if df.refresherStop != nil {
+		close(df.refresherStop)
+		df.refresherStop = nil
+	}
+}
+
+// refreshDueLists refreshes all subscribed lists whose interval has passed
+func (df *DNSFilter) refreshDueLists() {
+	type dueList struct{ listType, listName string }
+	due := []dueList{}
+
+	df.mutex.RLock()
+	now := time.Now()
+	for _, listType := range []string{"blocklist", "whitelist", "ipblocklist"} {
+		for _, listName := range df.listNames(listType) {
+			sub, exists := df.Subscriptions[listKey(listType, listName)]
+			if exists && now.Sub(sub.LastFetched) >= sub.refreshInterval() {
+				due = append(due, dueList{listType, listName})
+			}
+		}
+	}
+	df.mutex.RUnlock()
+
+	for _, list := range due {
+		if err := df.RefreshList(list.listName, list.listType); err != nil {
+			log.Printf("Warning: Could not refresh %s %s: %v", list.listType, list.listName, err)
+		}
+	}
+}
+
+// listNames returns the names of the loaded lists of a type. The caller must
+// hold the lock.
+func (df *DNSFilter) listNames(listType string) []string {
+	names := []string{}
+	switch listType {
+	case "blocklist":
+		for name := range df.BlocklistTries {
+			names = append(names, name)
+		}
+	case "whitelist":
+		for name := range df.WhitelistTries {
+			names = append(names, name)
+		}
+	case "ipblocklist":
+		for name := range df.IPBlocklists {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RefreshList fetches a subscribed list from its source. The new content is
+// only swapped in if it can be parsed and is not empty; otherwise the list
+// keeps its content and the error is recorded in the subscription.
+func (df *DNSFilter) RefreshList(listName, listType string) error {
+	df.refreshMutex.Lock()
+	defer df.refreshMutex.Unlock()
+
+	key := listKey(listType, listName)
+
+	df.mutex.RLock()
+	sub, exists := df.Subscriptions[key]
+	var current Subscription
+	if exists {
+		current = *sub
+	}
+	df.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("list %s has no subscription", listName)
+	}
+
+	data, etag, lastModified, err := fetchSubscription(&current)
+	var lines []string
+	var trie *Node
+	var stats ParseStats
+	var ipList *IPList
+	if err == nil && data != nil {
+		if listType == "ipblocklist" {
+			ipList, err = ParseIPList(bytes.NewReader(data))
+			if err == nil && len(ipList.Prefixes) == 0 {
+				err = fmt.Errorf("source contains no valid entries")
+			}
+		} else {
+			lines, err = readLines(bytes.NewReader(data))
+			if err == nil {
+				trie, stats = ParseDomainLines(lines, current.Format)
+				if stats.Rules == 0 {
+					err = fmt.Errorf("source contains no supported rules (%d skipped as %s)", stats.Skipped, stats.Format)
+				}
+			}
+		}
+	}
+
+	// Write the new content next to the list file before taking the lock, so
+	// lookups do not wait for the disk. Domain lists are saved as fetched, so
+	// they are parsed the same way when the file is loaded again.
+	var listPath, tmpPath string
+	if err == nil && data != nil {
+		var entries []string
+		if listType == "ipblocklist" {
+			entries = ipList.Entries()
+			stats.Rules = len(entries)
+		} else {
+			entries = withFormatHeader(stats.Format, lines)
+		}
+		listPath, tmpPath, err = df.writeRefreshedList(listName, listType, entries)
+		if tmpPath != "" {
+			defer os.Remove(tmpPath) // Only left if the content is not swapped in
+		}
+	}
+
+	df.mutex.Lock()
+
+	// The subscription may have been replaced or removed, or the list
+	// deleted meanwhile
+	sub, exists = df.Subscriptions[key]
+	if !exists || sub.URL != current.URL || !df.listLoaded(listType, listName) {
+		df.mutex.Unlock()
+		return nil
+	}
+
+	sub.LastFetched = time.Now()
+	if err == nil && data != nil {
+		// Renaming replaces the list file at once, so it is never read half
+		// written, and keeps it in step with the loaded content
+		if renameErr := os.Rename(tmpPath, listPath); renameErr != nil {
+			err = fmt.Errorf("error replacing list file %s: %v", listPath, renameErr)
+		}
+	}
+
+	if err != nil {
+		sub.LastError = err.Error()
+	} else {
+		sub.LastError = ""
+	}
+	if err == nil && data != nil {
+		switch listType {
+		case "blocklist":
+			df.BlocklistTries[listName] = trie
+		case "whitelist":
+			df.WhitelistTries[listName] = trie
+		case "ipblocklist":
+			df.IPBlocklists[listName] = ipList
+		}
+		if trie != nil {
+			df.listStats[key] = stats
+		}
+
+		sub.ETag = etag
+		sub.LastModified = lastModified
+		sub.LastUpdated = sub.LastFetched
+		log.Printf("Refreshed %s %s from %s with %d rules, %d skipped", listType, listName, sub.URL, stats.Rules, stats.Skipped)
+	}
+
+	encoded, version, saveErr := df.encodeSubscriptions()
+	df.mutex.Unlock()
+
+	if saveErr == nil {
+		saveErr = df.writeSubscriptions(encoded, version)
+	}
+	if err != nil {
+		if saveErr != nil {
+			log.Printf("Warning: Could not save subscriptions: %v", saveErr)
+		}
+		return err
+	}
+	return saveErr
+}
+
+// writeRefreshedList writes the refreshed entries of a list to a hidden
+// temporary file in the list directory, which the watcher and the list loader
+// ignore. It returns the path of the list file and of the temporary file.
+func (df *DNSFilter) writeRefreshedList(listName, listType string, entries []string) (string, string, error) {
+	dirPath, err := df.listDir(listType)
+	if err != nil {
+		return "", "", err
+	}
+
+	tmpPath := filepath.Join(dirPath, "."+listName+".tmp")
+	if err := writeListFile(tmpPath, entries); err != nil {
+		os.Remove(tmpPath)
+		return "", "", err
+	}
+	return filepath.Join(dirPath, listName), tmpPath, nil
+}
+
+// fetchSubscription downloads the source of a subscription, using the ETag
+// and Last-Modified of the last fetch. It returns nil data if the source was
+// not modified.
+func fetchSubscription(sub *Subscription) ([]byte, string, string, error) {
+	req, err := http.NewRequest(http.MethodGet, sub.URL, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if sub.ETag != "" {
+		req.Header.Set("If-None-Match", sub.ETag)
+	}
+	if sub.LastModified != "" {
+		req.Header.Set("If-Modified-Since", sub.LastModified)
+	}
+
+	client := &http.Client{Timeout: subscriptionFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, sub.ETag, sub.LastModified, nil
+	default:
+		return nil, "", "", fmt.Errorf("unexpected status from %s: %s", sub.URL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error reading %s: %v", sub.URL, err)
+	}
+	if len(data) > maxSubscriptionSize {
+		return nil, "", "", fmt.Errorf("source %s exceeds %d bytes", sub.URL, maxSubscriptionSize)
+	}
+
+	return data, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
@@ -0,0 +1,187 @@
+package dnslookup
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRefreshList(t *testing.T) {
+	var response atomic.Value // Name of the response the source sends next
+	response.Store("ok")
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch response.Load().(string) {
+		case "ok":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.net\n"))
+		case "error":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "large":
+			w.Header().Set("ETag", `"v2"`)
+			line := []byte("0.0.0.0 ads.example.org\n")
+			w.Write(bytes.Repeat(line, maxSubscriptionSize/len(line)+1))
+		}
+	}))
+	defer source.Close()
+
+	df := newTestFilter(t, `{"10.0.0.1": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}}`,
+		map[string]string{"blocklist/ads": "# Empty until refreshed\n"})
+
+	// Subscribe without the refresh setSubscription starts in the background
+	df.mutex.Lock()
+	df.Subscriptions[listKey("blocklist", "ads")] = &Subscription{URL: source.URL, Format: FormatHosts}
+	df.mutex.Unlock()
+
+	tests := []struct {
+		response string
+		valid    bool
+		etag     string // ETag of the subscription afterwards
+	}{
+		{"ok", true, `"v1"`},
+		{"ok", true, `"v1"`}, // Not modified
+		{"error", false, `"v1"`},
+		{"large", false, `"v1"`},
+	}
+
+	for i, tc := range tests {
+		response.Store(tc.response)
+		err := df.RefreshList("ads", "blocklist")
+		if (err == nil) != tc.valid {
+			t.Fatalf("Test %d: expected valid=%t, got error %v", i, tc.valid, err)
+		}
+
+		// Failed refreshes keep the downloaded content
+		if df.CheckDomain("10.0.0.1", "tracker.example.net") {
+			t.Errorf("Test %d: expected tracker.example.net to be blocked", i)
+		}
+		if !df.CheckDomain("10.0.0.1", "ads.example.org") {
+			t.Errorf("Test %d: expected ads.example.org to be allowed", i)
+		}
+
+		// The state of the subscription is saved
+		saved, err := LoadSubscriptions(df.subscriptionsPath())
+		if err != nil {
+			t.Fatalf("Test %d: expected no error loading subscriptions, got %v", i, err)
+		}
+		sub, exists := saved[listKey("blocklist", "ads")]
+		if !exists {
+			t.Fatalf("Test %d: expected the subscription to be saved", i)
+		}
+		if sub.ETag != tc.etag || sub.URL != source.URL || sub.LastFetched.IsZero() {
+			t.Errorf("Test %d: expected saved ETag %s for %s, got %+v", i, tc.etag, source.URL, sub)
+		}
+		if (sub.LastError == "") != tc.valid {
+			t.Errorf("Test %d: expected saved error only for failed refreshes, got %q", i, sub.LastError)
+		}
+	}
+
+	// The list file holds the downloaded rules, so they survive a restart
+	data, err := os.ReadFile(filepath.Join(df.BlocklistDir, "ads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# Format: hosts") || !strings.Contains(string(data), "tracker.example.net") {
+		t.Errorf("Expected the downloaded hosts list in the list file, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(df.BlocklistDir, ".ads.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file left, got %v", err)
+	}
+
+	restarted := NewDNSFilter(df.ConfigPath, df.BlocklistDir, df.WhitelistDir, df.IPBlocklistDir)
+	if err := restarted.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.CheckDomain("10.0.0.1", "ads.example.com") {
+		t.Error("Expected ads.example.com to be blocked after a restart")
+	}
+	if sub := restarted.copySubscription("blocklist", "ads"); sub == nil || sub.ETag != `"v1"` {
+		t.Errorf("Expected the subscription to be loaded after a restart, got %+v", sub)
+	}
+}
+
+func TestDeleteListDuringRefresh(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(df *DNSFilter) error
+	}{
+		{"list and subscription", func(df *DNSFilter) error {
+			return df.DeleteList("ads", "blocklist")
+		}},
+		{"list only", func(df *DNSFilter) error {
+			// A list deleted from under its subscription, e.g. by another
+			// caller taking the lock first
+			df.mutex.Lock()
+			defer df.mutex.Unlock()
+			return df.deleteDomainList("ads", "blocklist")
+		}},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			requested := make(chan struct{})
+			release := make(chan struct{})
+			source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(requested)
+				<-release
+				w.Write([]byte("0.0.0.0 ads.example.com\n"))
+			}))
+			defer source.Close()
+
+			df := newTestFilter(t, `{"10.0.0.1": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}}`,
+				map[string]string{"blocklist/ads": "# Empty until refreshed\n"})
+			df.mutex.Lock()
+			df.Subscriptions[listKey("blocklist", "ads")] = &Subscription{URL: source.URL, Format: FormatHosts}
+			df.mutex.Unlock()
+
+			// Delete the list while the refresh waits for the source
+			refreshed := make(chan error)
+			go func() { refreshed <- df.RefreshList("ads", "blocklist") }()
+			<-requested
+			if err := tc.delete(df); err != nil {
+				t.Fatalf("Test %d: expected no error deleting the list, got %v", i, err)
+			}
+			close(release)
+			if err := <-refreshed; err != nil {
+				t.Errorf("Test %d: expected the refresh of a deleted list to be dropped, got %v", i, err)
+			}
+
+			if content, err := df.GetListContent("ads", "blocklist"); err == nil {
+				t.Errorf("Test %d: expected the list to stay deleted, got %v", i, content.Domains)
+			}
+			for _, name := range []string{"ads", ".ads.tmp"} {
+				if _, err := os.Stat(filepath.Join(df.BlocklistDir, name)); !os.IsNotExist(err) {
+					t.Errorf("Test %d: expected no file %s, got %v", i, name, err)
+				}
+			}
+		})
+	}
+
+	// Deleting a list removes its subscription in the same step
+	df := newTestFilter(t, `{}`, map[string]string{"blocklist/ads": "ads.example.com\n"})
+	df.mutex.Lock()
+	df.Subscriptions[listKey("blocklist", "ads")] = &Subscription{URL: "http://127.0.0.1:1/ads"}
+	df.mutex.Unlock()
+	if err := df.DeleteList("ads", "blocklist"); err != nil {
+		t.Fatalf("Expected no error deleting the list, got %v", err)
+	}
+	if df.copySubscription("blocklist", "ads") != nil {
+		t.Errorf("Expected the subscription to be deleted")
+	}
+	saved, err := LoadSubscriptions(df.subscriptionsPath())
+	if err != nil {
+		t.Fatalf("Expected no error loading subscriptions, got %v", err)
+	}
+	if len(saved) != 0 {
+		t.Errorf("Expected no saved subscriptions, got %v", saved)
+	}
+}
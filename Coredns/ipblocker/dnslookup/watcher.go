@@ -0,0 +1,277 @@
+package dnslookup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay is how long a file has to stay unchanged before it is reloaded,
+// so that a file being written is not parsed halfway
+const reloadDelay = 500 * time.Millisecond
+
+// Status describes the state of the files behind a DNS filter
+type Status struct {
+	Clients       int               `json:"clients"`
+	Profiles      int               `json:"profiles"`
+	Blocklists    int               `json:"blocklists"`
+	Whitelists    int               `json:"whitelists"`
+	IPBlocklists  int               `json:"ipblocklists"`
+	Watching      bool              `json:"watching"`                // Files are reloaded when they change
+	LastReload    time.Time         `json:"lastReload"`              // Last time a file was (re)loaded
+	ConfigError   string            `json:"configError,omitempty"`   // Last error loading the client configuration
+	ProfilesError string            `json:"profilesError,omitempty"` // Last error loading the profiles
+	ListErrors    map[string]string `json:"listErrors,omitempty"`    // Last errors loading list files, keyed by "type/name"
+}
+
+// GetStatus returns the state of the files behind the filter
+func (df *DNSFilter) GetStatus() Status {
+	df.watchMutex.Lock()
+	watching := df.watcher != nil
+	df.watchMutex.Unlock()
+
+	df.mutex.RLock()
+	defer df.mutex.RUnlock()
+
+	status := Status{
+		Clients:       len(df.Clients),
+		Profiles:      len(df.Profiles),
+		Blocklists:    len(df.BlocklistTries),
+		Whitelists:    len(df.WhitelistTries),
+		IPBlocklists:  len(df.IPBlocklists),
+		Watching:      watching,
+		LastReload:    df.lastReload,
+		ConfigError:   df.configError,
+		ProfilesError: df.profilesError,
+	}
+	if len(df.listErrors) > 0 {
+		status.ListErrors = make(map[string]string, len(df.listErrors))
+		for key, err := range df.listErrors {
+			status.ListErrors[key] = err
+		}
+	}
+
+	return status
+}
+
+// Watch starts reloading the client configuration and the list files when
+// they change on disk. Lists are recompiled in the background and swapped in
+// atomically; if a file cannot be loaded, the previous content is kept and
+// the error is reported by GetStatus and GetAllLists.
+func (df *DNSFilter) Watch() error {
+	df.watchMutex.Lock()
+	defer df.watchMutex.Unlock()
+
+	if df.watcher != nil {
+		return nil // Already watching
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating file watcher: %v", err)
+	}
+
+	for _, dir := range df.watchedDirs() {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("error watching directory %s: %v", dir, err)
+		}
+	}
+
+	df.watcher = watcher
+	df.watchTimers = make(map[string]*time.Timer)
+	go df.watchLoop(watcher)
+
+	log.Printf("Watching %s, %s, %s and %s for changes",
+		df.ConfigPath, df.BlocklistDir, df.WhitelistDir, df.IPBlocklistDir)
+	return nil
+}
+
+// Close stops watching the files and refreshing subscribed lists
+func (df *DNSFilter) Close() error {
+	df.watchMutex.Lock()
+	defer df.watchMutex.Unlock()
+
+	df.stopRefresher()
+	if df.watcher == nil {
+		return nil
+	}
+
+	for _, timer := range df.watchTimers {
+		timer.Stop()
+	}
+	df.watchTimers = nil
+
+	err := df.watcher.Close()
+	df.watcher = nil
+	return err
+}
+
+// watchedDirs returns the directories holding the filter's files
+func (df *DNSFilter) watchedDirs() []string {
+	dirs := []string{}
+	for _, dir := range []string{filepath.Dir(df.ConfigPath), df.BlocklistDir, df.WhitelistDir, df.IPBlocklistDir} {
+		dirs = mergeUnique(dirs, []string{filepath.Clean(dir)})
+	}
+	return dirs
+}
+
+// watchLoop processes file system events until the watcher is closed
+func (df *DNSFilter) watchLoop(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			df.scheduleReload(filepath.Clean(event.Name))
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Warning: File watcher error: %v", err)
+		}
+	}
+}
+
+// scheduleReload reloads a file once it stopped changing for reloadDelay
+func (df *DNSFilter) scheduleReload(path string) {
+	if path != filepath.Clean(df.ConfigPath) && path != filepath.Clean(df.profilesPath()) && isIgnoredListFile(filepath.Base(path)) {
+		return
+	}
+
+	df.watchMutex.Lock()
+	defer df.watchMutex.Unlock()
+
+	if df.watchTimers == nil {
+		return // Closed
+	}
+
+	if timer, exists := df.watchTimers[path]; exists {
+		timer.Reset(reloadDelay)
+		return
+	}
+	df.watchTimers[path] = time.AfterFunc(reloadDelay, func() {
+		df.watchMutex.Lock()
+		if df.watchTimers != nil {
+			delete(df.watchTimers, path)
+		}
+		df.watchMutex.Unlock()
+
+		df.reloadPath(path)
+	})
+}
+
+// reloadPath reloads the client configuration, the profiles or the list file
+// at path
+func (df *DNSFilter) reloadPath(path string) {
+	if path == filepath.Clean(df.ConfigPath) {
+		df.reloadClientConfig()
+		return
+	}
+	if path == filepath.Clean(df.profilesPath()) {
+		df.reloadProfiles()
+		return
+	}
+
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	switch dir {
+	case filepath.Clean(df.BlocklistDir):
+		df.reloadList("blocklist", name, path)
+	case filepath.Clean(df.WhitelistDir):
+		df.reloadList("whitelist", name, path)
+	case filepath.Clean(df.IPBlocklistDir):
+		df.reloadList("ipblocklist", name, path)
+	}
+}
+
+// reloadClientConfig reloads the client configuration, keeping the current one
+// if the file cannot be parsed
+func (df *DNSFilter) reloadClientConfig() {
+	clients, err := LoadClientConfig(df.ConfigPath)
+
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error reloading client configuration, keeping previous one: %v", err)
+		df.configError = err.Error()
+		return
+	}
+
+	df.Clients = clients
+	df.buildClientIndex()
+	df.configError = ""
+	df.lastReload = time.Now()
+	log.Printf("Client configuration reloaded with %d clients", len(clients))
+}
+
+// reloadList recompiles a list file and swaps it in. A removed file unloads
+// the list; a file that cannot be loaded keeps the previous content.
+func (df *DNSFilter) reloadList(listType, listName, path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		df.unloadList(listType, listName)
+		return
+	}
+
+	// Compile outside the lock so lookups continue meanwhile
+	var trie *Node
+	var stats ParseStats
+	var ipList *IPList
+	var err error
+	if listType == "ipblocklist" {
+		ipList, err = LoadIPList(path)
+	} else {
+		trie, stats, err = LoadDomainList(path)
+	}
+
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error reloading %s %s, keeping previous content: %v", listType, listName, err)
+		df.listErrors[listKey(listType, listName)] = err.Error()
+		return
+	}
+
+	switch listType {
+	case "blocklist":
+		df.BlocklistTries[listName] = trie
+		df.listStats[listKey(listType, listName)] = stats
+	case "whitelist":
+		df.WhitelistTries[listName] = trie
+		df.listStats[listKey(listType, listName)] = stats
+	case "ipblocklist":
+		df.IPBlocklists[listName] = ipList
+	}
+	delete(df.listErrors, listKey(listType, listName))
+	df.lastReload = time.Now()
+	log.Printf("Reloaded %s: %s", listType, listName)
+}
+
+// unloadList removes a list whose file was deleted. Client references are
+// kept, so the list is picked up again if the file comes back.
+func (df *DNSFilter) unloadList(listType, listName string) {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	switch listType {
+	case "blocklist":
+		delete(df.BlocklistTries, listName)
+	case "whitelist":
+		delete(df.WhitelistTries, listName)
+	case "ipblocklist":
+		delete(df.IPBlocklists, listName)
+	}
+	delete(df.listErrors, listKey(listType, listName))
+	delete(df.listStats, listKey(listType, listName))
+	df.lastReload = time.Now()
+	log.Printf("Unloaded %s %s, its file was removed", listType, listName)
+}
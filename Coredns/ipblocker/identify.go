@@ -0,0 +1,135 @@
+package ipblocker
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Sources a client can be identified from
+const (
+	sourceIP  = "ip"  // Source address of the query
+	sourceECS = "ecs" // EDNS Client Subnet set by a trusted forwarder
+	sourceDoH = "doh" // Client ID in the DoH path
+	sourceDoT = "dot" // Client ID prefix of the DoT server name
+)
+
+// dohPath is the path DoH queries are sent to, a client ID may follow it
+const dohPath = "/dns-query"
+
+// Identification selects how clients are identified beyond the source address
+// of their queries
+type Identification struct {
+	ECS            bool           // Use the ECS address of queries from trusted proxies
+	DoH            bool           // Use the client ID in the DoH path, /dns-query/{clientID}
+	DoTServerName  string         // Use the client ID prefix of this DoT server name, {clientID}.dns.example.com
+	TrustedProxies []netip.Prefix // Forwarders whose ECS option is trusted
+}
+
+// identifyClient returns the key a query's client is looked up with and the
+// source it came from. A client ID from DoH or DoT comes first, then the ECS
+// address of a trusted forwarder, then the source address.
+func (id *Identification) identifyClient(ctx context.Context, state request.Request) (string, string) {
+	ip := state.IP()
+	if id == nil {
+		return ip, sourceIP
+	}
+
+	if id.DoH {
+		if r, ok := ctx.Value(dnsserver.HTTPRequestKey{}).(*http.Request); ok {
+			if clientID, ok := dohClientID(r); ok {
+				return clientID, sourceDoH
+			}
+		}
+	}
+
+	if id.DoTServerName != "" {
+		if cs, ok := state.W.(dns.ConnectionStater); ok {
+			if tlsState := cs.ConnectionState(); tlsState != nil {
+				if clientID, ok := sniClientID(tlsState.ServerName, id.DoTServerName); ok {
+					return clientID, sourceDoT
+				}
+			}
+		}
+	}
+
+	if id.ECS && id.trusted(ip) {
+		if addr, ok := ecsAddress(state.Req); ok {
+			return addr, sourceECS
+		}
+	}
+
+	return ip, sourceIP
+}
+
+// trusted checks if a query comes from a trusted forwarder
+func (id *Identification) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range id.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dohClientID returns the client ID of a DoH request to /dns-query/{clientID}
+func dohClientID(r *http.Request) (string, bool) {
+	clientID, found := strings.CutPrefix(r.URL.Path, dohPath+"/")
+	if !found || !dnslookup.IsClientID(clientID) {
+		return "", false
+	}
+	return clientID, true
+}
+
+// validDoHPath accepts DoH requests to /dns-query with or without a client ID
+func validDoHPath(r *http.Request) bool {
+	if r.URL.Path == dohPath {
+		return true
+	}
+	_, ok := dohClientID(r)
+	return ok
+}
+
+// sniClientID returns the client ID of a DoT connection to
+// {clientID}.{serverName}
+func sniClientID(sni, serverName string) (string, bool) {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	clientID, found := strings.CutSuffix(sni, "."+serverName)
+	if !found || !dnslookup.IsClientID(clientID) {
+		return "", false
+	}
+	return clientID, true
+}
+
+// ecsAddress returns the address of the EDNS Client Subnet option of a query
+func ecsAddress(r *dns.Msg) (string, bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return "", false
+	}
+
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(subnet.Address)
+		if !ok || addr.IsUnspecified() {
+			return "", false
+		}
+		return addr.Unmap().String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,133 @@
+package ipblocker
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// tlsWriter is a response writer of a DoT connection to a server name
+type tlsWriter struct {
+	*test.ResponseWriter
+	serverName string
+}
+
+func (w *tlsWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{ServerName: w.serverName}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	id := &Identification{
+		ECS:            true,
+		DoH:            true,
+		DoTServerName:  "dns.example.com",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("fd00::/64")},
+	}
+
+	tests := []struct {
+		id     *Identification
+		remote string
+		ecs    string // Address of the ECS option, if any
+		path   string // Path of the DoH request, if any
+		sni    string // Server name of the DoT connection, if any
+		key    string
+		source string
+	}{
+		{nil, "10.1.1.1", "192.168.1.5", "/dns-query/kids-tablet", "laptop.dns.example.com", "10.1.1.1", sourceIP},
+		{id, "10.1.1.1", "", "", "", "10.1.1.1", sourceIP},
+		{id, "10.1.1.1", "192.168.1.5", "", "", "192.168.1.5", sourceECS},
+		{id, "fd00::53", "2001:db8::5", "", "", "2001:db8::5", sourceECS},
+		{id, "172.16.0.1", "192.168.1.5", "", "", "172.16.0.1", sourceIP}, // Untrusted forwarder
+		{id, "10.1.1.1", "0.0.0.0", "", "", "10.1.1.1", sourceIP},
+		{id, "10.1.1.1", "::", "", "", "10.1.1.1", sourceIP},
+		{id, "10.1.1.1", "192.168.1.5", "/dns-query/kids-tablet", "laptop.dns.example.com", "kids-tablet", sourceDoH},
+		{id, "10.1.1.1", "192.168.1.5", "/dns-query/Kids_Tablet", "laptop.dns.example.com", "laptop", sourceDoT},
+		{id, "10.1.1.1", "192.168.1.5", "/dns-query", "Laptop.DNS.Example.COM.", "laptop", sourceDoT},
+		{id, "10.1.1.1", "192.168.1.5", "", "dns.example.com", "192.168.1.5", sourceECS},
+		{id, "10.1.1.1", "", "", "laptop.dns.example.net", "10.1.1.1", sourceIP},
+		{id, "10.1.1.1", "", "", "10-1-1-1.dns.example.com", "10-1-1-1", sourceDoT},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if tc.ecs != "" {
+			m.SetEdns0(4096, false)
+			subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(tc.ecs).To4()}
+			if subnet.Address == nil {
+				subnet.Family, subnet.SourceNetmask, subnet.Address = 2, 56, net.ParseIP(tc.ecs)
+			}
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
+		}
+
+		ctx := context.Background()
+		if tc.path != "" {
+			ctx = context.WithValue(ctx, dnsserver.HTTPRequestKey{}, httptest.NewRequest(http.MethodPost, tc.path, nil))
+		}
+		var w dns.ResponseWriter = &test.ResponseWriter{RemoteIP: tc.remote}
+		if tc.sni != "" {
+			w = &tlsWriter{ResponseWriter: &test.ResponseWriter{RemoteIP: tc.remote}, serverName: tc.sni}
+		}
+
+		key, source := tc.id.identifyClient(ctx, request.Request{W: w, Req: m})
+		if key != tc.key || source != tc.source {
+			t.Errorf("Test %d: expected %s from %s, got %s from %s", i, tc.key, tc.source, key, source)
+		}
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	id := &Identification{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("fd00::/64")},
+	}
+
+	tests := []struct {
+		ip      string
+		trusted bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"10.2.0.1", false},
+		{"fd00::1", true},
+		{"fd00:0:0:1::1", false},
+		{"not an address", false},
+	}
+
+	for i, tc := range tests {
+		if trusted := id.trusted(tc.ip); trusted != tc.trusted {
+			t.Errorf("Test %d: expected %s trusted %v, got %v", i, tc.ip, tc.trusted, trusted)
+		}
+	}
+}
+
+func TestValidDoHPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"/dns-query", true},
+		{"/dns-query/kids-tablet", true},
+		{"/dns-query/", false},
+		{"/dns-query/Kids-Tablet", false},
+		{"/dns-query/10.0.0.1", false},
+		{"/dns-query/kids-tablet/extra", false},
+		{"/dns-query-kids-tablet", false},
+		{"/other", false},
+	}
+
+	for i, tc := range tests {
+		if valid := validDoHPath(httptest.NewRequest(http.MethodGet, tc.path, nil)); valid != tc.valid {
+			t.Errorf("Test %d: expected %s valid %v, got %v", i, tc.path, tc.valid, valid)
+		}
+	}
+}
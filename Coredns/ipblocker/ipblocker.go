@@ -4,147 +4,176 @@ package ipblocker
 import (
 	"context"
 	"log"
-	"path/filepath"
-	"sync"
+	"time"
 
-	"github.com/coredns/caddy"
-	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/coredns/coredns/plugin/ipblocker/querylog"
 	"github.com/coredns/coredns/plugin/ipblocker/restapi"
+	"github.com/coredns/coredns/plugin/ipblocker/stats"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
-// Default configuration paths and API port
-const (
-	defaultConfigPath   = "/clients.json"
-	defaultBlocklistDir = "/blocklists"
-	defaultWhitelistDir = "/whitelists"
-	defaultAPIPort      = 8099
-)
-
 // IPBlocker is the plugin that processes DNS requests
 type IPBlocker struct {
-	Next      plugin.Handler
-	APIPort   int
-	APIServer *restapi.APIServer
-	DNSFilter *dnslookup.DNSFilter
+	Next           plugin.Handler
+	FilterName     string // Name of the shared filter, used as metrics label
+	APIServer      *restapi.APIServer
+	DNSFilter      *dnslookup.DNSFilter
+	BlockResponse  *BlockResponse
+	Identification *Identification
+	QueryLog       *querylog.Log    // Log of the handled queries, nil if disabled
+	Stream         *querylog.Stream // Live stream of the handled queries
+	Stats          *stats.Store     // Rolling statistics of the handled queries, nil if disabled
 }
 
-// Global variables for one-time initialization
-var (
-	setupOnce sync.Once
-	instance  *IPBlocker
-)
+// Name implements the Plugin interface
+func (ib *IPBlocker) Name() string { return "ipblocker" }
 
-// init registers the plugin with CoreDNS
-func init() {
-	plugin.Register("ipblocker", setup)
-}
+// ServeDNS implements the Plugin interface and is called for each DNS request
+func (ib *IPBlocker) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	// Get information about the request
+	state := request.Request{W: w, Req: r}
 
-// setup is the function called by CoreDNS when loading the plugin
-func setup(c *caddy.Controller) error {
-	// One-time global initialization with sync.Once
-	setupOnce.Do(func() {
-		log.Println("IPBlocker Plugin was initialized ONCE globally")
+	// Get the client, identified by IP address unless configured otherwise, and
+	// the domain
+	ip, source := ib.Identification.identifyClient(ctx, state)
+	domain := state.Name()
 
-		// Initialize global resources like databases, caches, etc.
-		instance = &IPBlocker{
-			APIPort: defaultAPIPort,
-		}
+	// Log client and domain, with the source of the identification
+	if source == sourceIP {
+		log.Printf("%s: %s", ip, domain)
+	} else {
+		log.Printf("%s (%s from %s): %s", ip, source, state.IP(), domain)
+	}
 
-		// Initialize DNS filter
-		configPath := defaultConfigPath
-		blocklistDir := defaultBlocklistDir
-		whitelistDir := defaultWhitelistDir
-
-		// Ensure directories exist
-		for _, dir := range []string{
-			filepath.Dir(configPath),
-			blocklistDir,
-			whitelistDir,
-		} {
-			if err := ensureDirExists(dir); err != nil {
-				log.Printf("Warning: Failed to create directory %s: %v", dir, err)
-			}
-		}
+	server := metrics.WithServer(ctx)
+	queryCount.WithLabelValues(server, ib.FilterName).Inc()
 
-		// Create DNS filter
-		instance.DNSFilter = dnslookup.NewDNSFilter(configPath, blocklistDir, whitelistDir)
-		if err := instance.DNSFilter.Initialize(); err != nil {
-			log.Printf("Error initializing DNS filter: %v", err)
+	// Check if domain is allowed for this client
+	verdict := dnslookup.Verdict{ClientIP: ip, Domain: domain, Allowed: true}
+	if ib.DNSFilter != nil {
+		start := time.Now()
+		verdict = ib.DNSFilter.Evaluate(ip, domain)
+		checkDuration.WithLabelValues(server, ib.FilterName).Observe(time.Since(start).Seconds())
+		if verdict.UnknownClient {
+			ib.DNSFilter.RecordUnknownClient(ip)
 		}
+	}
 
-		// Initialize REST API
-		instance.APIServer = restapi.NewAPIServer(instance.DNSFilter)
-		if err := instance.APIServer.Initialize(configPath, blocklistDir, whitelistDir, instance.APIPort); err != nil {
-			log.Printf("Error initializing API server: %v", err)
+	// Count the verdict that decided the query and record the query in the
+	// statistics, query log and live stream once it is answered. If nothing is
+	// written, the server answers with the returned rcode.
+	decided := &verdict
+	var latency time.Duration
+	serverRcode := dns.RcodeServerFailure
+	rec := dnstest.NewRecorder(w)
+	w = rec
+	defer func() {
+		countVerdict(server, ib.FilterName, decided)
+		if ib.Stats != nil {
+			ib.Stats.Record(rec.Start, decided.ClientIP, domain, !decided.Allowed)
 		}
-	})
-
-	// Parse plugin options if any
-	for c.Next() {
-		// This function is executed for each server block
-		if c.NextArg() {
-			return plugin.Error("ipblocker", c.ArgErr())
+		if ib.QueryLog == nil && !ib.Stream.Active() {
+			return
+		}
+		if rec.Msg == nil {
+			rec.Rcode = serverRcode
 		}
+		entry := newQueryLogEntry(state, source, decided, rec, latency)
+		if ib.QueryLog != nil {
+			ib.QueryLog.Record(entry)
+		}
+		ib.Stream.Publish(entry)
+	}()
+
+	if !verdict.Allowed {
+		// Domain is blocked, answer according to the client's block response
+		log.Printf("Blocking access to %s for client %s (%s)", domain, ip, source)
+		return ib.writeBlocked(w, r, verdict.BlockResponse, blockReason(&verdict))
 	}
 
-	// Add the plugin to CoreDNS
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		// We use the global instance and only set the Next handler
-		instance.Next = next
-		return instance
-	})
+	// Domain is allowed, pass the request to the next plugin and hold back its
+	// answer until the answer has been checked as well
+	nw := nonwriter.New(w)
+	start := time.Now()
+	rcode, err := plugin.NextOrFailure(ib.Name(), ib.Next, ctx, nw, r)
+	latency = time.Since(start)
+	if nw.Msg == nil {
+		// Nothing was written, leave the error response to the server
+		serverRcode = rcode
+		return rcode, err
+	}
 
-	return nil
-}
+	// Answers to queries allowed by an override, e.g. while filtering is
+	// paused, are not checked either
+	if ib.DNSFilter != nil && verdict.Override == "" {
+		if answerVerdict := ib.checkAnswer(ip, domain, nw.Msg); !answerVerdict.Allowed {
+			decided = &answerVerdict
+			if answerVerdict.CNAME != "" {
+				log.Printf("Blocking answer for %s to client %s: CNAME %s matched %s (%s)",
+					domain, ip, answerVerdict.CNAME, answerVerdict.ListName, answerVerdict.Rule)
+			} else {
+				log.Printf("Blocking answer for %s to client %s: address %s matched %s (%s)",
+					domain, ip, answerVerdict.AnswerIP, answerVerdict.ListName, answerVerdict.Rule)
+			}
+			return ib.writeBlocked(w, r, answerVerdict.BlockResponse, blockReason(&answerVerdict))
+		}
+	}
 
-// ensureDirExists creates a directory if it doesn't exist
-func ensureDirExists(dir string) error {
-	// This would use os.MkdirAll in real implementation
-	// For simplicity, we'll just log the action
-	log.Printf("Ensuring directory exists: %s", dir)
-	return nil
+	w.WriteMsg(nw.Msg)
+	return rcode, err
 }
 
-// Name implements the Plugin interface
-func (ib *IPBlocker) Name() string { return "ipblocker" }
-
-// ServeDNS implements the Plugin interface and is called for each DNS request
-func (ib *IPBlocker) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	// Create a recorder to capture the response
-	rec := dnstest.NewRecorder(w)
-
-	// Get information about the request
-	state := request.Request{W: w, Req: r}
-
-	// Get IP address and domain
-	ip := state.IP()
-	domain := state.Name()
-
-	// Log IP and domain
-	log.Printf("%s: %s", ip, domain)
-
-	// Check if domain is allowed for this client
-	allowed := true
-	if ib.DNSFilter != nil {
-		allowed = ib.DNSFilter.CheckDomain(ip, domain)
+// writeBlocked writes the answer for a blocked query, attaching the Extended
+// DNS Error if the client supports EDNS0
+func (ib *IPBlocker) writeBlocked(w dns.ResponseWriter, r *dns.Msg, mode string, ede *dns.EDNS0_EDE) (int, error) {
+	br := ib.BlockResponse
+	if br == nil {
+		br = NewBlockResponse()
 	}
 
-	if !allowed {
-		// Domain is blocked, return NXDOMAIN
-		log.Printf("Blocking access to %s for client %s", domain, ip)
+	resp := br.Build(r, mode)
+	if opt := r.IsEdns0(); opt != nil && ede != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+		respOpt := resp.IsEdns0()
+		respOpt.Option = append(respOpt.Option, ede)
+	}
+	w.WriteMsg(resp)
 
-		// Create NXDOMAIN response
-		resp := new(dns.Msg)
-		resp.SetRcode(r, dns.RcodeNameError) // NXDOMAIN
-		w.WriteMsg(resp)
-		return dns.RcodeNameError, nil
+	// The response is already written, so REFUSED must not be reported back to
+	// the server, which would otherwise write its own error response
+	if resp.Rcode == dns.RcodeRefused {
+		return dns.RcodeSuccess, nil
 	}
+	return resp.Rcode, nil
+}
 
-	// Domain is allowed, pass the request to the next plugin
-	return plugin.NextOrFailure(ib.Name(), ib.Next, ctx, rec, r)
+// newQueryLogEntry returns the query log entry of an answered query
+func newQueryLogEntry(state request.Request, source string, verdict *dnslookup.Verdict, rec *dnstest.Recorder, latency time.Duration) querylog.Entry {
+	entry := querylog.Entry{
+		Time:      rec.Start,
+		Client:    verdict.ClientIP,
+		ClientIP:  state.IP(),
+		QName:     state.Name(),
+		QType:     state.Type(),
+		Verdict:   querylog.VerdictAllowed,
+		ListType:  verdict.ListType,
+		ListName:  verdict.ListName,
+		Rule:      verdict.Rule,
+		Override:  verdict.OverrideID,
+		Rcode:     dns.RcodeToString[rec.Rcode],
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+	}
+	if source != sourceIP {
+		entry.Source = source
+	}
+	if !verdict.Allowed {
+		entry.Verdict = querylog.VerdictBlocked
+	}
+	return entry
 }
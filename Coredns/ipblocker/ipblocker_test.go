@@ -0,0 +1,190 @@
+package ipblocker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/ipblocker/querylog"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// testClients configures the address test.ResponseWriter sends from
+const testClients = `{
+  "10.240.0.1": {"blocklists": ["ads"], "whitelists": [], "mode": "blocklist"}
+}`
+
+// testConfig returns the settings of a filter named after the test, with its
+// files in a temporary directory and a blocklist "ads" blocking
+// ads.example.com
+func testConfig(t *testing.T) *config {
+	t.Helper()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "etc", "clients.json"), testClients)
+	writeTestFile(t, filepath.Join(dir, "blocklists", "ads"), "ads.example.com\n")
+
+	return &config{
+		filterConfig: filterConfig{
+			FilterName:       t.Name(),
+			ConfigPath:       filepath.Join(dir, "etc", "clients.json"),
+			BlocklistDir:     filepath.Join(dir, "blocklists"),
+			WhitelistDir:     filepath.Join(dir, "whitelists"),
+			IPBlockDir:       filepath.Join(dir, "ipblocklists"),
+			QueryLogPath:     filepath.Join(dir, "log", "queries.jsonl"),
+			QueryLogMaxSize:  querylog.DefaultMaxSize,
+			QueryLogMaxFiles: querylog.DefaultMaxFiles,
+		},
+		BlockResponse:  NewBlockResponse(),
+		Identification: &Identification{},
+	}
+}
+
+// newTestFilter acquires a filter with the settings of testConfig, released
+// when the test ends
+func newTestFilter(t *testing.T) (*config, *sharedFilter) {
+	t.Helper()
+
+	cfg := testConfig(t)
+	shared, err := acquireFilter(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error acquiring the filter, got %v", err)
+	}
+	t.Cleanup(func() {
+		if err := releaseFilter(shared); err != nil {
+			t.Errorf("Expected no error releasing the filter, got %v", err)
+		}
+	})
+	return cfg, shared
+}
+
+// writeTestFile writes a file, creating its directory
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upstream answers every query with an empty NOERROR response
+var upstream = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+})
+
+// serve sends a query for name through the handler
+func serve(t *testing.T, ib *IPBlocker, name string) {
+	t.Helper()
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	if _, err := ib.ServeDNS(context.Background(), &test.ResponseWriter{}, m); err != nil {
+		t.Fatalf("Expected no error serving %s, got %v", name, err)
+	}
+}
+
+func TestServeDNSQueryLog(t *testing.T) {
+	cfg, shared := newTestFilter(t)
+	ib := shared.handler(upstream, cfg)
+
+	serve(t, ib, "ads.example.com.")
+	serve(t, ib, "www.example.org.")
+
+	// Entries are written in the background
+	var page *querylog.Page
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var err error
+		page, err = shared.queryLog.Query(querylog.Filter{})
+		if err != nil {
+			t.Fatalf("Expected no error querying the log, got %v", err)
+		}
+		if len(page.Entries) >= 2 {
+			break
+		}
+	}
+	if len(page.Entries) != 2 {
+		t.Fatalf("Expected 2 logged queries, got %d", len(page.Entries))
+	}
+
+	tests := []struct {
+		qname    string
+		verdict  string
+		listName string
+		rcode    string
+	}{
+		{"www.example.org.", querylog.VerdictAllowed, "", "NOERROR"},
+		{"ads.example.com.", querylog.VerdictBlocked, "ads", "NXDOMAIN"},
+	}
+	for i, tc := range tests {
+		entry := page.Entries[i]
+		if entry.QName != tc.qname || entry.Verdict != tc.verdict || entry.ListName != tc.listName || entry.Rcode != tc.rcode {
+			t.Errorf("Test %d: expected %s %s by %q with %s, got %s %s by %q with %s", i,
+				tc.qname, tc.verdict, tc.listName, tc.rcode, entry.QName, entry.Verdict, entry.ListName, entry.Rcode)
+		}
+		if entry.ClientIP != "10.240.0.1" {
+			t.Errorf("Test %d: expected client 10.240.0.1, got %s", i, entry.ClientIP)
+		}
+	}
+}
+
+func TestServeDNSStats(t *testing.T) {
+	cfg, shared := newTestFilter(t)
+	ib := shared.handler(upstream, cfg)
+
+	serve(t, ib, "ads.example.com.")
+	serve(t, ib, "www.example.org.")
+	serve(t, ib, "www.example.org.")
+
+	summary := shared.stats.Summarize(time.Now(), time.Hour, 10)
+	if summary.Queries != 3 || summary.Blocked != 1 {
+		t.Fatalf("Expected 3 queries with 1 blocked, got %d with %d blocked", summary.Queries, summary.Blocked)
+	}
+	if len(summary.TopBlockedDomains) != 1 || summary.TopBlockedDomains[0].Name != "ads.example.com" {
+		t.Errorf("Expected ads.example.com as top blocked domain, got %v", summary.TopBlockedDomains)
+	}
+	if len(summary.TopClients) != 1 || summary.TopClients[0].Count != 3 {
+		t.Errorf("Expected one client with 3 queries, got %v", summary.TopClients)
+	}
+}
+
+func TestServeDNSStream(t *testing.T) {
+	cfg, shared := newTestFilter(t)
+	ib := shared.handler(upstream, cfg)
+
+	sub := shared.stream.Subscribe(querylog.Filter{Verdict: querylog.VerdictBlocked})
+	defer shared.stream.Unsubscribe(sub)
+
+	serve(t, ib, "www.example.org.")
+	serve(t, ib, "ads.example.com.")
+
+	select {
+	case entry := <-sub.Entries():
+		if entry.QName != "ads.example.com." || entry.ListName != "ads" {
+			t.Errorf("Expected ads.example.com. blocked by ads, got %s blocked by %q", entry.QName, entry.ListName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a blocked query on the stream, got none")
+	}
+
+	select {
+	case entry := <-sub.Entries():
+		t.Errorf("Expected only the blocked query, got %s", entry.QName)
+	default:
+	}
+
+	// The same queries reach the statistics
+	if summary := shared.stats.Summarize(time.Now(), time.Hour, 10); summary.Queries != 2 {
+		t.Errorf("Expected 2 queries in the statistics, got %d", summary.Queries)
+	}
+}
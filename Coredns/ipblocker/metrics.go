@@ -0,0 +1,103 @@
+package ipblocker
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Variables declared for monitoring, exported on the endpoint of the metrics
+// plugin
+var (
+	queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ipblocker",
+		Name:      "queries_total",
+		Help:      "Counter of queries checked by the ipblocker plugin.",
+	}, []string{"server", "filter"})
+
+	blockedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ipblocker",
+		Name:      "blocked_total",
+		Help:      "Counter of blocked queries by the list that blocked them.",
+	}, []string{"server", "filter", "list_type", "list"})
+
+	whitelistedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ipblocker",
+		Name:      "whitelisted_total",
+		Help:      "Counter of queries allowed by a whitelist.",
+	}, []string{"server", "filter", "list"})
+
+	unknownClientCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ipblocker",
+		Name:      "unknown_client_queries_total",
+		Help:      "Counter of queries from clients without a configuration by the policy applied.",
+	}, []string{"server", "filter", "policy"})
+
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "ipblocker",
+		Name:      "check_duration_seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10), // 1µs to 262ms
+		Help:      "Histogram of the time it took to check a query against the lists.",
+	}, []string{"server", "filter"})
+)
+
+// countVerdict updates the counters for the verdict that decided a query
+func countVerdict(server, filter string, verdict *dnslookup.Verdict) {
+	if verdict.UnknownClient {
+		unknownClientCount.WithLabelValues(server, filter, verdict.Policy).Inc()
+	}
+
+	if !verdict.Allowed {
+		listType, list := verdict.ListType, verdict.ListName
+		if verdict.Override != "" {
+			listType, list = "override", ""
+		} else if verdict.UnknownClient && verdict.Policy == dnslookup.UnknownClientDeny {
+			listType, list = "unknown_client", ""
+		}
+		blockedCount.WithLabelValues(server, filter, listType, list).Inc()
+		return
+	}
+
+	if verdict.ListType == "whitelist" && verdict.ListName != "" {
+		whitelistedCount.WithLabelValues(server, filter, verdict.ListName).Inc()
+	}
+}
+
+// listCollector exports the number of entries of each list of a filter when
+// the metrics are scraped
+type listCollector struct {
+	filter *dnslookup.DNSFilter
+	desc   *prometheus.Desc
+}
+
+// newListCollector returns the list size collector of a filter, which must be
+// registered once per filter
+func newListCollector(name string, filter *dnslookup.DNSFilter) *listCollector {
+	return &listCollector{
+		filter: filter,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(plugin.Namespace, "ipblocker", "list_entries"),
+			"Number of domains, addresses or networks in each list.",
+			[]string{"list_type", "list"},
+			prometheus.Labels{"filter": name},
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (lc *listCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lc.desc
+}
+
+// Collect implements prometheus.Collector
+func (lc *listCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, list := range lc.filter.GetAllLists() {
+		ch <- prometheus.MustNewConstMetric(lc.desc, prometheus.GaugeValue, float64(list.Count), list.Type, list.Name)
+	}
+}
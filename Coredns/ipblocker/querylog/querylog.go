@@ -0,0 +1,470 @@
+// Package querylog writes the DNS queries handled by the ipblocker plugin to a
+// rotating JSONL file and searches them
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default limits of a query log
+const (
+	DefaultMaxSize  = 100 << 20 // 100 MiB per file
+	DefaultMaxFiles = 5         // Current file and rotated ones
+
+	queueSize     = 4096        // Entries waiting to be written, more are dropped
+	flushInterval = time.Second // Entries are written at least this often
+	tailSize      = 64 << 10    // Bytes read from the end of a file to find the last entry
+	maxLineLength = 64 << 10    // Longest entry read back
+	readSize      = 64 << 10    // Bytes read at once when searching a file backwards
+	defaultLimit  = 100
+	maxLimit      = 1000
+)
+
+// Verdicts of a query
+const (
+	VerdictAllowed = "allowed"
+	VerdictBlocked = "blocked"
+)
+
+// Entry is a DNS query and how it was handled
+type Entry struct {
+	ID        uint64    `json:"id,omitempty"` // Increasing number of the entry, used as cursor, not set in streams
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`              // Key the client was filtered with, an address or client ID
+	ClientIP  string    `json:"clientIP"`            // Source address of the query
+	Source    string    `json:"source,omitempty"`    // How the client was identified: "ecs", "doh" or "dot", empty for the address
+	QName     string    `json:"qname"`               // Queried name
+	QType     string    `json:"qtype"`               // Query type, e.g. "A"
+	Verdict   string    `json:"verdict"`             // "allowed" or "blocked"
+	ListType  string    `json:"listType,omitempty"`  // Type of the list that decided
+	ListName  string    `json:"listName,omitempty"`  // List that decided
+	Rule      string    `json:"rule,omitempty"`      // Matched rule of the list
+	Override  string    `json:"override,omitempty"`  // ID of the override that decided
+	Rcode     string    `json:"rcode"`               // Response code sent to the client
+	LatencyMs float64   `json:"latencyMs,omitempty"` // Time the upstream took to answer, in milliseconds
+}
+
+// Filter selects entries of a query log
+type Filter struct {
+	Client  string    // Client key or source address
+	Domain  string    // Name, matching its subdomains as well
+	Verdict string    // "allowed" or "blocked"
+	From    time.Time // Earliest time, inclusive
+	To      time.Time // Latest time, exclusive
+	Before  uint64    // Cursor, only entries with a lower ID
+	Limit   int       // Entries per page, 100 by default
+}
+
+// Page is a page of entries, newest first
+type Page struct {
+	Entries    []Entry `json:"entries"`
+	NextCursor string  `json:"nextCursor,omitempty"` // Cursor of the next page, empty on the last one
+}
+
+// Log is a query log written to a JSONL file, which is rotated once it
+// reaches the size limit
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	entries chan Entry
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	// closed is set by Close, after which entries are no longer queued
+	closeMutex sync.RWMutex
+	closed     bool
+
+	// Write state, protected by mutex
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	nextID uint64
+}
+
+// Open opens the query log at path, continuing an existing file, and starts
+// writing entries in the background
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	l := &Log{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		entries:  make(chan Entry, queueSize),
+		done:     make(chan struct{}),
+	}
+
+	// Continue numbering after the newest entry on disk
+	for _, name := range l.fileNames() {
+		if id, ok := lastID(name); ok {
+			l.nextID = id + 1
+			break
+		}
+	}
+	if l.nextID == 0 {
+		l.nextID = 1
+	}
+
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+
+	go l.writeLoop()
+	return l, nil
+}
+
+// Record queues an entry for writing. It never blocks: if the writer cannot
+// keep up, the entry is dropped. Entries recorded after Close are ignored.
+func (l *Log) Record(entry Entry) {
+	l.closeMutex.RLock()
+	defer l.closeMutex.RUnlock()
+
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		if l.dropped.Add(1)%1000 == 1 {
+			log.Printf("Warning: Query log cannot keep up, %d entries dropped", l.dropped.Load())
+		}
+	}
+}
+
+// Close writes the queued entries and closes the file
+func (l *Log) Close() error {
+	l.closeMutex.Lock()
+	if l.closed {
+		l.closeMutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.entries)
+	l.closeMutex.Unlock()
+
+	<-l.done
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("error writing query log: %v", err)
+	}
+	return l.file.Close()
+}
+
+// writeLoop writes queued entries until the log is closed
+func (l *Log) writeLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-l.entries:
+			if !ok {
+				return
+			}
+			if err := l.write(entry); err != nil {
+				log.Printf("Warning: Could not write query log: %v", err)
+			}
+		case <-ticker.C:
+			l.mutex.Lock()
+			if err := l.writer.Flush(); err != nil {
+				log.Printf("Warning: Could not write query log: %v", err)
+			}
+			l.mutex.Unlock()
+		}
+	}
+}
+
+// write numbers an entry and appends it to the file, rotating it first if it
+// would grow beyond the size limit
+func (l *Log) write(entry Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry.ID = l.nextID
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.writer.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.nextID++
+	return nil
+}
+
+// openFile opens the current file for appending, the caller must hold the
+// lock or be the only user
+func (l *Log) openFile() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening query log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening query log: %v", err)
+	}
+
+	l.file = file
+	l.writer = bufio.NewWriter(file)
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to path.1, path.1 to path.2 and so on,
+// dropping the oldest, and starts a new file. The caller must hold the lock.
+func (l *Log) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	names := l.fileNames()
+	if err := os.Remove(names[len(names)-1]); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not remove old query log: %v", err)
+	}
+	for i := len(names) - 1; i > 0; i-- {
+		if err := os.Rename(names[i-1], names[i]); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Could not rotate query log: %v", err)
+		}
+	}
+
+	return l.openFile()
+}
+
+// fileNames returns the names of the current and the rotated files, newest
+// first
+func (l *Log) fileNames() []string {
+	names := []string{l.path}
+	for i := 1; i < l.maxFiles; i++ {
+		names = append(names, l.path+"."+strconv.Itoa(i))
+	}
+	return names
+}
+
+// lastID returns the ID of the last entry of a file
+func lastID(name string) (uint64, bool) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false
+	}
+	offset := info.Size() - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return 0, false
+	}
+
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		var entry Entry
+		if json.Unmarshal(lines[i], &entry) == nil && entry.ID > 0 {
+			return entry.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Query returns a page of the entries matching a filter, newest first. Pass
+// the NextCursor of a page as Filter.Before to get the next one.
+func (l *Log) Query(filter Filter) (*Page, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultLimit
+	}
+	if filter.Limit > maxLimit {
+		filter.Limit = maxLimit
+	}
+	filter.Domain = strings.ToLower(strings.TrimSuffix(filter.Domain, "."))
+
+	// Open the files while holding the lock, so a rotation cannot move them
+	// in between. Open files stay readable when they are renamed, and only
+	// the entries written so far are read.
+	l.mutex.Lock()
+	if err := l.writer.Flush(); err != nil {
+		log.Printf("Warning: Could not write query log: %v", err)
+	}
+	files := []*os.File{}
+	sizes := []int64{}
+	for _, name := range l.fileNames() {
+		file, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+		files = append(files, file)
+		sizes = append(sizes, info.Size())
+	}
+	l.mutex.Unlock()
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	page := &Page{Entries: []Entry{}}
+	for i, file := range files {
+		matches, past, err := filter.scan(file, sizes[i], filter.Limit-len(page.Entries))
+		if err != nil {
+			return nil, fmt.Errorf("error reading query log: %v", err)
+		}
+		page.Entries = append(page.Entries, matches...)
+		if len(page.Entries) >= filter.Limit || past {
+			break // Older files only hold entries before From
+		}
+	}
+
+	if len(page.Entries) == filter.Limit {
+		page.NextCursor = strconv.FormatUint(page.Entries[len(page.Entries)-1].ID, 10)
+	}
+	return page, nil
+}
+
+// scan returns the newest entries of the first size bytes of a file matching
+// the filter, at most limit, newest first. The file is read backwards, so
+// only the entries newer than the last match are read, and reading stops at
+// the first entry before From; past reports whether it was reached.
+func (f *Filter) scan(r io.ReaderAt, size int64, limit int) (entries []Entry, past bool, err error) {
+	entries = []Entry{}
+	err = readLinesBackwards(r, size, func(line []byte) bool {
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return true // Partly written or foreign line
+		}
+		if !f.From.IsZero() && entry.Time.Before(f.From) {
+			past = true
+			return false // Older entries are before From as well
+		}
+		if f.match(&entry) {
+			entries = append(entries, entry)
+		}
+		return len(entries) < limit
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, past, nil
+}
+
+// readLinesBackwards calls fn with the lines of the first size bytes of a
+// file, last line first, until fn returns false. Empty lines and lines longer
+// than maxLineLength are skipped. The line passed to fn is only valid during
+// the call.
+func readLinesBackwards(r io.ReaderAt, size int64, fn func(line []byte) bool) error {
+	var (
+		chunk = make([]byte, readSize)
+		rest  []byte // Start of the line following the last chunk read
+		long  bool   // The line rest belongs to is too long and skipped
+	)
+	for offset := size; offset > 0; {
+		n := int64(len(chunk))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err := r.ReadAt(chunk[:n], offset); err != nil && err != io.EOF {
+			return err
+		}
+
+		data := append(chunk[:n:n], rest...)
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			line := data[i+1:]
+			if long {
+				long = false
+			} else if len(line) > 0 && len(line) <= maxLineLength && !fn(line) {
+				return nil
+			}
+			data = data[:i]
+		}
+
+		if len(data) > maxLineLength {
+			long = true
+			data = nil
+		}
+		rest = append(rest[:0:0], data...)
+	}
+
+	if len(rest) > 0 && !long {
+		fn(rest)
+	}
+	return nil
+}
+
+// match checks if an entry matches the filter
+func (f *Filter) match(entry *Entry) bool {
+	if f.Before > 0 && entry.ID >= f.Before {
+		return false
+	}
+	if f.Client != "" && entry.Client != f.Client && entry.ClientIP != f.Client {
+		return false
+	}
+	if f.Verdict != "" && entry.Verdict != f.Verdict {
+		return false
+	}
+	if !f.From.IsZero() && entry.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !entry.Time.Before(f.To) {
+		return false
+	}
+	if f.Domain != "" {
+		name := strings.ToLower(strings.TrimSuffix(entry.QName, "."))
+		if name != f.Domain && !strings.HasSuffix(name, "."+f.Domain) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package querylog
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntries records n queries from two clients, every third one blocked,
+// and reopens the log so all of them are on disk. The first query has the
+// time of the last, like before the clock was set back, so it is only found
+// if a query reads past the entries before its From.
+func testEntries(t *testing.T, n int) *Log {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	l, err := Open(path, 2<<10, 5) // Rotated every few entries
+	if err != nil {
+		t.Fatalf("Expected no error opening the query log, got %v", err)
+	}
+	start := time.Date(2025, 4, 12, 10, 0, 0, 0, time.UTC)
+	for i := 1; i <= n; i++ {
+		seconds := i
+		if i == 1 {
+			seconds = n
+		}
+		entry := Entry{
+			Time:     start.Add(time.Duration(seconds) * time.Second),
+			Client:   fmt.Sprintf("10.0.0.%d", i%2+1),
+			ClientIP: fmt.Sprintf("10.0.0.%d", i%2+1),
+			QName:    fmt.Sprintf("host%d.example.com.", i),
+			QType:    "A",
+			Verdict:  VerdictAllowed,
+			Rcode:    "NOERROR",
+		}
+		if i%3 == 0 {
+			entry.Verdict = VerdictBlocked
+			entry.Rcode = "NXDOMAIN"
+		}
+		l.Record(entry)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Expected no error closing the query log, got %v", err)
+	}
+
+	l, err = Open(path, 2<<10, 5)
+	if err != nil {
+		t.Fatalf("Expected no error reopening the query log, got %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestQuery(t *testing.T) {
+	l := testEntries(t, 30)
+
+	tests := []struct {
+		filter Filter
+		ids    []uint64
+		cursor string
+	}{
+		{Filter{Limit: 5}, []uint64{30, 29, 28, 27, 26}, "26"},
+		{Filter{Limit: 5, Before: 26}, []uint64{25, 24, 23, 22, 21}, "21"},
+		{Filter{Limit: 5, Before: 4}, []uint64{3, 2, 1}, ""},
+		{Filter{Limit: 4, Verdict: VerdictBlocked}, []uint64{30, 27, 24, 21}, "21"},
+		{Filter{Limit: 3, Client: "10.0.0.1"}, []uint64{30, 28, 26}, "26"},
+		{Filter{Domain: "host7.example.com"}, []uint64{7}, ""},
+		{Filter{Domain: "example.com", Before: 3}, []uint64{2, 1}, ""},
+		{Filter{From: time.Date(2025, 4, 12, 10, 0, 28, 0, time.UTC)}, []uint64{30, 29, 28}, ""},
+		{Filter{From: time.Date(2025, 4, 12, 10, 0, 3, 0, time.UTC), Before: 10, Verdict: VerdictBlocked}, []uint64{9, 6, 3}, ""},
+		{Filter{To: time.Date(2025, 4, 12, 10, 0, 3, 0, time.UTC)}, []uint64{2}, ""},
+		{Filter{Domain: "example.org"}, []uint64{}, ""},
+	}
+
+	for i, tc := range tests {
+		page, err := l.Query(tc.filter)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+		ids := []uint64{}
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tc.ids) || page.NextCursor != tc.cursor {
+			t.Errorf("Test %d: expected %v with cursor %q, got %v with cursor %q", i, tc.ids, tc.cursor, ids, page.NextCursor)
+		}
+	}
+}
+
+func TestReadLinesBackwards(t *testing.T) {
+	// Lines crossing the chunks read at once, one of them too long to read
+	// back, and a last line without a newline
+	lines := []string{}
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d %s", i, strings.Repeat("x", i%97)))
+	}
+	long := strings.Repeat("y", maxLineLength+readSize/2)
+	content := strings.Join(lines[:2500], "\n") + "\n" + long + "\n\n" + strings.Join(lines[2500:], "\n")
+
+	got := []string{}
+	err := readLinesBackwards(strings.NewReader(content), int64(len(content)), func(line []byte) bool {
+		got = append(got, string(line))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(got) != len(lines) {
+		t.Fatalf("Expected %d lines, got %d", len(lines), len(got))
+	}
+	for i, line := range got {
+		if expected := lines[len(lines)-1-i]; line != expected {
+			t.Fatalf("Line %d: expected %.20q, got %.20q", i, expected, line)
+		}
+	}
+
+	// Reading stops once fn returns false
+	count := 0
+	readLinesBackwards(strings.NewReader(content), int64(len(content)), func(line []byte) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("Expected reading to stop after 3 lines, got %d", count)
+	}
+}
+
+func TestRecordAfterClose(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "queries.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatalf("Expected no error opening the query log, got %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Expected no error closing the query log, got %v", err)
+	}
+
+	// Queries answered while the plugin shuts down must not panic
+	l.Record(Entry{QName: "example.com."})
+	if err := l.Close(); err != nil {
+		t.Errorf("Expected no error closing the query log twice, got %v", err)
+	}
+}
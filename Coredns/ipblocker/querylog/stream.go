@@ -0,0 +1,102 @@
+package querylog
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// subscriptionSize is the number of entries buffered for a subscriber, more
+// are dropped until it catches up
+const subscriptionSize = 256
+
+// Stream passes live entries to subscribers. A subscriber that cannot keep up
+// loses entries instead of slowing down the queries. The methods of a nil
+// stream do nothing.
+type Stream struct {
+	mutex       sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	active      atomic.Int32 // Number of subscribers, read without the lock
+}
+
+// Subscription receives the entries of a stream matching its filter
+type Subscription struct {
+	entries chan Entry
+	filter  Filter
+	dropped atomic.Uint64
+}
+
+// NewStream returns a stream without subscribers
+func NewStream() *Stream {
+	return &Stream{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Active checks if the stream has subscribers, so entries only need to be
+// built for them if it does
+func (s *Stream) Active() bool {
+	return s != nil && s.active.Load() > 0
+}
+
+// Subscribe adds a subscriber receiving the entries matching a filter. Its
+// time range and cursor are ignored.
+func (s *Stream) Subscribe(filter Filter) *Subscription {
+	sub := &Subscription{
+		entries: make(chan Entry, subscriptionSize),
+		filter: Filter{
+			Client:  filter.Client,
+			Domain:  strings.ToLower(strings.TrimSuffix(filter.Domain, ".")),
+			Verdict: filter.Verdict,
+		},
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.subscribers[sub] = struct{}{}
+	s.active.Add(1)
+	return sub
+}
+
+// Unsubscribe removes a subscriber
+func (s *Stream) Unsubscribe(sub *Subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.subscribers[sub]; exists {
+		delete(s.subscribers, sub)
+		s.active.Add(-1)
+	}
+}
+
+// Publish passes an entry to the matching subscribers without waiting for
+// them
+func (s *Stream) Publish(entry Entry) {
+	if !s.Active() {
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for sub := range s.subscribers {
+		if !sub.filter.match(&entry) {
+			continue
+		}
+		select {
+		case sub.entries <- entry:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Entries returns the channel the entries are received from
+func (sub *Subscription) Entries() <-chan Entry {
+	return sub.entries
+}
+
+// Dropped returns the number of entries dropped so far because the
+// subscriber did not keep up
+func (sub *Subscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
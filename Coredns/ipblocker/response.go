@@ -0,0 +1,151 @@
+package ipblocker
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/miekg/dns"
+)
+
+// Defaults for answers to blocked queries
+const (
+	defaultBlockResponse = dnslookup.BlockResponseNXDomain
+	defaultBlockTTL      = 60
+)
+
+// Names used in the synthesized SOA record of blocked answers
+const (
+	blockSOANs   = "ipblocker."
+	blockSOAMbox = "hostmaster.ipblocker."
+)
+
+// BlockResponse describes how blocked queries are answered
+type BlockResponse struct {
+	Mode       string // Default mode for clients without their own setting
+	SinkholeV4 net.IP // Address returned for blocked A queries in sinkhole mode
+	SinkholeV6 net.IP // Address returned for blocked AAAA queries in sinkhole mode
+	TTL        uint32 // TTL of sinkhole answers and of the SOA used for negative caching
+}
+
+// NewBlockResponse returns the default block response: NXDOMAIN, sinkholing to
+// the unspecified addresses
+func NewBlockResponse() *BlockResponse {
+	return &BlockResponse{
+		Mode:       defaultBlockResponse,
+		SinkholeV4: net.IPv4zero,
+		SinkholeV6: net.IPv6unspecified,
+		TTL:        defaultBlockTTL,
+	}
+}
+
+// Build creates the answer to a blocked query. An empty mode selects the
+// configured default.
+func (br *BlockResponse) Build(r *dns.Msg, mode string) *dns.Msg {
+	if mode == "" {
+		mode = br.Mode
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.RecursionAvailable = true
+
+	switch mode {
+	case dnslookup.BlockResponseRefused:
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	case dnslookup.BlockResponseNoData:
+		resp.Ns = []dns.RR{br.soa(r)}
+		return resp
+	case dnslookup.BlockResponseSinkhole:
+		if answer := br.sinkhole(r); answer != nil {
+			resp.Answer = []dns.RR{answer}
+		} else {
+			// Other query types get NODATA
+			resp.Ns = []dns.RR{br.soa(r)}
+		}
+		return resp
+	default:
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = []dns.RR{br.soa(r)}
+		return resp
+	}
+}
+
+// sinkhole returns the sinkhole record for A and AAAA queries, nil otherwise
+func (br *BlockResponse) sinkhole(r *dns.Msg) dns.RR {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: br.TTL}
+
+	switch q.Qtype {
+	case dns.TypeA:
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: br.SinkholeV4}
+	case dns.TypeAAAA:
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: br.SinkholeV6}
+	}
+	return nil
+}
+
+// soa returns a SOA record owned by the blocked name, so that resolvers cache
+// the negative answer for the block TTL
+func (br *BlockResponse) soa(r *dns.Msg) dns.RR {
+	name := "."
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: br.TTL},
+		Ns:      blockSOANs,
+		Mbox:    blockSOAMbox,
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  br.TTL,
+	}
+}
+
+// blockReason returns the Extended DNS Error (RFC 8914) describing why a query
+// was blocked
+func blockReason(verdict *dnslookup.Verdict) *dns.EDNS0_EDE {
+	if verdict.Override != "" {
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: "blocked by override " + verdict.OverrideID,
+		}
+	}
+
+	switch verdict.ListType {
+	case "blocklist":
+		if verdict.CNAME != "" {
+			return &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeBlocked,
+				ExtraText: "cname " + verdict.CNAME + " blocked by blocklist " + verdict.ListName,
+			}
+		}
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: "blocked by blocklist " + verdict.ListName,
+		}
+	case "ipblocklist":
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: "answer " + verdict.AnswerIP + " blocked by ipblocklist " + verdict.ListName,
+		}
+	case "whitelist":
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeFiltered,
+			ExtraText: "not in any whitelist",
+		}
+	default:
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeProhibited,
+			ExtraText: "client not allowed",
+		}
+	}
+}
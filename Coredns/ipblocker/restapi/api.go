@@ -7,10 +7,14 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/coredns/coredns/plugin/ipblocker/querylog"
+	"github.com/coredns/coredns/plugin/ipblocker/stats"
 	"github.com/gorilla/mux"
 )
 
@@ -24,19 +28,22 @@ type DomainManagementRequest struct {
 	Domains []string `json:"domains"`
 }
 
-// DNSCheckResponse for domain checking
-type DNSCheckResponse struct {
-	ClientIP string `json:"clientIP"`
-	Domain   string `json:"domain"`
-	Allowed  bool   `json:"allowed"`
-}
-
 // APIServer represents the REST API server
 type APIServer struct {
-	server    *http.Server
-	DNSFilter *dnslookup.DNSFilter
-	running   bool
-	mutex     sync.Mutex
+	server     *http.Server
+	DNSFilter  *dnslookup.DNSFilter
+	QueryLog   *querylog.Log    // Query log of the filter, nil if disabled
+	Stream     *querylog.Stream // Live query stream of the filter, nil if disabled
+	Stats      *stats.Store     // Statistics of the filter, nil if disabled
+	FilterName string           // Name of the filter, used as metrics label
+	// BootstrapKey is an API key from the Corefile, accepted with the admin
+	// role besides the keys in apikeys.json
+	BootstrapKey string
+	AuthDisabled bool      // Accept requests without an API key
+	keys         *keyStore // API keys, loaded on Initialize
+	running      bool
+	shutdown     chan struct{} // Closed on shutdown to end the streams
+	mutex        sync.Mutex
 }
 
 // NewAPIServer creates a new API server instance
@@ -56,9 +63,21 @@ func loggerMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// timeoutMiddleware adds timeout to all requests
+// streamPrefix is the path prefix of long-lived streams
+const streamPrefix = "/api/stream/"
+
+// streamKeepalive is how often an idle stream sends a comment, so proxies do
+// not close the connection
+const streamKeepalive = 15 * time.Second
+
+// timeoutMiddleware adds timeout to all requests except streams
 func timeoutMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, streamPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 		defer cancel()
 
@@ -116,7 +135,7 @@ func (api *APIServer) getListsByType(w http.ResponseWriter, r *http.Request) {
 	listType := vars["type"]
 	log.Printf("[API] Handler: getListsByType called with type: %s", listType)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -131,7 +150,7 @@ func (api *APIServer) getListContent(w http.ResponseWriter, r *http.Request) {
 	listName := vars["name"]
 	log.Printf("[API] Handler: getListContent called with type: %s, name: %s", listType, listName)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -151,7 +170,7 @@ func (api *APIServer) createList(w http.ResponseWriter, r *http.Request) {
 	listType := vars["type"]
 	log.Printf("[API] Handler: createList called with type: %s", listType)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -181,7 +200,7 @@ func (api *APIServer) updateList(w http.ResponseWriter, r *http.Request) {
 	listName := vars["name"]
 	log.Printf("[API] Handler: updateList called with type: %s, name: %s", listType, listName)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -212,7 +231,7 @@ func (api *APIServer) deleteList(w http.ResponseWriter, r *http.Request) {
 	listName := vars["name"]
 	log.Printf("[API] Handler: deleteList called with type: %s, name: %s", listType, listName)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -225,6 +244,41 @@ func (api *APIServer) deleteList(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// refreshList fetches a subscribed list from its source right away
+func (api *APIServer) refreshList(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listType := vars["type"]
+	listName := vars["name"]
+	log.Printf("[API] Handler: refreshList called with type: %s, name: %s", listType, listName)
+
+	if !dnslookup.IsValidListType(listType) {
+		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
+		return
+	}
+
+	list, err := api.DNSFilter.GetListContent(listName, listType)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if list.Subscription == nil {
+		sendErrorResponse(w, "List has no subscription", http.StatusBadRequest)
+		return
+	}
+
+	if err := api.DNSFilter.RefreshList(listName, listType); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	list, err = api.DNSFilter.GetListContent(listName, listType)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	sendJSONResponse(w, list.Subscription, http.StatusOK)
+}
+
 // Domain Management Handlers
 
 // addDomains adds domains to a list
@@ -234,7 +288,7 @@ func (api *APIServer) addDomains(w http.ResponseWriter, r *http.Request) {
 	listName := vars["name"]
 	log.Printf("[API] Handler: addDomains called with type: %s, name: %s", listType, listName)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -262,7 +316,7 @@ func (api *APIServer) removeDomains(w http.ResponseWriter, r *http.Request) {
 	listName := vars["name"]
 	log.Printf("[API] Handler: removeDomains called with type: %s, name: %s", listType, listName)
 
-	if listType != "blocklist" && listType != "whitelist" {
+	if !dnslookup.IsValidListType(listType) {
 		sendErrorResponse(w, "Invalid list type", http.StatusBadRequest)
 		return
 	}
@@ -364,32 +418,388 @@ func (api *APIServer) deleteClient(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Override Handlers
+
+// getOverrides returns the active overrides of a client
+func (api *APIServer) getOverrides(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientIP := vars["ip"]
+	log.Printf("[API] Handler: getOverrides called with IP: %s", clientIP)
+
+	overrides, err := api.DNSFilter.GetOverrides(clientIP)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	sendJSONResponse(w, overrides, http.StatusOK)
+}
+
+// createOverride adds an expiring override to a client
+func (api *APIServer) createOverride(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientIP := vars["ip"]
+	log.Printf("[API] Handler: createOverride called with IP: %s", clientIP)
+
+	var request dnslookup.OverrideRequest
+	if err := decodeJSONRequest(r, &request); err != nil {
+		log.Printf("[API] Error decoding JSON: %v", err)
+		sendErrorResponse(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	override, err := api.DNSFilter.CreateOverride(clientIP, &request)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[API] Override created for %s: %+v", clientIP, *override)
+	sendJSONResponse(w, override, http.StatusCreated)
+}
+
+// deleteOverride removes an override of a client
+func (api *APIServer) deleteOverride(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientIP := vars["ip"]
+	id := vars["id"]
+	log.Printf("[API] Handler: deleteOverride called with IP: %s, id: %s", clientIP, id)
+
+	if err := api.DNSFilter.DeleteOverride(clientIP, id); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Profile Management Handlers
+
+// getAllProfiles returns all profiles
+func (api *APIServer) getAllProfiles(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: getAllProfiles called")
+	sendJSONResponse(w, api.DNSFilter.GetAllProfiles(), http.StatusOK)
+}
+
+// getProfile returns a profile by name
+func (api *APIServer) getProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	log.Printf("[API] Handler: getProfile called with name: %s", name)
+
+	profile, err := api.DNSFilter.GetProfile(name)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	sendJSONResponse(w, profile, http.StatusOK)
+}
+
+// createProfile creates a new profile
+func (api *APIServer) createProfile(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: createProfile called")
+
+	var newProfile dnslookup.Profile
+	if err := decodeJSONRequest(r, &newProfile); err != nil {
+		log.Printf("[API] Error decoding JSON: %v", err)
+		sendErrorResponse(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if err := api.DNSFilter.CreateProfile(&newProfile); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[API] New profile created: %+v", newProfile)
+	sendJSONResponse(w, newProfile, http.StatusCreated)
+}
+
+// updateProfile updates an existing profile
+func (api *APIServer) updateProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	log.Printf("[API] Handler: updateProfile called with name: %s", name)
+
+	var updatedProfile dnslookup.Profile
+	if err := decodeJSONRequest(r, &updatedProfile); err != nil {
+		log.Printf("[API] Error decoding JSON: %v", err)
+		sendErrorResponse(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	updatedProfile.Name = name
+
+	if err := api.DNSFilter.UpdateProfile(&updatedProfile); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[API] Profile updated: %+v", updatedProfile)
+	sendJSONResponse(w, updatedProfile, http.StatusOK)
+}
+
+// deleteProfile deletes a profile
+func (api *APIServer) deleteProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	log.Printf("[API] Handler: deleteProfile called with name: %s", name)
+
+	if err := api.DNSFilter.DeleteProfile(name); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Unknown Client Handlers
+
+// getUnknownClients returns the unknown client policy and the unknown clients
+// that sent queries
+func (api *APIServer) getUnknownClients(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: getUnknownClients called")
+	sendJSONResponse(w, api.DNSFilter.GetUnknownClients(), http.StatusOK)
+}
+
+// setUnknownClientPolicy sets the policy for unknown clients
+func (api *APIServer) setUnknownClientPolicy(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: setUnknownClientPolicy called")
+
+	var policy dnslookup.UnknownClientPolicy
+	if err := decodeJSONRequest(r, &policy); err != nil {
+		log.Printf("[API] Error decoding JSON: %v", err)
+		sendErrorResponse(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if err := api.DNSFilter.SetUnknownClientPolicy(&policy); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[API] Unknown client policy set: %s", policy.Action)
+	sendJSONResponse(w, policy, http.StatusOK)
+}
+
+// resetUnknownClientPolicy restores the unknown client policy of the Corefile
+func (api *APIServer) resetUnknownClientPolicy(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: resetUnknownClientPolicy called")
+
+	if err := api.DNSFilter.ResetUnknownClientPolicy(); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // DNS Lookup Handler
 
-// checkDomain checks if a client is allowed to access a domain
+// checkDomain checks if a client is allowed to access a domain and explains why
 func (api *APIServer) checkDomain(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	clientIP := vars["ip"]
 	domain := vars["domain"]
 	log.Printf("[API] Handler: checkDomain called with IP: %s, domain: %s", clientIP, domain)
 
-	allowed := api.DNSFilter.CheckDomain(clientIP, domain)
+	sendJSONResponse(w, api.DNSFilter.Evaluate(clientIP, domain), http.StatusOK)
+}
+
+// Query Log Handlers
+
+// getQueryLog returns a page of the query log, newest first, filtered by the
+// query parameters client, domain, verdict, from and to. The cursor parameter
+// continues after a previous page.
+func (api *APIServer) getQueryLog(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: getQueryLog called")
+
+	if api.QueryLog == nil {
+		sendErrorResponse(w, "Query log is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := querylog.Filter{
+		Client:  query.Get("client"),
+		Domain:  query.Get("domain"),
+		Verdict: query.Get("verdict"),
+	}
+
+	if filter.Verdict != "" && filter.Verdict != querylog.VerdictAllowed && filter.Verdict != querylog.VerdictBlocked {
+		sendErrorResponse(w, "Invalid verdict, expected allowed or blocked", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			sendErrorResponse(w, "Invalid from time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		filter.From = from
+	}
+	if value := query.Get("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			sendErrorResponse(w, "Invalid to time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		filter.To = to
+	}
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			sendErrorResponse(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter.Before = cursor
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			sendErrorResponse(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	page, err := api.QueryLog.Query(filter)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, page, http.StatusOK)
+}
+
+// streamQueries streams the queries of the filter as Server-Sent Events until
+// the client disconnects, filtered by the query parameters client, domain and
+// verdict. Entries a slow client cannot take are dropped and reported in a
+// "dropped" event.
+func (api *APIServer) streamQueries(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: streamQueries called")
+
+	if api.Stream == nil {
+		sendErrorResponse(w, "Query stream is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := querylog.Filter{
+		Client:  query.Get("client"),
+		Domain:  query.Get("domain"),
+		Verdict: query.Get("verdict"),
+	}
+	if filter.Verdict != "" && filter.Verdict != querylog.VerdictAllowed && filter.Verdict != querylog.VerdictBlocked {
+		sendErrorResponse(w, "Invalid verdict, expected allowed or blocked", http.StatusBadRequest)
+		return
+	}
+
+	// The write timeout of the server would end the stream
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("[API] Could not clear write deadline of stream: %v", err)
+	}
+
+	sub := api.Stream.Subscribe(filter)
+	defer api.Stream.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("[API] Streaming not supported: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+
+	var dropped uint64
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-api.shutdown:
+			return
+		case entry := <-sub.Entries():
+			data, _ := json.Marshal(entry)
+			_, err = fmt.Fprintf(w, "event: query\ndata: %s\n\n", data)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+
+		if total := sub.Dropped(); err == nil && total > dropped {
+			_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", total-dropped)
+			dropped = total
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return // Client is gone
+		}
+	}
+}
+
+// Statistics Handler
+
+// getStats returns the statistics of the period given by the query parameter
+// period, e.g. "1h", "24h" or "7d", with the top names limited by top
+func (api *APIServer) getStats(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: getStats called")
+
+	if api.Stats == nil {
+		sendErrorResponse(w, "Statistics are disabled", http.StatusNotFound)
+		return
+	}
 
-	response := DNSCheckResponse{
-		ClientIP: clientIP,
-		Domain:   domain,
-		Allowed:  allowed,
+	query := r.URL.Query()
+	period := 24 * time.Hour
+	if value := query.Get("period"); value != "" {
+		parsed, err := stats.ParsePeriod(value)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		period = parsed
+	}
+	top := 0
+	if value := query.Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			sendErrorResponse(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+		top = parsed
 	}
 
-	sendJSONResponse(w, response, http.StatusOK)
+	sendJSONResponse(w, api.Stats.Summarize(time.Now(), period, top), http.StatusOK)
 }
 
+// Status Handler
+
+// getStatus returns the state of the filter's files, including load errors
+func (api *APIServer) getStatus(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: getStatus called")
+	sendJSONResponse(w, api.DNSFilter.GetStatus(), http.StatusOK)
+}
+
+// clientRoute matches the key of a client entry in a route, an address, a
+// network like 10.8.0.0/24 or a client ID
+const clientRoute = "{ip:[0-9A-Za-z:.-]+(?:/[0-9]+)?}"
+
 // setupRoutes configures all API routes
 func (api *APIServer) setupRoutes() *mux.Router {
 	router := mux.NewRouter()
 
 	// Apply middleware
 	router.Use(loggerMiddleware)
+	router.Use(api.metricsMiddleware)
+	router.Use(api.authMiddleware)
 	router.Use(timeoutMiddleware)
 
 	// List management routes
@@ -399,6 +809,7 @@ func (api *APIServer) setupRoutes() *mux.Router {
 	router.HandleFunc("/api/lists/{type}", api.createList).Methods("POST")
 	router.HandleFunc("/api/lists/{type}/{name}", api.updateList).Methods("PUT")
 	router.HandleFunc("/api/lists/{type}/{name}", api.deleteList).Methods("DELETE")
+	router.HandleFunc("/api/lists/{type}/{name}/refresh", api.refreshList).Methods("POST")
 
 	// Domain management routes
 	router.HandleFunc("/api/lists/{type}/{name}/domains", api.addDomains).Methods("POST")
@@ -406,19 +817,51 @@ func (api *APIServer) setupRoutes() *mux.Router {
 
 	// Client management routes
 	router.HandleFunc("/api/clients", api.getAllClients).Methods("GET")
-	router.HandleFunc("/api/clients/{ip}", api.getClientByIP).Methods("GET")
+	router.HandleFunc("/api/clients/"+clientRoute, api.getClientByIP).Methods("GET")
 	router.HandleFunc("/api/clients", api.createClient).Methods("POST")
-	router.HandleFunc("/api/clients/{ip}", api.updateClient).Methods("PUT")
-	router.HandleFunc("/api/clients/{ip}", api.deleteClient).Methods("DELETE")
+	router.HandleFunc("/api/clients/"+clientRoute, api.updateClient).Methods("PUT")
+	router.HandleFunc("/api/clients/"+clientRoute, api.deleteClient).Methods("DELETE")
+
+	// Override routes
+	router.HandleFunc("/api/clients/"+clientRoute+"/overrides", api.getOverrides).Methods("GET")
+	router.HandleFunc("/api/clients/"+clientRoute+"/overrides", api.createOverride).Methods("POST")
+	router.HandleFunc("/api/clients/"+clientRoute+"/overrides/{id}", api.deleteOverride).Methods("DELETE")
+
+	// Profile management routes
+	router.HandleFunc("/api/profiles", api.getAllProfiles).Methods("GET")
+	router.HandleFunc("/api/profiles/{name}", api.getProfile).Methods("GET")
+	router.HandleFunc("/api/profiles", api.createProfile).Methods("POST")
+	router.HandleFunc("/api/profiles/{name}", api.updateProfile).Methods("PUT")
+	router.HandleFunc("/api/profiles/{name}", api.deleteProfile).Methods("DELETE")
+
+	// Unknown client routes
+	router.HandleFunc("/api/unknown-clients", api.getUnknownClients).Methods("GET")
+	router.HandleFunc("/api/unknown-clients/policy", api.setUnknownClientPolicy).Methods("PUT")
+	router.HandleFunc("/api/unknown-clients/policy", api.resetUnknownClientPolicy).Methods("DELETE")
 
 	// DNS lookup routes
 	router.HandleFunc("/api/check/{ip}/{domain}", api.checkDomain).Methods("GET")
 
+	// Query log routes
+	router.HandleFunc("/api/querylog", api.getQueryLog).Methods("GET")
+	router.HandleFunc(streamPrefix+"queries", api.streamQueries).Methods("GET")
+
+	// Statistics routes
+	router.HandleFunc("/api/stats", api.getStats).Methods("GET")
+
+	// Status routes
+	router.HandleFunc("/api/status", api.getStatus).Methods("GET")
+
+	// API key routes
+	router.HandleFunc(keysPrefix, api.getAPIKeys).Methods("GET")
+	router.HandleFunc(keysPrefix, api.createAPIKey).Methods("POST")
+	router.HandleFunc(keysPrefix+"/{id}", api.deleteAPIKey).Methods("DELETE")
+
 	return router
 }
 
 // Initialize initializes the API server
-func (api *APIServer) Initialize(configPath, blocklistDir, whitelistDir string, port int) error {
+func (api *APIServer) Initialize(configPath, blocklistDir, whitelistDir, ipBlocklistDir, addr string) error {
 	api.mutex.Lock()
 	defer api.mutex.Unlock()
 
@@ -439,30 +882,48 @@ func (api *APIServer) Initialize(configPath, blocklistDir, whitelistDir string,
 	if err != nil {
 		return err
 	}
+	absIPBlocklistDir, err := filepath.Abs(ipBlocklistDir)
+	if err != nil {
+		return err
+	}
 
 	// Initialize DNS filter if not already provided
 	if api.DNSFilter == nil {
-		api.DNSFilter = dnslookup.NewDNSFilter(absConfigPath, absBlocklistDir, absWhitelistDir)
+		api.DNSFilter = dnslookup.NewDNSFilter(absConfigPath, absBlocklistDir, absWhitelistDir, absIPBlocklistDir)
 		if err := api.DNSFilter.Initialize(); err != nil {
 			return err
 		}
 	}
 
+	// Load the API keys, the bootstrap key works even if the file is broken
+	keys, err := loadKeyStore(filepath.Join(filepath.Dir(absConfigPath), apiKeysFile), api.BootstrapKey)
+	if err != nil {
+		log.Printf("[API] %v", err)
+	}
+	api.keys = keys
+	if api.AuthDisabled {
+		log.Printf("[API] Warning: authentication is disabled, anyone reaching %s can change the filter", addr)
+	} else if keys.empty() {
+		log.Printf("[API] Warning: no API keys configured, every request will be rejected until api_key is set")
+	}
+
 	// Setup routes
 	router := api.setupRoutes()
 
-	// Configure server with timeouts
+	// Configure server with timeouts, streams clear their write timeout
 	api.server = &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
+		Addr:         addr,
 		Handler:      router,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	api.shutdown = make(chan struct{})
+	api.server.RegisterOnShutdown(func() { close(api.shutdown) })
 
 	// Start server in a goroutine
 	go func() {
-		log.Printf("[API] Server starting on port %d...", port)
+		log.Printf("[API] Server starting on %s...", addr)
 		if err := api.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Printf("[API] Server failed to start: %v", err)
 		}
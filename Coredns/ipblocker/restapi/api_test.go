@@ -0,0 +1,81 @@
+package restapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/gorilla/mux"
+)
+
+// newTestAPI returns an API server for a filter in a temporary directory
+// with a blocklist "ads" blocking ads.example.com
+func newTestAPI(t *testing.T) *APIServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "blocklists"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blocklists", "ads"), []byte("ads.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	df := dnslookup.NewDNSFilter(filepath.Join(dir, "clients.json"),
+		filepath.Join(dir, "blocklists"), filepath.Join(dir, "whitelists"), filepath.Join(dir, "ipblocklists"))
+	if err := df.Initialize(); err != nil {
+		t.Fatalf("Expected no error initializing the filter, got %v", err)
+	}
+	t.Cleanup(func() { df.Close() })
+	return NewAPIServer(df)
+}
+
+func TestManageDomains(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		handler http.HandlerFunc
+		domains string
+		status  int
+		err     string
+		list    string // Rules of the list afterwards, a rejected request leaves it unchanged
+	}{
+		{api.addDomains, `["tracker.example.com", "/(/"]`, http.StatusBadRequest, "invalid regular expression", "[ads.example.com]"},
+		{api.addDomains, `["tracker.example.com", "*.*"]`, http.StatusBadRequest, "matches every name", "[ads.example.com]"},
+		{api.addDomains, `["tracker.example.com", "bad domain"]`, http.StatusBadRequest, "invalid domain", "[ads.example.com]"},
+		{api.addDomains, `["tracker*.example.com"]`, http.StatusOK, "", "[ads.example.com tracker*.example.com]"},
+		{api.removeDomains, `["tracker*.example.com"]`, http.StatusOK, "", "[ads.example.com]"},
+	}
+
+	for i, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/lists/blocklist/ads/domains", strings.NewReader(`{"domains": `+tc.domains+`}`))
+		r = mux.SetURLVars(r, map[string]string{"type": "blocklist", "name": "ads"})
+		w := httptest.NewRecorder()
+		tc.handler(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("Test %d: expected status %d, got %d: %s", i, tc.status, w.Code, w.Body.String())
+		}
+		var response ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if !strings.Contains(response.Error, tc.err) {
+			t.Errorf("Test %d: expected error containing %q, got %q", i, tc.err, response.Error)
+		}
+
+		content, err := api.DNSFilter.GetListContent("ads", "blocklist")
+		if err != nil {
+			t.Fatalf("Test %d: expected no error getting the list, got %v", i, err)
+		}
+		sort.Strings(content.Domains)
+		if list := fmt.Sprint(content.Domains); list != tc.list {
+			t.Errorf("Test %d: expected the list to be %s, got %s", i, tc.list, list)
+		}
+	}
+}
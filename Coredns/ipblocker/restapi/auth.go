@@ -0,0 +1,291 @@
+package restapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API key roles
+const (
+	RoleAdmin = "admin" // Every route, including key management
+	RoleRead  = "read"  // GET routes except key management
+)
+
+// apiKeysFile is the file the API keys are stored in, next to the client
+// configuration
+const apiKeysFile = "apikeys.json"
+
+// apiKeyBytes is the number of random bytes of a key, 64 hex characters like
+// users.api_key of the management database
+const apiKeyBytes = 32
+
+// keysPrefix is the path prefix of the key management routes
+const keysPrefix = "/api/keys"
+
+// APIKey is a key accepted by the API. Only the SHA-256 hash of the key is
+// stored, the key itself is shown once when it is created.
+type APIKey struct {
+	ID      string    `json:"id,omitempty"`
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`           // "admin" or "read"
+	Hash    string    `json:"hash,omitempty"` // SHA-256 of the key, hex encoded
+	Created time.Time `json:"created"`
+	Key     string    `json:"key,omitempty"` // The key, only in the response creating it
+}
+
+// keyStore holds the API keys, persisted in a JSON file, and the bootstrap
+// key from the Corefile
+type keyStore struct {
+	path      string
+	keys      map[string]APIKey // Keyed by ID
+	bootstrap string            // Hash of the bootstrap key, empty if none
+	mutex     sync.RWMutex
+}
+
+// hashAPIKey returns the hash an API key is stored as
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadKeyStore loads the API keys from a JSON file. The bootstrap key is
+// accepted with the admin role even if the file cannot be loaded.
+func loadKeyStore(filename, bootstrapKey string) (*keyStore, error) {
+	ks := &keyStore{
+		path: filename,
+		keys: make(map[string]APIKey),
+	}
+	if bootstrapKey != "" {
+		ks.bootstrap = hashAPIKey(bootstrapKey)
+	}
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return ks, fmt.Errorf("error reading API keys: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &ks.keys); err != nil {
+		ks.keys = make(map[string]APIKey)
+		return ks, fmt.Errorf("error parsing API keys: %v", err)
+	}
+
+	return ks, nil
+}
+
+// save saves the API keys, the caller must hold the lock
+func (ks *keyStore) save() error {
+	data, err := json.MarshalIndent(ks.keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding API keys: %v", err)
+	}
+
+	if err := os.WriteFile(ks.path, data, 0600); err != nil {
+		return fmt.Errorf("error writing API keys: %v", err)
+	}
+
+	return nil
+}
+
+// empty checks if no key would be accepted
+func (ks *keyStore) empty() bool {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	return ks.bootstrap == "" && len(ks.keys) == 0
+}
+
+// authenticate returns the role of a key
+func (ks *keyStore) authenticate(key string) (string, bool) {
+	if ks == nil || key == "" {
+		return "", false
+	}
+	hash := hashAPIKey(key)
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	role, found := "", false
+	if ks.bootstrap != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(ks.bootstrap)) == 1 {
+		role, found = RoleAdmin, true
+	}
+	for _, apiKey := range ks.keys {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(apiKey.Hash)) == 1 {
+			role, found = apiKey.Role, true
+		}
+	}
+	return role, found
+}
+
+// list returns the keys without their hashes, sorted by name
+func (ks *keyStore) list() []APIKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	result := []APIKey{}
+	for id, apiKey := range ks.keys {
+		apiKey.ID = id
+		apiKey.Hash = ""
+		result = append(result, apiKey)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result
+}
+
+// create generates a new key and returns it, including the key itself
+func (ks *keyStore) create(name, role string) (*APIKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("key name is required")
+	}
+	if role != RoleAdmin && role != RoleRead {
+		return nil, fmt.Errorf("invalid role %s, expected admin or read", role)
+	}
+
+	secret := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error generating key: %v", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("error generating key id: %v", err)
+	}
+
+	key := hex.EncodeToString(secret)
+	apiKey := APIKey{
+		Name:    name,
+		Role:    role,
+		Hash:    hashAPIKey(key),
+		Created: time.Now().UTC(),
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	ks.keys[hex.EncodeToString(id)] = apiKey
+	if err := ks.save(); err != nil {
+		return nil, err
+	}
+
+	apiKey.ID = hex.EncodeToString(id)
+	apiKey.Hash = ""
+	apiKey.Key = key
+	return &apiKey, nil
+}
+
+// remove deletes a key, which is rejected from then on
+func (ks *keyStore) remove(id string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	if _, exists := ks.keys[id]; !exists {
+		return fmt.Errorf("key not found: %s", id)
+	}
+
+	delete(ks.keys, id)
+	return ks.save()
+}
+
+// requestKey returns the API key of a request, sent as
+// "Authorization: Bearer KEY" or "X-API-Key: KEY"
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authMiddleware rejects requests without a valid API key with 401
+// Unauthorized, and requests a read-only key is not allowed to make with 403
+// Forbidden
+func (api *APIServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.AuthDisabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := requestKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ipblocker"`)
+			sendErrorResponse(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		role, ok := api.keys.authenticate(key)
+		if !ok {
+			log.Printf("[API] Rejected invalid API key from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ipblocker", error="invalid_token"`)
+			sendErrorResponse(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		if role != RoleAdmin && (r.Method != http.MethodGet || strings.HasPrefix(r.URL.Path, keysPrefix)) {
+			sendErrorResponse(w, "API key is read-only", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// API Key Handlers
+
+// getAPIKeys returns the API keys without the keys themselves
+func (api *APIServer) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: getAPIKeys called")
+	sendJSONResponse(w, api.keys.list(), http.StatusOK)
+}
+
+// createAPIKey creates an API key and returns it, the only time the key is
+// shown
+func (api *APIServer) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	log.Println("[API] Handler: createAPIKey called")
+
+	var request APIKey
+	if err := decodeJSONRequest(r, &request); err != nil {
+		log.Printf("[API] Error decoding JSON: %v", err)
+		sendErrorResponse(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := api.keys.create(request.Name, request.Role)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[API] API key created: %s (%s)", apiKey.Name, apiKey.Role)
+	sendJSONResponse(w, apiKey, http.StatusCreated)
+}
+
+// deleteAPIKey revokes an API key
+func (api *APIServer) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log.Printf("[API] Handler: deleteAPIKey called with ID: %s", id)
+
+	if err := api.keys.remove(id); err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package restapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// testBootstrapKey is the admin key from the Corefile in the tests
+const testBootstrapKey = "bootstrap-key-of-at-least-32-characters"
+
+func TestAuthMiddleware(t *testing.T) {
+	keys, err := loadKeyStore(filepath.Join(t.TempDir(), apiKeysFile), testBootstrapKey)
+	if err != nil {
+		t.Fatalf("Expected no error loading the keys, got %v", err)
+	}
+	readKey, err := keys.create("dashboard", RoleRead)
+	if err != nil {
+		t.Fatalf("Expected no error creating a read key, got %v", err)
+	}
+	adminKey, err := keys.create("automation", RoleAdmin)
+	if err != nil {
+		t.Fatalf("Expected no error creating an admin key, got %v", err)
+	}
+	revokedKey, err := keys.create("old", RoleAdmin)
+	if err != nil {
+		t.Fatalf("Expected no error creating a key, got %v", err)
+	}
+	if err := keys.remove(revokedKey.ID); err != nil {
+		t.Fatalf("Expected no error removing a key, got %v", err)
+	}
+
+	api := &APIServer{keys: keys}
+	handler := api.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		method string
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{http.MethodGet, "/api/lists", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/lists", "Authorization", "Bearer not-a-key", http.StatusUnauthorized},
+		{http.MethodGet, "/api/lists", "Authorization", "Basic " + adminKey.Key, http.StatusUnauthorized},
+		{http.MethodGet, "/api/lists", "X-API-Key", revokedKey.Key, http.StatusUnauthorized},
+		{http.MethodGet, "/api/lists", "Authorization", "Bearer " + readKey.Key, http.StatusOK},
+		{http.MethodPost, "/api/lists/blocklist", "Authorization", "Bearer " + readKey.Key, http.StatusForbidden},
+		{http.MethodDelete, "/api/clients/10.0.0.1", "X-API-Key", readKey.Key, http.StatusForbidden},
+		{http.MethodGet, "/api/keys", "X-API-Key", readKey.Key, http.StatusForbidden},
+		{http.MethodPost, "/api/lists/blocklist", "Authorization", "Bearer " + adminKey.Key, http.StatusOK},
+		{http.MethodGet, "/api/keys", "X-API-Key", adminKey.Key, http.StatusOK},
+		{http.MethodPost, "/api/keys", "Authorization", "bearer " + testBootstrapKey, http.StatusOK},
+	}
+
+	for i, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("Test %d: expected %s %s to get %d, got %d", i, tc.method, tc.path, tc.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Test %d: expected a WWW-Authenticate header", i)
+		}
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	api := &APIServer{AuthDisabled: true}
+	handler := api.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/lists/blocklist", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected requests without a key to pass, got %d", w.Code)
+	}
+}
+
+func TestKeyStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), apiKeysFile)
+	keys, _ := loadKeyStore(path, "")
+	if !keys.empty() {
+		t.Fatalf("Expected no keys without a bootstrap key or file")
+	}
+	created, err := keys.create("dashboard", RoleRead)
+	if err != nil {
+		t.Fatalf("Expected no error creating a key, got %v", err)
+	}
+	if _, err := keys.create("dashboard", "owner"); err == nil {
+		t.Errorf("Expected an error creating a key with an unknown role")
+	}
+
+	// Only the hash is stored, and the key is accepted after a restart
+	reloaded, err := loadKeyStore(path, "")
+	if err != nil {
+		t.Fatalf("Expected no error reloading the keys, got %v", err)
+	}
+	for _, apiKey := range reloaded.list() {
+		if apiKey.Key != "" || apiKey.Hash != "" {
+			t.Errorf("Expected listed keys without key or hash, got %+v", apiKey)
+		}
+	}
+	if role, ok := reloaded.authenticate(created.Key); !ok || role != RoleRead {
+		t.Errorf("Expected the key to be accepted with the read role after a reload, got %q, %v", role, ok)
+	}
+}
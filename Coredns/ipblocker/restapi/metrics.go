@@ -0,0 +1,73 @@
+package restapi
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// requestCount counts the API requests, exported on the endpoint of the
+// metrics plugin
+var requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "ipblocker",
+	Name:      "api_requests_total",
+	Help:      "Counter of REST API requests by route and status code.",
+}, []string{"filter", "method", "route", "code"})
+
+// routePattern matches the pattern of a route variable, e.g. ":[0-9]+" in
+// "{id:[0-9]+}"
+var routePattern = regexp.MustCompile(`:[^{}]*}`)
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(data)
+}
+
+// Unwrap returns the wrapped writer, so http.ResponseController can flush
+// streams through the recorder
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// metricsMiddleware counts requests by the route they matched, so that the
+// client addresses and list names in paths do not become labels
+func (api *APIServer) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = routePattern.ReplaceAllString(template, "}")
+			}
+		}
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		requestCount.WithLabelValues(api.FilterName, r.Method, route, strconv.Itoa(sr.status)).Inc()
+	})
+}
@@ -0,0 +1,777 @@
+package ipblocker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/ipblocker/dnslookup"
+	"github.com/coredns/coredns/plugin/ipblocker/querylog"
+	"github.com/coredns/coredns/plugin/ipblocker/restapi"
+	"github.com/coredns/coredns/plugin/ipblocker/stats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default configuration paths and API address
+const (
+	defaultConfigPath   = "/clients.json"
+	defaultBlocklistDir = "/blocklists"
+	defaultWhitelistDir = "/whitelists"
+	defaultIPBlockDir   = "/ipblocklists"
+	defaultAPIAddress   = ":8099"
+	defaultFilterName   = "default"
+	statsFile           = "stats.json" // Statistics, next to the client configuration
+	minAPIKeyLength     = 32           // Shortest bootstrap key accepted for the REST API
+)
+
+// config holds the settings parsed from an ipblocker Corefile block
+type config struct {
+	filterConfig
+	BlockResponse  *BlockResponse  // Answer for blocked queries in this server block
+	Identification *Identification // How clients of this server block are identified
+}
+
+// filterConfig holds the settings of a DNS filter, which all server blocks
+// sharing the filter must agree on
+type filterConfig struct {
+	FilterName   string // Name under which the DNS filter is shared between server blocks
+	ConfigPath   string // Path of the client configuration file
+	BlocklistDir string // Directory containing the blocklists
+	WhitelistDir string // Directory containing the whitelists
+	IPBlockDir   string // Directory containing the IP blocklists
+	APIAddress   string // Listen address of the REST API, empty if disabled
+	APIKey       string // Bootstrap admin key of the REST API, "off" disables authentication
+	Watch        bool   // Reload the client configuration and lists when they change
+
+	// Policy for clients without a configuration as written in the Corefile,
+	// e.g. "template blocklist blocklist/ads", empty for the default
+	UnknownClients string
+
+	QueryLogPath     string // Path of the query log, empty if disabled
+	QueryLogMaxSize  int64  // Size in bytes at which the query log is rotated
+	QueryLogMaxFiles int    // Number of query log files kept, including the current one
+}
+
+// init registers the plugin with CoreDNS
+func init() {
+	plugin.Register("ipblocker", setup)
+}
+
+// setup is the function called by CoreDNS when loading the plugin
+func setup(c *caddy.Controller) error {
+	cfg, err := parseConfig(c)
+	if err != nil {
+		return plugin.Error("ipblocker", err)
+	}
+
+	shared, err := acquireFilter(cfg)
+	if err != nil {
+		return plugin.Error("ipblocker", err)
+	}
+	c.OnShutdown(func() error {
+		return releaseFilter(shared)
+	})
+
+	// On a reload, the filters of this instance are handed over to the new
+	// one, or restored if it fails to start
+	c.OnRestart(retireFilters)
+	c.OnRestartFailed(restoreFilters)
+
+	// Accept DoH queries with a client ID in the path
+	if cfg.Identification.DoH {
+		dnsserver.GetConfig(c).HTTPRequestValidateFunc = validDoHPath
+	}
+
+	// Add the plugin to CoreDNS, every server block gets its own handler
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return shared.handler(next, cfg)
+	})
+
+	return nil
+}
+
+// parseConfig parses the ipblocker Corefile block:
+//
+//	ipblocker {
+//	    filter vpn
+//	    config /etc/coredns/clients.json
+//	    blocklists /var/lib/ipblocker/blocklists
+//	    whitelists /var/lib/ipblocker/whitelists
+//	    ipblocklists /var/lib/ipblocker/ipblocklists
+//	    api 127.0.0.1:8099
+//	    api_key {$IPBLOCKER_API_KEY}
+//	    watch on
+//	    block_response sinkhole 192.168.1.2
+//	    block_ttl 300
+//	    unknown_clients template blocklist blocklist/ads ipblocklist/malware
+//	    identify ecs
+//	    identify doh
+//	    identify dot dns.example.com
+//	    trusted_proxies 10.0.0.53 192.168.1.0/24
+//	    querylog /var/log/ipblocker/queries.jsonl 100 5
+//	}
+func parseConfig(c *caddy.Controller) (*config, error) {
+	cfg := &config{
+		filterConfig: filterConfig{
+			FilterName:   defaultFilterName,
+			ConfigPath:   defaultConfigPath,
+			BlocklistDir: defaultBlocklistDir,
+			WhitelistDir: defaultWhitelistDir,
+			IPBlockDir:   defaultIPBlockDir,
+			APIAddress:   defaultAPIAddress,
+			Watch:        true,
+		},
+		BlockResponse:  NewBlockResponse(),
+		Identification: &Identification{},
+	}
+
+	for c.Next() {
+		// The directive itself takes no arguments, everything goes into the
+		// block. RemainingArgs stops at the opening brace, NextArg would not.
+		if len(c.RemainingArgs()) > 0 {
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "filter":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				cfg.FilterName = args[0]
+			case "config":
+				path, err := parsePath(c)
+				if err != nil {
+					return nil, err
+				}
+				cfg.ConfigPath = path
+			case "blocklists":
+				path, err := parsePath(c)
+				if err != nil {
+					return nil, err
+				}
+				cfg.BlocklistDir = path
+			case "whitelists":
+				path, err := parsePath(c)
+				if err != nil {
+					return nil, err
+				}
+				cfg.WhitelistDir = path
+			case "ipblocklists":
+				path, err := parsePath(c)
+				if err != nil {
+					return nil, err
+				}
+				cfg.IPBlockDir = path
+			case "api":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				addr, err := parseAPIAddress(args[0])
+				if err != nil {
+					return nil, c.Errf("invalid api address '%s': %v", args[0], err)
+				}
+				cfg.APIAddress = addr
+			case "api_key":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				// The key is not repeated in the error, it would end up in the logs
+				if args[0] != "off" && len(args[0]) < minAPIKeyLength {
+					return nil, c.Errf("api_key must be 'off' or at least %d characters long", minAPIKeyLength)
+				}
+				cfg.APIKey = args[0]
+			case "watch":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				switch args[0] {
+				case "on":
+					cfg.Watch = true
+				case "off":
+					cfg.Watch = false
+				default:
+					return nil, c.Errf("watch must be 'on' or 'off', got '%s'", args[0])
+				}
+			case "block_response":
+				if err := parseBlockResponse(c, cfg.BlockResponse); err != nil {
+					return nil, err
+				}
+			case "block_ttl":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(args[0], 10, 32)
+				if err != nil {
+					return nil, c.Errf("invalid block_ttl '%s': %v", args[0], err)
+				}
+				cfg.BlockResponse.TTL = uint32(ttl)
+			case "identify":
+				if err := parseIdentify(c, cfg.Identification); err != nil {
+					return nil, err
+				}
+			case "trusted_proxies":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, arg := range args {
+					prefix, err := parseTrustedProxy(arg)
+					if err != nil {
+						return nil, c.Errf("invalid trusted proxy '%s': %v", arg, err)
+					}
+					cfg.Identification.TrustedProxies = append(cfg.Identification.TrustedProxies, prefix)
+				}
+			case "unknown_clients":
+				args := c.RemainingArgs()
+				if _, err := dnslookup.ParseUnknownClientPolicy(args); err != nil {
+					return nil, c.Errf("invalid unknown_clients: %v", err)
+				}
+				cfg.UnknownClients = strings.Join(args, " ")
+			case "querylog":
+				if err := parseQueryLog(c, &cfg.filterConfig); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, c.Errf("unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if err := cfg.validateDirs(); err != nil {
+		return nil, err
+	}
+	if cfg.Identification.ECS && len(cfg.Identification.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("identify ecs requires trusted_proxies")
+	}
+
+	return cfg, nil
+}
+
+// validateDirs checks that the list directories differ, and that the client
+// configuration is not in one of them: every file in a list directory is loaded
+// as a list
+func (cfg *filterConfig) validateDirs() error {
+	if cfg.BlocklistDir == cfg.WhitelistDir || cfg.BlocklistDir == cfg.IPBlockDir || cfg.WhitelistDir == cfg.IPBlockDir {
+		return fmt.Errorf("blocklists, whitelists and ipblocklists must use different directories")
+	}
+	if dir := cfg.configDir(); cfg.usesListDir(dir) {
+		return fmt.Errorf("config %s must not be in a list directory", cfg.ConfigPath)
+	}
+	return nil
+}
+
+// configDir returns the directory of the client configuration, which also
+// holds the profiles, overrides, policy, subscriptions, statistics and API keys
+// of the filter
+func (cfg *filterConfig) configDir() string {
+	return filepath.Dir(cfg.ConfigPath)
+}
+
+// usesListDir checks if dir is one of the list directories
+func (cfg *filterConfig) usesListDir(dir string) bool {
+	return dir == cfg.BlocklistDir || dir == cfg.WhitelistDir || dir == cfg.IPBlockDir
+}
+
+// parsePath reads the single path argument of a directive
+func parsePath(c *caddy.Controller) (string, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return "", c.ArgErr()
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return "", c.Errf("invalid path '%s': %v", args[0], err)
+	}
+	return path, nil
+}
+
+// parseBlockResponse reads "block_response MODE [ADDRESS...]", where the
+// addresses set the IPv4 and/or IPv6 sinkhole target
+func parseBlockResponse(c *caddy.Controller, br *BlockResponse) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	mode := args[0]
+	if !dnslookup.IsValidBlockResponse(mode) {
+		return c.Errf("unknown block_response '%s'", mode)
+	}
+	if mode != dnslookup.BlockResponseSinkhole && len(args) > 1 {
+		return c.Errf("block_response %s takes no addresses", mode)
+	}
+
+	for _, arg := range args[1:] {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return c.Errf("invalid sinkhole address '%s'", arg)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			br.SinkholeV4 = ip4
+		} else {
+			br.SinkholeV6 = ip
+		}
+	}
+
+	br.Mode = mode
+	return nil
+}
+
+// parseIdentify reads "identify ecs", "identify doh" or "identify dot
+// SERVERNAME", each enabling a source clients are identified from
+func parseIdentify(c *caddy.Controller, id *Identification) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	switch args[0] {
+	case sourceECS:
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		id.ECS = true
+	case sourceDoH:
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		id.DoH = true
+	case sourceDoT:
+		if len(args) != 2 {
+			return c.Errf("identify dot needs the server name, e.g. 'identify dot dns.example.com'")
+		}
+		serverName := strings.ToLower(strings.TrimSuffix(args[1], "."))
+		if serverName == "" || strings.Contains(serverName, "/") {
+			return c.Errf("invalid dot server name '%s'", args[1])
+		}
+		id.DoTServerName = serverName
+	default:
+		return c.Errf("unknown identify source '%s', expected ecs, doh or dot", args[0])
+	}
+	return nil
+}
+
+// parseQueryLog reads "querylog PATH [MAX_SIZE [MAX_FILES]]", where the
+// query log is rotated at MAX_SIZE megabytes and MAX_FILES files are kept.
+// "querylog off" disables it.
+func parseQueryLog(c *caddy.Controller, cfg *filterConfig) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+
+	if args[0] == "off" {
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		cfg.QueryLogPath, cfg.QueryLogMaxSize, cfg.QueryLogMaxFiles = "", 0, 0
+		return nil
+	}
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return c.Errf("invalid path '%s': %v", args[0], err)
+	}
+	cfg.QueryLogPath = path
+	cfg.QueryLogMaxSize = querylog.DefaultMaxSize
+	cfg.QueryLogMaxFiles = querylog.DefaultMaxFiles
+
+	if len(args) > 1 {
+		size, err := strconv.Atoi(args[1])
+		if err != nil || size < 1 {
+			return c.Errf("invalid querylog size '%s', expected megabytes", args[1])
+		}
+		cfg.QueryLogMaxSize = int64(size) << 20
+	}
+	if len(args) > 2 {
+		files, err := strconv.Atoi(args[2])
+		if err != nil || files < 1 {
+			return c.Errf("invalid querylog file count '%s'", args[2])
+		}
+		cfg.QueryLogMaxFiles = files
+	}
+	return nil
+}
+
+// parseTrustedProxy parses the address or network of a trusted forwarder
+func parseTrustedProxy(arg string) (netip.Prefix, error) {
+	if strings.Contains(arg, "/") {
+		prefix, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(arg)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseAPIAddress validates the API listen address; "off" disables the API
+func parseAPIAddress(addr string) (string, error) {
+	if addr == "off" {
+		return "", nil
+	}
+
+	// Allow a bare port for convenience
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = ":" + addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("host must be an IP address: %s", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("port out of range: %s", port)
+	}
+
+	return addr, nil
+}
+
+// sharedFilter is a DNS filter with its API server, query log, live query
+// stream and statistics, shared by all server blocks that use the same filter
+// name
+type sharedFilter struct {
+	cfg      filterConfig
+	filter   *dnslookup.DNSFilter
+	api      *restapi.APIServer
+	queryLog *querylog.Log
+	stream   *querylog.Stream
+	stats    *stats.Store
+	lists    *listCollector
+	exported bool // lists is registered with Prometheus
+	refs     int  // Server blocks using the filter
+	oldRefs  int  // References before a reload, restored if it fails
+}
+
+// handler returns the plugin instance of a server block using the filter
+func (shared *sharedFilter) handler(next plugin.Handler, cfg *config) *IPBlocker {
+	return &IPBlocker{
+		Next:           next,
+		FilterName:     cfg.FilterName,
+		APIServer:      shared.api,
+		DNSFilter:      shared.filter,
+		QueryLog:       shared.queryLog,
+		Stream:         shared.stream,
+		Stats:          shared.stats,
+		BlockResponse:  cfg.BlockResponse,
+		Identification: cfg.Identification,
+	}
+}
+
+// Registry of the DNS filters in use, keyed by filter name. During a reload,
+// the filters of the running instance move to retired, and the new instance
+// takes over those whose settings did not change.
+var (
+	filtersMutex sync.Mutex
+	filters      = make(map[string]*sharedFilter)
+	retired      map[string]*sharedFilter // nil unless a reload is in progress
+)
+
+// acquireFilter returns the shared filter for cfg.FilterName, creating and
+// initializing it on first use. Server blocks sharing a filter must agree on
+// its settings. Two filters cannot share a configuration directory, as the
+// files next to the client configuration hold the state of the filter, or use
+// it as a list directory; nor can they share a query log or listen on the same
+// API address.
+func acquireFilter(cfg *config) (*sharedFilter, error) {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+
+	if shared, exists := filters[cfg.FilterName]; exists {
+		if shared.cfg != cfg.filterConfig {
+			return nil, fmt.Errorf("filter %s is already defined with different settings", cfg.FilterName)
+		}
+		shared.refs++
+		return shared, nil
+	}
+
+	for name, other := range filters {
+		if other.cfg.configDir() == cfg.configDir() {
+			return nil, fmt.Errorf("config directory %s is already used by filter %s", cfg.configDir(), name)
+		}
+		if other.cfg.usesListDir(cfg.configDir()) {
+			return nil, fmt.Errorf("config directory %s is a list directory of filter %s", cfg.configDir(), name)
+		}
+		if cfg.usesListDir(other.cfg.configDir()) {
+			return nil, fmt.Errorf("list directory %s is the config directory of filter %s", other.cfg.configDir(), name)
+		}
+		if cfg.APIAddress != "" && other.cfg.APIAddress == cfg.APIAddress {
+			return nil, fmt.Errorf("api address %s is already used by filter %s", cfg.APIAddress, name)
+		}
+		if cfg.QueryLogPath != "" && other.cfg.QueryLogPath == cfg.QueryLogPath {
+			return nil, fmt.Errorf("querylog %s is already used by filter %s", cfg.QueryLogPath, name)
+		}
+	}
+
+	// Take over the filter of the instance being replaced if its settings did
+	// not change, so a reload keeps the loaded lists and counters
+	if shared, exists := retired[cfg.FilterName]; exists && shared.cfg == cfg.filterConfig {
+		log.Printf("IPBlocker keeping filter %s", cfg.FilterName)
+		shared.refs++
+		shared.startAPI()
+		filters[cfg.FilterName] = shared
+		return shared, nil
+	}
+
+	// Save the statistics a retired filter with the same files collected
+	// since its last save, before they are loaded again
+	for _, old := range retired {
+		if old.cfg.configDir() == cfg.configDir() {
+			if err := old.stats.Save(); err != nil {
+				log.Printf("Warning: Could not save statistics of filter %s: %v", old.cfg.FilterName, err)
+			}
+		}
+	}
+
+	log.Printf("IPBlocker initializing filter %s", cfg.FilterName)
+	shared := &sharedFilter{cfg: cfg.filterConfig, refs: 1}
+	if dir := cfg.configDir(); filepath.Dir(dir) == dir {
+		log.Printf("Warning: Filter %s keeps its state next to %s in %s, use a dedicated directory for the config", cfg.FilterName, cfg.ConfigPath, dir)
+	}
+
+	// Ensure directories exist
+	for _, dir := range []string{
+		cfg.configDir(),
+		cfg.BlocklistDir,
+		cfg.WhitelistDir,
+		cfg.IPBlockDir,
+	} {
+		if err := ensureDirExists(dir); err != nil {
+			log.Printf("Warning: Failed to create directory %s: %v", dir, err)
+		}
+	}
+
+	// Create DNS filter
+	shared.filter = dnslookup.NewDNSFilter(cfg.ConfigPath, cfg.BlocklistDir, cfg.WhitelistDir, cfg.IPBlockDir)
+	if cfg.UnknownClients != "" {
+		// Already validated by parseConfig
+		policy, _ := dnslookup.ParseUnknownClientPolicy(strings.Fields(cfg.UnknownClients))
+		shared.filter.SetDefaultUnknownClientPolicy(policy)
+	}
+	if err := shared.filter.Initialize(); err != nil {
+		log.Printf("Error initializing DNS filter: %v", err)
+	}
+	shared.filter.StartRefresher()
+	shared.lists = newListCollector(cfg.FilterName, shared.filter)
+	if old, exists := retired[cfg.FilterName]; exists {
+		old.unexportLists() // Replaced by this filter, with the same labels
+	}
+	shared.exportLists()
+	if cfg.Watch {
+		if err := shared.filter.Watch(); err != nil {
+			log.Printf("Error watching DNS filter files: %v", err)
+		}
+	}
+
+	// Open the query log if enabled
+	if cfg.QueryLogPath != "" {
+		if err := ensureDirExists(filepath.Dir(cfg.QueryLogPath)); err != nil {
+			log.Printf("Warning: Failed to create directory %s: %v", filepath.Dir(cfg.QueryLogPath), err)
+		}
+		queryLog, err := querylog.Open(cfg.QueryLogPath, cfg.QueryLogMaxSize, cfg.QueryLogMaxFiles)
+		if err != nil {
+			log.Printf("Error opening query log: %v", err)
+		}
+		shared.queryLog = queryLog
+	}
+
+	shared.stream = querylog.NewStream()
+
+	// Load the statistics of previous runs
+	shared.stats = stats.New(filepath.Join(cfg.configDir(), statsFile))
+	if err := shared.stats.Load(); err != nil {
+		log.Printf("Warning: Could not load statistics, starting empty: %v", err)
+	}
+
+	// Initialize REST API unless it was disabled
+	if cfg.APIAddress == "" {
+		log.Printf("IPBlocker REST API is disabled for filter %s", cfg.FilterName)
+	} else {
+		shared.api = restapi.NewAPIServer(shared.filter)
+		shared.api.QueryLog = shared.queryLog
+		shared.api.Stream = shared.stream
+		shared.api.Stats = shared.stats
+		shared.api.FilterName = cfg.FilterName
+		if cfg.APIKey == "off" {
+			shared.api.AuthDisabled = true
+		} else {
+			shared.api.BootstrapKey = cfg.APIKey
+		}
+		shared.startAPI()
+	}
+
+	filters[cfg.FilterName] = shared
+	return shared, nil
+}
+
+// releaseFilter drops one reference to a shared filter and closes it once no
+// server block uses it anymore. The instance being replaced by a reload
+// releases its filters only after the new one started, which completes the
+// reload.
+func releaseFilter(shared *sharedFilter) error {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+
+	retired = nil
+
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+
+	if filters[shared.cfg.FilterName] == shared {
+		delete(filters, shared.cfg.FilterName)
+	}
+	return shared.close()
+}
+
+// retireFilters prepares a reload: the filters of the running instance keep
+// serving its queries, but stop their API servers so the new instance can
+// listen on the same addresses. Called once per server block, so only the
+// first call does anything.
+func retireFilters() error {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+
+	if retired != nil {
+		return nil
+	}
+
+	retired = filters
+	filters = make(map[string]*sharedFilter)
+	for _, shared := range retired {
+		shared.oldRefs = shared.refs
+		if err := shared.stopAPI(); err != nil {
+			log.Printf("Error stopping API server of filter %s: %v", shared.cfg.FilterName, err)
+		}
+	}
+	return nil
+}
+
+// restoreFilters undoes retireFilters after a failed reload: the filters the
+// new instance created are closed, and the retired ones get back their
+// references and API servers
+func restoreFilters() error {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+
+	if retired == nil {
+		return nil
+	}
+
+	for name, shared := range filters {
+		if retired[name] != shared {
+			if err := shared.close(); err != nil {
+				log.Printf("Error closing filter %s: %v", name, err)
+			}
+		}
+	}
+
+	filters = retired
+	retired = nil
+	for _, shared := range filters {
+		shared.refs = shared.oldRefs
+		shared.exportLists()
+		shared.startAPI()
+	}
+	return nil
+}
+
+// close stops the file watcher, query log, statistics, list metrics and API
+// server of a filter
+func (shared *sharedFilter) close() error {
+	name := shared.cfg.FilterName
+
+	shared.unexportLists()
+	if err := shared.filter.Close(); err != nil {
+		log.Printf("Error closing DNS filter %s: %v", name, err)
+	}
+	if shared.queryLog != nil {
+		if err := shared.queryLog.Close(); err != nil {
+			log.Printf("Error closing query log of filter %s: %v", name, err)
+		}
+	}
+	if err := shared.stats.Close(); err != nil {
+		log.Printf("Error saving statistics of filter %s: %v", name, err)
+	}
+	return shared.stopAPI()
+}
+
+// exportLists registers the list size metrics of a filter
+func (shared *sharedFilter) exportLists() {
+	if shared.exported {
+		return
+	}
+	if err := prometheus.Register(shared.lists); err != nil {
+		log.Printf("Warning: Could not register list metrics of filter %s: %v", shared.cfg.FilterName, err)
+		return
+	}
+	shared.exported = true
+}
+
+// unexportLists unregisters the list size metrics of a filter. Collectors are
+// matched by their metrics, so this must not be done twice: the second time
+// would remove the collector of a filter with the same name.
+func (shared *sharedFilter) unexportLists() {
+	if shared.exported {
+		prometheus.Unregister(shared.lists)
+		shared.exported = false
+	}
+}
+
+// startAPI starts the API server of a filter, unless it is disabled or
+// already running
+func (shared *sharedFilter) startAPI() {
+	if shared.api == nil {
+		return
+	}
+
+	cfg := shared.cfg
+	if err := shared.api.Initialize(cfg.ConfigPath, cfg.BlocklistDir, cfg.WhitelistDir, cfg.IPBlockDir, cfg.APIAddress); err != nil {
+		log.Printf("Error initializing API server: %v", err)
+	}
+}
+
+// stopAPI stops the API server of a filter, if it has one
+func (shared *sharedFilter) stopAPI() error {
+	if shared.api == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return shared.api.Shutdown(ctx)
+}
+
+// ensureDirExists creates a directory if it doesn't exist
+func ensureDirExists(dir string) error {
+	log.Printf("Ensuring directory exists: %s", dir)
+	return os.MkdirAll(dir, 0755)
+}
@@ -0,0 +1,309 @@
+package ipblocker
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/ipblocker/querylog"
+)
+
+// reloadFilter acquires a filter, starts a reload and acquires the filter of
+// the new instance with the settings changed by change
+func reloadFilter(t *testing.T, change func(cfg *config)) (old, new *sharedFilter) {
+	t.Helper()
+
+	cfg := testConfig(t)
+	old, err := acquireFilter(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error acquiring the filter, got %v", err)
+	}
+	if err := retireFilters(); err != nil {
+		t.Fatalf("Expected no error retiring the filters, got %v", err)
+	}
+
+	changed := *cfg
+	change(&changed)
+	new, err = acquireFilter(&changed)
+	if err != nil {
+		t.Fatalf("Expected no error acquiring the filter during a reload, got %v", err)
+	}
+	return old, new
+}
+
+func TestReloadFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+		kept   bool // The new instance takes over the old filter
+	}{
+		{"unchanged", func(cfg *config) {}, true},
+		{"settings", func(cfg *config) { cfg.QueryLogMaxFiles++ }, false},
+		{"renamed", func(cfg *config) { cfg.FilterName += "-renamed" }, false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old, new := reloadFilter(t, tc.change)
+			if (old == new) != tc.kept {
+				t.Fatalf("Test %d: expected the filter to be kept %v, got %v", i, tc.kept, old == new)
+			}
+
+			// The old instance keeps serving until it shuts down
+			if old.filter.CheckDomain("10.240.0.1", "ads.example.com") {
+				t.Errorf("Test %d: expected the old filter to block ads.example.com", i)
+			}
+
+			// Shutting down the old instance completes the reload
+			if err := releaseFilter(old); err != nil {
+				t.Errorf("Test %d: expected no error releasing the old filter, got %v", i, err)
+			}
+			if filters[new.cfg.FilterName] != new || retired != nil {
+				t.Errorf("Test %d: expected only the new filter to be registered", i)
+			}
+			if err := releaseFilter(new); err != nil {
+				t.Errorf("Test %d: expected no error releasing the new filter, got %v", i, err)
+			}
+			if len(filters) != 0 {
+				t.Errorf("Test %d: expected no filters after shutdown, got %d", i, len(filters))
+			}
+		})
+	}
+}
+
+func TestReloadFilterFailed(t *testing.T) {
+	old, new := reloadFilter(t, func(cfg *config) { cfg.QueryLogMaxFiles++ })
+
+	if err := restoreFilters(); err != nil {
+		t.Fatalf("Expected no error restoring the filters, got %v", err)
+	}
+	if filters[old.cfg.FilterName] != old || old.refs != 1 {
+		t.Fatalf("Expected the old filter to be restored with 1 reference, got %d", old.refs)
+	}
+	if new.exported {
+		t.Errorf("Expected the list metrics of the new filter to be unregistered")
+	}
+	if !old.exported {
+		t.Errorf("Expected the list metrics of the old filter to be registered")
+	}
+
+	if err := releaseFilter(old); err != nil {
+		t.Errorf("Expected no error releasing the filter, got %v", err)
+	}
+	if len(filters) != 0 {
+		t.Errorf("Expected no filters after shutdown, got %d", len(filters))
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	apiKey := strings.Repeat("k", minAPIKeyLength)
+
+	tests := []struct {
+		input  string
+		change func(cfg *config) // Expected changes to the defaults
+		err    string
+	}{
+		// Paths and API
+		{"ipblocker", func(cfg *config) {}, ""},
+		{"ipblocker {\n}", func(cfg *config) {}, ""},
+		{`ipblocker {
+			filter vpn
+			config /etc/ipblocker/clients.json
+			blocklists /var/lib/ipblocker/blocklists
+			whitelists /var/lib/ipblocker/whitelists
+			ipblocklists /var/lib/ipblocker/ipblocklists
+			api 127.0.0.1:9000
+			watch off
+		}`, func(cfg *config) {
+			cfg.FilterName = "vpn"
+			cfg.ConfigPath = "/etc/ipblocker/clients.json"
+			cfg.BlocklistDir = "/var/lib/ipblocker/blocklists"
+			cfg.WhitelistDir = "/var/lib/ipblocker/whitelists"
+			cfg.IPBlockDir = "/var/lib/ipblocker/ipblocklists"
+			cfg.APIAddress = "127.0.0.1:9000"
+			cfg.Watch = false
+		}, ""},
+		{"ipblocker {\n api 9000\n}", func(cfg *config) { cfg.APIAddress = ":9000" }, ""},
+		{"ipblocker {\n api [::1]:9000\n}", func(cfg *config) { cfg.APIAddress = "[::1]:9000" }, ""},
+		{"ipblocker {\n api off\n}", func(cfg *config) { cfg.APIAddress = "" }, ""},
+		{"ipblocker vpn {\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n filter a b\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n config\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n api localhost:9000\n}", nil, "host must be an IP address"},
+		{"ipblocker {\n api 70000\n}", nil, "port out of range"},
+		{"ipblocker {\n blocklists /lists\n whitelists /lists\n}", nil, "different directories"},
+		{"ipblocker {\n config /blocklists/clients.json\n}", nil, "list directory"},
+		{"ipblocker {\n watch maybe\n}", nil, "watch must be"},
+		{"ipblocker {\n listen :53\n}", nil, "unknown property 'listen'"},
+
+		// API key
+		{"ipblocker {\n api_key " + apiKey + "\n}", func(cfg *config) { cfg.APIKey = apiKey }, ""},
+		{"ipblocker {\n api_key off\n}", func(cfg *config) { cfg.APIKey = "off" }, ""},
+		{"ipblocker {\n api_key " + apiKey[1:] + "\n}", nil, "at least 32 characters"},
+		{"ipblocker {\n api_key\n}", nil, "Wrong argument count"},
+
+		// Block response
+		{"ipblocker {\n block_response sinkhole 192.168.1.2 fd00::2\n block_ttl 300\n}", func(cfg *config) {
+			cfg.BlockResponse.Mode = "sinkhole"
+			cfg.BlockResponse.SinkholeV4 = net.ParseIP("192.168.1.2").To4()
+			cfg.BlockResponse.SinkholeV6 = net.ParseIP("fd00::2")
+			cfg.BlockResponse.TTL = 300
+		}, ""},
+		{"ipblocker {\n block_response refused\n}", func(cfg *config) { cfg.BlockResponse.Mode = "refused" }, ""},
+		{"ipblocker {\n block_response\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n block_response redirect\n}", nil, "unknown block_response"},
+		{"ipblocker {\n block_response nxdomain 192.168.1.2\n}", nil, "takes no addresses"},
+		{"ipblocker {\n block_response sinkhole sinkhole.local\n}", nil, "invalid sinkhole address"},
+		{"ipblocker {\n block_ttl -1\n}", nil, "invalid block_ttl"},
+		{"ipblocker {\n block_ttl 4294967296\n}", nil, "invalid block_ttl"},
+
+		// Client identification
+		{"ipblocker {\n identify ecs\n trusted_proxies 10.0.0.53 192.168.1.0/24 ::ffff:10.0.0.54\n}", func(cfg *config) {
+			cfg.Identification.ECS = true
+			cfg.Identification.TrustedProxies = []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.53/32"), netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("10.0.0.54/32")}
+		}, ""},
+		{"ipblocker {\n identify doh\n identify dot DNS.Example.com.\n}", func(cfg *config) {
+			cfg.Identification.DoH = true
+			cfg.Identification.DoTServerName = "dns.example.com"
+		}, ""},
+		{"ipblocker {\n identify ecs\n}", nil, "requires trusted_proxies"},
+		{"ipblocker {\n identify ecs doh\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n identify dot\n}", nil, "needs the server name"},
+		{"ipblocker {\n identify sni\n}", nil, "unknown identify source"},
+		{"ipblocker {\n trusted_proxies\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n trusted_proxies 10.0.0.0/33\n}", nil, "invalid trusted proxy"},
+
+		// Unknown clients
+		{"ipblocker {\n unknown_clients allow\n}", func(cfg *config) { cfg.UnknownClients = "allow" }, ""},
+		{"ipblocker {\n unknown_clients template blocklist blocklist/ads\n}", func(cfg *config) {
+			cfg.UnknownClients = "template blocklist blocklist/ads"
+		}, ""},
+		{"ipblocker {\n unknown_clients\n}", nil, "invalid unknown_clients"},
+		{"ipblocker {\n unknown_clients block\n}", nil, "invalid unknown_clients"},
+
+		// Query log
+		{"ipblocker {\n querylog /var/log/ipblocker/queries.jsonl\n}", func(cfg *config) {
+			cfg.QueryLogPath = "/var/log/ipblocker/queries.jsonl"
+			cfg.QueryLogMaxSize = querylog.DefaultMaxSize
+			cfg.QueryLogMaxFiles = querylog.DefaultMaxFiles
+		}, ""},
+		{"ipblocker {\n querylog /var/log/ipblocker/queries.jsonl 100 5\n}", func(cfg *config) {
+			cfg.QueryLogPath = "/var/log/ipblocker/queries.jsonl"
+			cfg.QueryLogMaxSize = 100 << 20
+			cfg.QueryLogMaxFiles = 5
+		}, ""},
+		{"ipblocker {\n querylog /queries.jsonl\n querylog off\n}", func(cfg *config) {}, ""},
+		{"ipblocker {\n querylog\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n querylog off 100\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n querylog /queries.jsonl 100 5 1\n}", nil, "Wrong argument count"},
+		{"ipblocker {\n querylog /queries.jsonl 0\n}", nil, "invalid querylog size"},
+		{"ipblocker {\n querylog /queries.jsonl 1.5\n}", nil, "invalid querylog size"},
+		{"ipblocker {\n querylog /queries.jsonl 100 0\n}", nil, "invalid querylog file count"},
+	}
+
+	for i, tc := range tests {
+		cfg, err := parseConfig(caddy.NewTestController("dns", tc.input))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Test %d: expected error containing %q, got %v", i, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+			continue
+		}
+
+		expected := &config{
+			filterConfig: filterConfig{
+				FilterName:   defaultFilterName,
+				ConfigPath:   defaultConfigPath,
+				BlocklistDir: defaultBlocklistDir,
+				WhitelistDir: defaultWhitelistDir,
+				IPBlockDir:   defaultIPBlockDir,
+				APIAddress:   defaultAPIAddress,
+				Watch:        true,
+			},
+			BlockResponse:  NewBlockResponse(),
+			Identification: &Identification{},
+		}
+		tc.change(expected)
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Test %d: expected %+v with %+v and %+v, got %+v with %+v and %+v", i,
+				expected.filterConfig, expected.BlockResponse, expected.Identification, cfg.filterConfig, cfg.BlockResponse, cfg.Identification)
+		}
+	}
+}
+
+func TestValidateDirs(t *testing.T) {
+	tests := []struct {
+		config     string
+		blocklists string
+		whitelists string
+		err        string
+	}{
+		{"/etc/ipblocker/clients.json", "/blocklists", "/whitelists", ""},
+		{"/clients.json", "/blocklists", "/whitelists", ""},
+		{"/etc/ipblocker/clients.json", "/lists", "/lists", "different directories"},
+		{"/blocklists/clients.json", "/blocklists", "/whitelists", "list directory"},
+		{"/whitelists/clients.json", "/blocklists", "/whitelists", "list directory"},
+		{"/ipblocklists/clients.json", "/blocklists", "/whitelists", "list directory"},
+	}
+
+	for i, tc := range tests {
+		cfg := filterConfig{
+			ConfigPath:   tc.config,
+			BlocklistDir: tc.blocklists,
+			WhitelistDir: tc.whitelists,
+			IPBlockDir:   "/ipblocklists",
+		}
+		err := cfg.validateDirs()
+		if tc.err == "" && err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("Test %d: expected error containing %q, got %v", i, tc.err, err)
+		}
+	}
+}
+
+func TestAcquireFilterConflicts(t *testing.T) {
+	first, _ := newTestFilter(t)
+	dir := filepath.Dir(first.ConfigPath)
+
+	tests := []struct {
+		change func(cfg *config)
+		err    string
+	}{
+		{func(cfg *config) {}, ""},
+		{func(cfg *config) { cfg.ConfigPath = first.ConfigPath }, "already used"},
+		{func(cfg *config) { cfg.ConfigPath = filepath.Join(dir, "other.json") }, "already used"},
+		{func(cfg *config) { cfg.ConfigPath = filepath.Join(first.BlocklistDir, "clients.json") }, "is a list directory"},
+		{func(cfg *config) { cfg.WhitelistDir = dir }, "is the config directory"},
+		{func(cfg *config) { cfg.QueryLogPath = first.QueryLogPath }, "already used"},
+	}
+
+	for i, tc := range tests {
+		cfg := testConfig(t)
+		cfg.FilterName = "second"
+		tc.change(cfg)
+
+		shared, err := acquireFilter(cfg)
+		if err == nil {
+			if err := releaseFilter(shared); err != nil {
+				t.Errorf("Test %d: expected no error releasing the filter, got %v", i, err)
+			}
+		}
+		if tc.err == "" && err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("Test %d: expected error containing %q, got %v", i, tc.err, err)
+		}
+	}
+}
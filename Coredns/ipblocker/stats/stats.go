@@ -0,0 +1,423 @@
+// Package stats keeps rolling statistics of the DNS queries handled by the
+// ipblocker plugin: per-minute counters for the last day and per-hour counters
+// with the most queried domains and most active clients for the last 30 days
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention and size limits of the statistics
+const (
+	MinuteRetention = 24 * time.Hour      // Per-minute buckets are kept this long
+	HourRetention   = 30 * 24 * time.Hour // Per-hour buckets are kept this long
+
+	saveInterval = 5 * time.Minute // Statistics are saved this often
+	maxHourKeys  = 10000           // Names counted per map in the current hour, more are left out of the top lists
+	maxKeptKeys  = 100             // Names kept per map once an hour is over
+	defaultTop   = 10
+	maxTop       = 100
+)
+
+// Bucket holds the counters of one minute or hour
+type Bucket struct {
+	Start   time.Time `json:"start"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+
+	// Queries by name, only in per-hour buckets
+	BlockedDomains map[string]uint64 `json:"blockedDomains,omitempty"`
+	AllowedDomains map[string]uint64 `json:"allowedDomains,omitempty"`
+	Clients        map[string]uint64 `json:"clients,omitempty"`
+}
+
+// Count is a name with its number of queries
+type Count struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// Point is the number of queries in one minute or hour of a timeline
+type Point struct {
+	Time    time.Time `json:"time"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+}
+
+// Summary is the statistics of a period
+type Summary struct {
+	Period            string    `json:"period"` // Length of the period, e.g. "24h"
+	From              time.Time `json:"from"`
+	To                time.Time `json:"to"`
+	Queries           uint64    `json:"queries"`
+	Allowed           uint64    `json:"allowed"`
+	Blocked           uint64    `json:"blocked"`
+	BlockRatio        float64   `json:"blockRatio"` // Share of blocked queries, 0 to 1
+	TopBlockedDomains []Count   `json:"topBlockedDomains"`
+	TopAllowedDomains []Count   `json:"topAllowedDomains"`
+	TopClients        []Count   `json:"topClients"`
+	Timeline          []Point   `json:"timeline"` // Per minute for periods up to a day, per hour otherwise
+}
+
+// Store keeps the statistics of a filter in memory and saves them to a file
+type Store struct {
+	path    string
+	minutes []Bucket // Oldest first
+	hours   []Bucket // Oldest first
+	dirty   bool     // Changed since the last save
+	mutex   sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// storeFile is the format of the statistics file
+type storeFile struct {
+	Minutes []Bucket `json:"minutes"`
+	Hours   []Bucket `json:"hours"`
+}
+
+// New returns an empty store that saves its statistics to path periodically
+func New(path string) *Store {
+	s := &Store{
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.saveLoop()
+	return s
+}
+
+// Load replaces the statistics with the ones saved in the file, if it exists
+func (s *Store) Load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading statistics: %v", err)
+	}
+
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error parsing statistics: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.minutes = dropBefore(file.Minutes, time.Now().Add(-MinuteRetention))
+	s.hours = dropBefore(file.Hours, time.Now().Add(-HourRetention))
+	for i := range s.hours {
+		initNames(&s.hours[i])
+	}
+	return nil
+}
+
+// Close stops saving periodically and saves the statistics a last time
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.Save()
+}
+
+// saveLoop saves changed statistics until the store is closed
+func (s *Store) saveLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("Warning: Could not save statistics: %v", err)
+			}
+		}
+	}
+}
+
+// Save writes the statistics to the file if they changed, e.g. before another
+// store loads them during a reload
+func (s *Store) Save() error {
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(storeFile{Minutes: s.minutes, Hours: s.hours})
+	s.dirty = false
+	s.mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("error encoding statistics: %v", err)
+	}
+
+	// Write a temporary file first, so a crash cannot leave a partial file
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true // Retry with the next save
+		s.mutex.Unlock()
+		return fmt.Errorf("error writing statistics: %v", err)
+	}
+	return nil
+}
+
+// Record counts a query of a client for a domain
+func (s *Store) Record(t time.Time, client, domain string, blocked bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	minute := bucket(&s.minutes, t.Truncate(time.Minute), MinuteRetention, false)
+	if minute == nil {
+		return // Beyond the retention
+	}
+	hour := bucket(&s.hours, t.Truncate(time.Hour), HourRetention, true)
+	if hour == nil {
+		return
+	}
+
+	minute.Queries++
+	hour.Queries++
+	if blocked {
+		minute.Blocked++
+		hour.Blocked++
+		increment(hour.BlockedDomains, domain)
+	} else {
+		increment(hour.AllowedDomains, domain)
+	}
+	increment(hour.Clients, client)
+	s.dirty = true
+}
+
+// bucket returns the bucket starting at start, adding it if needed and
+// dropping the buckets older than the retention. A new bucket with names trims
+// the previous one to its top names. A bucket older than the newest one, e.g.
+// for a query that took longer than a later one, is inserted in order unless
+// it is beyond the retention.
+func bucket(buckets *[]Bucket, start time.Time, retention time.Duration, named bool) *Bucket {
+	list := *buckets
+	i := sort.Search(len(list), func(i int) bool { return !list[i].Start.Before(start) })
+	if i < len(list) && list[i].Start.Equal(start) {
+		return &list[i]
+	}
+
+	if i < len(list) {
+		if start.Before(list[len(list)-1].Start.Add(-retention)) {
+			return nil
+		}
+		list = append(list, Bucket{})
+		copy(list[i+1:], list[i:])
+		list[i] = Bucket{Start: start}
+		if named {
+			initNames(&list[i])
+		}
+		*buckets = list
+		return &list[i]
+	}
+
+	if named && len(list) > 0 {
+		trim(&list[len(list)-1])
+	}
+	list = append(dropBefore(list, start.Add(-retention)), Bucket{Start: start})
+	if named {
+		initNames(&list[len(list)-1])
+	}
+	*buckets = list
+	return &list[len(list)-1]
+}
+
+// initNames creates the name maps of a per-hour bucket, which are left out of
+// the file while empty
+func initNames(bucket *Bucket) {
+	if bucket.BlockedDomains == nil {
+		bucket.BlockedDomains = make(map[string]uint64)
+	}
+	if bucket.AllowedDomains == nil {
+		bucket.AllowedDomains = make(map[string]uint64)
+	}
+	if bucket.Clients == nil {
+		bucket.Clients = make(map[string]uint64)
+	}
+}
+
+// dropBefore returns the buckets starting at or after a time
+func dropBefore(buckets []Bucket, cutoff time.Time) []Bucket {
+	i := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Start.Before(cutoff) })
+	if i == 0 {
+		return buckets
+	}
+	return append([]Bucket(nil), buckets[i:]...)
+}
+
+// increment counts a name, unless the map is full and the name is new
+func increment(counts map[string]uint64, name string) {
+	if _, exists := counts[name]; exists || len(counts) < maxHourKeys {
+		counts[name]++
+	}
+}
+
+// trim keeps the most queried names of a finished per-hour bucket
+func trim(bucket *Bucket) {
+	bucket.BlockedDomains = topMap(bucket.BlockedDomains, maxKeptKeys)
+	bucket.AllowedDomains = topMap(bucket.AllowedDomains, maxKeptKeys)
+	bucket.Clients = topMap(bucket.Clients, maxKeptKeys)
+}
+
+// topMap returns the n most counted names of a map
+func topMap(counts map[string]uint64, n int) map[string]uint64 {
+	if len(counts) <= n {
+		return counts
+	}
+	result := make(map[string]uint64, n)
+	for _, count := range top(counts, n) {
+		result[count.Name] = count.Count
+	}
+	return result
+}
+
+// top returns the n most counted names, ties sorted by name
+func top(counts map[string]uint64, n int) []Count {
+	result := make([]Count, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, Count{Name: name, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// ParsePeriod parses the length of a statistics period: a duration like
+// "90m" or "24h", or a number of days like "7d", up to 30 days
+func ParsePeriod(value string) (time.Duration, error) {
+	var period time.Duration
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %s", value)
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		period, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %s", value)
+		}
+	}
+
+	if period < time.Minute || period > HourRetention {
+		return 0, fmt.Errorf("period must be between 1m and 30d")
+	}
+	return period, nil
+}
+
+// Summarize returns the statistics of the period before now with the n most
+// queried names. Totals and the timeline of periods up to a day come from the
+// per-minute buckets; longer periods and the top lists use the per-hour
+// buckets overlapping the period.
+func (s *Store) Summarize(now time.Time, period time.Duration, n int) Summary {
+	if n <= 0 {
+		n = defaultTop
+	}
+	if n > maxTop {
+		n = maxTop
+	}
+
+	summary := Summary{
+		Period: formatPeriod(period),
+		From:   now.Add(-period),
+		To:     now,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Totals and timeline
+	step, buckets := time.Hour, s.hours
+	if period <= MinuteRetention {
+		step, buckets = time.Minute, s.minutes
+	}
+	index := make(map[int64]*Bucket, len(buckets))
+	for i := range buckets {
+		index[buckets[i].Start.Unix()] = &buckets[i]
+	}
+	summary.Timeline = []Point{}
+	for t := summary.From.Truncate(step); t.Before(now); t = t.Add(step) {
+		point := Point{Time: t}
+		if bucket, exists := index[t.Unix()]; exists {
+			point.Queries = bucket.Queries
+			point.Blocked = bucket.Blocked
+		}
+		summary.Timeline = append(summary.Timeline, point)
+		summary.Queries += point.Queries
+		summary.Blocked += point.Blocked
+	}
+	summary.Allowed = summary.Queries - summary.Blocked
+	if summary.Queries > 0 {
+		summary.BlockRatio = float64(summary.Blocked) / float64(summary.Queries)
+	}
+
+	// Top lists
+	blocked := make(map[string]uint64)
+	allowed := make(map[string]uint64)
+	clients := make(map[string]uint64)
+	from := summary.From.Truncate(time.Hour)
+	for i := range s.hours {
+		bucket := &s.hours[i]
+		if bucket.Start.Before(from) {
+			continue
+		}
+		for name, count := range bucket.BlockedDomains {
+			blocked[name] += count
+		}
+		for name, count := range bucket.AllowedDomains {
+			allowed[name] += count
+		}
+		for name, count := range bucket.Clients {
+			clients[name] += count
+		}
+	}
+	summary.TopBlockedDomains = top(blocked, n)
+	summary.TopAllowedDomains = top(allowed, n)
+	summary.TopClients = top(clients, n)
+
+	return summary
+}
+
+// formatPeriod formats a period like ParsePeriod accepts it, whole days
+// beyond the first as days
+func formatPeriod(period time.Duration) string {
+	if period > 24*time.Hour && period%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(period/(24*time.Hour))) + "d"
+	}
+	text := strings.TrimSuffix(period.String(), "0s")
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
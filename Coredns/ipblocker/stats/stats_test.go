@@ -0,0 +1,238 @@
+package stats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTime is a whole hour, so that periods end on a bucket boundary
+var testTime = time.Date(2025, 4, 12, 12, 0, 0, 0, time.UTC)
+
+// newTestStore returns an empty store saving to a temporary directory
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	s := New(filepath.Join(t.TempDir(), "stats.json"))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRollover(t *testing.T) {
+	s := newTestStore(t)
+
+	tests := []struct {
+		time    time.Time
+		minutes int
+		hours   int
+	}{
+		{testTime, 1, 1},
+		{testTime.Add(30 * time.Second), 1, 1},
+		{testTime.Add(time.Minute), 2, 1},
+		{testTime.Add(61 * time.Minute), 3, 2},
+		{testTime.Add(25 * time.Hour), 2, 3},      // Minutes before 13:00 the day before are dropped
+		{testTime.Add(32 * 24 * time.Hour), 1, 1}, // Everything else is beyond the retention
+		{testTime.Add(32*24*time.Hour + time.Second), 1, 1},
+	}
+
+	for i, tc := range tests {
+		s.Record(tc.time, "10.0.0.1", "example.com", false)
+		if len(s.minutes) != tc.minutes || len(s.hours) != tc.hours {
+			t.Errorf("Test %d: expected %d minutes and %d hours, got %d and %d", i, tc.minutes, tc.hours, len(s.minutes), len(s.hours))
+		}
+	}
+
+	last := s.hours[len(s.hours)-1]
+	if last.Queries != 2 || last.AllowedDomains["example.com"] != 2 || last.Clients["10.0.0.1"] != 2 {
+		t.Errorf("Expected the last hour to count 2 queries, got %+v", last)
+	}
+}
+
+func TestOutOfOrderRecord(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Record(testTime.Add(6*time.Minute+time.Second), "10.0.0.1", "example.com", false)
+	s.Record(testTime.Add(5*time.Minute+59*time.Second), "10.0.0.1", "ads.example.com", true)
+	s.Record(testTime.Add(-time.Minute), "10.0.0.2", "example.com", false)
+	s.Record(testTime.Add(-25*time.Hour), "10.0.0.2", "example.com", false) // Beyond the minute retention
+
+	starts := func(buckets []Bucket) []string {
+		var result []string
+		for _, bucket := range buckets {
+			result = append(result, bucket.Start.Format("15:04"))
+		}
+		return result
+	}
+	if minutes := fmt.Sprint(starts(s.minutes)); minutes != "[11:59 12:05 12:06]" {
+		t.Errorf("Expected the minutes in order, got %s", minutes)
+	}
+	if hours := fmt.Sprint(starts(s.hours)); hours != "[11:00 12:00]" {
+		t.Errorf("Expected the hours in order, got %s", hours)
+	}
+
+	summary := s.Summarize(testTime.Add(time.Hour), 2*time.Hour, 0)
+	if summary.Queries != 3 || summary.Blocked != 1 {
+		t.Errorf("Expected 3 queries with 1 blocked, got %d with %d", summary.Queries, summary.Blocked)
+	}
+	if !reflect.DeepEqual(summary.TopClients, []Count{{"10.0.0.1", 2}, {"10.0.0.2", 1}}) {
+		t.Errorf("Expected both clients in the top list, got %v", summary.TopClients)
+	}
+}
+
+func TestTopTrimming(t *testing.T) {
+	s := newTestStore(t)
+
+	// Domain i is queried i+1 times in the first hour
+	for i := 0; i < 150; i++ {
+		for j := 0; j <= i; j++ {
+			s.Record(testTime, "10.0.0.1", fmt.Sprintf("d%d.example.com", i), false)
+		}
+	}
+	if top := s.Summarize(testTime.Add(time.Minute), time.Hour, 1000).TopAllowedDomains; len(top) != maxTop || top[0].Name != "d149.example.com" {
+		t.Errorf("Expected the top list to be limited to %d names starting with d149, got %d", maxTop, len(top))
+	}
+	if top := s.Summarize(testTime.Add(time.Minute), time.Hour, 0).TopAllowedDomains; len(top) != defaultTop {
+		t.Errorf("Expected %d names by default, got %d", defaultTop, len(top))
+	}
+
+	// The first hour is trimmed to its most queried names once the next starts
+	s.Record(testTime.Add(time.Hour), "10.0.0.1", "example.com", false)
+	first := s.hours[0]
+	if len(first.AllowedDomains) != maxKeptKeys || first.Queries != 150*151/2 {
+		t.Errorf("Expected %d names kept and all queries counted, got %d names and %d queries", maxKeptKeys, len(first.AllowedDomains), first.Queries)
+	}
+	if first.AllowedDomains["d50.example.com"] != 51 || first.AllowedDomains["d49.example.com"] != 0 {
+		t.Errorf("Expected d50 to be kept and d49 to be dropped, got %d and %d",
+			first.AllowedDomains["d50.example.com"], first.AllowedDomains["d49.example.com"])
+	}
+
+	// New names beyond the limit of the current hour are not counted by name
+	for i := 0; i <= maxHourKeys; i++ {
+		s.Record(testTime.Add(time.Hour), fmt.Sprintf("client-%d", i), "example.com", false)
+	}
+	s.Record(testTime.Add(time.Hour), "10.0.0.1", "example.com", false)
+	last := s.hours[1]
+	if len(last.Clients) != maxHourKeys || last.Clients["10.0.0.1"] != 2 || last.Queries != maxHourKeys+3 {
+		t.Errorf("Expected %d clients with 10.0.0.1 counted twice, got %d clients with %d", maxHourKeys, len(last.Clients), last.Clients["10.0.0.1"])
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		value  string
+		period time.Duration
+		err    bool
+	}{
+		{"1m", time.Minute, false},
+		{"90m", 90 * time.Minute, false},
+		{"24h", 24 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"30d", HourRetention, false},
+		{"30s", 0, true},
+		{"31d", 0, true},
+		{"721h", 0, true},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"day", 0, true},
+	}
+
+	for i, tc := range tests {
+		period, err := ParsePeriod(tc.value)
+		if (err != nil) != tc.err || period != tc.period {
+			t.Errorf("Test %d: expected %s to parse to %v with error %v, got %v with %v", i, tc.value, tc.period, tc.err, period, err)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := newTestStore(t)
+
+	s.Record(testTime.Add(-29*24*time.Hour), "10.0.0.4", "old.example.com", false)
+	s.Record(testTime.Add(-3*24*time.Hour), "10.0.0.3", "ads.example.com", true)
+	s.Record(testTime.Add(-2*time.Hour), "10.0.0.2", "www.example.com", false)
+	s.Record(testTime.Add(-30*time.Second), "10.0.0.1", "example.com", false)
+
+	tests := []struct {
+		value    string
+		period   string // As formatted in the summary
+		timeline int
+		queries  uint64
+		blocked  uint64
+		clients  int // From the per-hour buckets overlapping the period
+	}{
+		{"1m", "1m", 1, 1, 0, 1},
+		{"90m", "1h30m", 90, 1, 0, 2},
+		{"24h", "24h", 1440, 2, 0, 2},
+		{"7d", "7d", 168, 3, 1, 3},
+		{"30d", "30d", 720, 4, 1, 4},
+	}
+
+	for i, tc := range tests {
+		period, err := ParsePeriod(tc.value)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error parsing %s, got %v", i, tc.value, err)
+		}
+		summary := s.Summarize(testTime, period, 0)
+
+		if summary.Period != tc.period || !summary.From.Equal(testTime.Add(-period)) || !summary.To.Equal(testTime) {
+			t.Errorf("Test %d: expected period %s before %v, got %s from %v to %v", i, tc.period, testTime, summary.Period, summary.From, summary.To)
+		}
+		if len(summary.Timeline) != tc.timeline {
+			t.Errorf("Test %d: expected %d points, got %d", i, tc.timeline, len(summary.Timeline))
+		}
+		if summary.Queries != tc.queries || summary.Blocked != tc.blocked || summary.Allowed != tc.queries-tc.blocked {
+			t.Errorf("Test %d: expected %d queries with %d blocked, got %d with %d blocked and %d allowed",
+				i, tc.queries, tc.blocked, summary.Queries, summary.Blocked, summary.Allowed)
+		}
+		if ratio := float64(tc.blocked) / float64(tc.queries); summary.BlockRatio != ratio {
+			t.Errorf("Test %d: expected block ratio %v, got %v", i, ratio, summary.BlockRatio)
+		}
+		if len(summary.TopClients) != tc.clients {
+			t.Errorf("Test %d: expected %d clients, got %v", i, tc.clients, summary.TopClients)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	s := newTestStore(t)
+
+	now := time.Now()
+	s.Record(now.Add(-2*time.Hour), "10.0.0.2", "www.example.com", false)
+	s.Record(now.Add(-time.Minute), "10.0.0.1", "ads.example.com", true)
+	s.Record(now, "10.0.0.1", "example.com", false)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Expected no error saving, got %v", err)
+	}
+
+	loaded := New(s.path)
+	defer loaded.Close()
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Expected no error loading, got %v", err)
+	}
+	for _, period := range []time.Duration{time.Hour, 7 * 24 * time.Hour} {
+		want, got := s.Summarize(now.Add(time.Minute), period, 0), loaded.Summarize(now.Add(time.Minute), period, 0)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected the loaded statistics of %v to be %+v, got %+v", period, want, got)
+		}
+	}
+
+	// Loaded hours count names again, including maps left out of the file
+	loaded.Record(now.Add(-2*time.Hour), "10.0.0.2", "ads.example.com", true)
+	if summary := loaded.Summarize(now.Add(time.Minute), 3*time.Hour, 0); summary.Blocked != 2 || len(summary.TopBlockedDomains) != 1 {
+		t.Errorf("Expected 2 blocked queries of one domain after loading, got %d of %v", summary.Blocked, summary.TopBlockedDomains)
+	}
+
+	// Unchanged statistics are not written again
+	if err := os.Remove(s.path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("Expected no error saving, got %v", err)
+	}
+	if _, err := os.Stat(s.path); !os.IsNotExist(err) {
+		t.Errorf("Expected unchanged statistics not to be saved, got %v", err)
+	}
+}